@@ -0,0 +1,110 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Names of the activation sockets adopted by Engine, set with
+// FileDescriptorName= in the .socket units
+const (
+	SocketHTTP     = "http"
+	SocketHTTPS    = "https"
+	SocketRedirect = "redirect"
+)
+
+// First file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// activation holds the inherited listeners not yet taken by an Engine
+var activation struct {
+	once      sync.Once
+	mu        sync.Mutex
+	listeners map[string][]net.Listener
+	err       error
+}
+
+// Listeners returns the sockets passed by systemd socket activation
+// (LISTEN_FDS, LISTEN_FDNAMES), keyed by FileDescriptorName; sockets without
+// a name are under "unknown". Nil when the process was not socket activated.
+// The environment is cleared on the first call so children do not inherit it.
+// Listeners an Engine has adopted are no longer returned.
+func Listeners() (map[string][]net.Listener, error) {
+	activation.once.Do(func() {
+		activation.listeners, activation.err = activationListeners(listenFDsStart)
+	})
+	activation.mu.Lock()
+	defer activation.mu.Unlock()
+	if activation.listeners == nil {
+		return nil, activation.err
+	}
+	listeners := map[string][]net.Listener{}
+	for name, list := range activation.listeners {
+		listeners[name] = append([]net.Listener(nil), list...)
+	}
+	return listeners, activation.err
+}
+
+// takeListener removes and returns the first inherited listener with one
+// of the names, nil when there is none
+func takeListener(names ...string) net.Listener {
+	// sockets that failed to convert are reported by Listeners
+	Listeners()
+	activation.mu.Lock()
+	defer activation.mu.Unlock()
+	for _, name := range names {
+		if list := activation.listeners[name]; len(list) > 0 {
+			activation.listeners[name] = list[1:]
+			return list[0]
+		}
+	}
+	return nil
+}
+
+// Read the activation environment, the sockets start at descriptor first
+func activationListeners(first int) (map[string][]net.Listener, error) {
+	pid, count := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if count == "" {
+		return nil, nil
+	}
+	names := os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != strconv.Itoa(os.Getpid()) {
+		// meant for another process, e.g. inherited through a wrapper
+		return nil, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("socket activation: invalid LISTEN_FDS %q", count)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+
+	listeners := map[string][]net.Listener{}
+	var errs []error
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		file := os.NewFile(uintptr(first+i), name)
+		listener, err := net.FileListener(file)
+		// FileListener works on a duplicate
+		file.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("socket activation: %s (fd %d): %w", name, first+i, err))
+			continue
+		}
+		listeners[name] = append(listeners[name], listener)
+	}
+	return listeners, errors.Join(errs...)
+}
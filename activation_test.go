@@ -0,0 +1,98 @@
+package daemon
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestActivationListeners(t *testing.T) {
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+	// duplicate them next to each other, as systemd passes them
+	var files []*os.File
+	for _, listener := range listeners {
+		file, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files = append(files, file)
+	}
+	first := int(files[0].Fd())
+	if int(files[1].Fd()) != first+1 {
+		t.Skip("duplicated descriptors are not consecutive")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "2")
+	if listeners, err := activationListeners(first); listeners != nil || err != nil {
+		t.Errorf("sockets of another pid adopted: %v %v", listeners, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("activation environment not cleared")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	t.Setenv("LISTEN_FDNAMES", "https:")
+	adopted, err := activationListeners(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(adopted[SocketHTTPS]) != 1 || len(adopted["unknown"]) != 1 {
+		t.Fatalf("unexpected listeners %v", adopted)
+	}
+	if adopted[SocketHTTPS][0].Addr().String() != listeners[0].Addr().String() {
+		t.Errorf("https is %v, want %v", adopted[SocketHTTPS][0].Addr(), listeners[0].Addr())
+	}
+	for _, list := range adopted {
+		list[0].Close()
+	}
+}
+
+func TestEngineAdoptsListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if systemd passed it in
+	Listeners()
+	activation.mu.Lock()
+	activation.listeners = map[string][]net.Listener{SocketHTTP: {listener}}
+	activation.mu.Unlock()
+	defer func() {
+		activation.mu.Lock()
+		activation.listeners = nil
+		activation.mu.Unlock()
+	}()
+
+	engine := NewEngineWithOptions(EngineOptions{})
+	engine.GET("/ping", func(c *gin.Context) { c.String(200, "pong") })
+	// the address is not bindable, only the inherited listener can serve
+	engine.Start("192.0.2.1:1")
+	defer engine.Shutdown()
+	resp, err := http.Get("http://" + listener.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "pong" {
+		t.Errorf("unexpected response %q", body)
+	}
+	if takeListener(SocketHTTP) != nil {
+		t.Errorf("listener handed out twice")
+	}
+}
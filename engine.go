@@ -15,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -60,6 +61,13 @@ type Engine struct {
 	opts        EngineOptions
 	autocertMgr *autocert.Manager
 	closeOnce   sync.Once
+	notifier    *Notifier
+
+	// User 设置时, 降权成功后关闭; listener 绑定后等它再 Serve
+	dropped  chan struct{}
+	dropOnce sync.Once
+	// Shutdown 开始后置位, 这时 keptListener 才真正关闭
+	closing atomic.Bool
 }
 
 // EngineOptions controls gin mode, middleware defaults, and HTTP server timeouts.
@@ -97,6 +105,20 @@ type EngineOptions struct {
 	HSTS bool
 	// HSTS max-age, 默认 180 天 (15552000s)。仅 HSTS=true 时生效。
 	HSTSMaxAge int
+
+	// 在 systemd Type=notify 下运行时, 默认在所有 listener 绑定端口后发 READY=1,
+	// Shutdown 时发 STOPPING=1, 并按 WATCHDOG_USEC 的一半间隔喂 watchdog。
+	// 设 true 关闭 (例如程序自己在 Engine 之外还有初始化, 想自己调 Notifier().Ready())。
+	DisableNotify bool
+
+	// 以 root 启动 (绑定 :80 / :443) 时, 所有 listener 绑定端口后切换到这个用户和组
+	// (setgroups 为用户的附加组 + setgid + setuid), 之后不再有 root 权限。Group 为空用
+	// 用户的主组。切换前 CertsDir 和 TUS 目录的属主改为该用户, 保证证书续期和上传可写。
+	// 切换失败时 fail closed: listener 不会开始 Serve, 进程记日志后以 1 退出。
+	// 已经以该用户运行 (例如 unit 的 User=) 时什么都不做。仅 unix。
+	// 降权发生在同一次 Start / StartTLS 的 listener 都绑定之后, 之后再绑定特权端口会失败。
+	User  string
+	Group string
 }
 
 func (opts *EngineOptions) effectiveReadHeaderTimeout() time.Duration {
@@ -129,6 +151,17 @@ func (opts *EngineOptions) effectiveShutdownTimeout() time.Duration {
 	}
 	return 5 * time.Second
 }
+// CertsDir 为空时用可执行文件同级 ./certs。
+func (opts *EngineOptions) effectiveCertsDir() (string, error) {
+	if opts.CertsDir != "" {
+		return opts.CertsDir, nil
+	}
+	ex, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(filepath.Dir(ex), "certs"), nil
+}
 func (opts *EngineOptions) effectiveGzipExcluded() []string {
 	if opts.GzipExcludedExtensions != nil {
 		return opts.GzipExcludedExtensions
@@ -163,6 +196,11 @@ func NewEngineWithOptions(opts EngineOptions) *Engine {
 		gin.DefaultErrorWriter = os.Stderr
 	}
 
+	// 证书目录要在 hardening 的只读系统里可写, install 时加进 ReadWritePaths
+	if certPath, err := opts.effectiveCertsDir(); err == nil {
+		addWritablePath(certPath)
+	}
+
 	router := gin.New()
 	if opts.AccessLog {
 		router.Use(gin.Logger())
@@ -188,12 +226,24 @@ func NewEngineWithOptions(opts EngineOptions) *Engine {
 		})
 	}
 
-	return &Engine{
+	engine := &Engine{
 		Engine:   router,
 		httpsrv:  nil,
 		httpsrvs: nil,
 		opts:     opts,
 	}
+	if !opts.DisableNotify {
+		engine.notifier = defaultNotifier()
+	}
+	if opts.User != "" || opts.Group != "" {
+		engine.dropped = make(chan struct{})
+	}
+	return engine
+}
+
+// Notifier 返回 Engine 使用的 systemd notify client, DisableNotify 时为 nil (方法都是 no-op)。
+func (engine *Engine) Notifier() *Notifier {
+	return engine.notifier
 }
 
 func (engine *Engine) Start(addr string) {
@@ -208,7 +258,8 @@ func (engine *Engine) Start(addr string) {
 		WriteTimeout:      engine.opts.effectiveWriteTimeout(),
 		IdleTimeout:       engine.opts.effectiveIdleTimeout(),
 	}
-	go engine.listenLoop(engine.httpsrv, false)
+	bound := engine.readyAfter(1)
+	go engine.listenLoop(engine.httpsrv, false, takeListener(SocketHTTP), bound)
 }
 
 func (engine *Engine) StartTLS(addr string, hosts ...string) error {
@@ -216,13 +267,9 @@ func (engine *Engine) StartTLS(addr string, hosts ...string) error {
 		return errors.New("at least one host must be specified for TLS autocert")
 	}
 
-	certPath := engine.opts.CertsDir
-	if certPath == "" {
-		ex, err := os.Executable()
-		if err != nil {
-			return err
-		}
-		certPath = path.Join(filepath.Dir(ex), "certs")
+	certPath, err := engine.opts.effectiveCertsDir()
+	if err != nil {
+		return err
 	}
 	if _, err := os.Stat(certPath); os.IsNotExist(err) {
 		if err := os.MkdirAll(certPath, 0700); err != nil {
@@ -239,6 +286,7 @@ func (engine *Engine) StartTLS(addr string, hosts ...string) error {
 		Cache:      autocert.DirCache(certPath),
 	}
 
+	bound := engine.readyAfter(engine.listeners())
 	if !engine.opts.DisableHTTPRedirect {
 		engine.httpsrv = &http.Server{
 			Addr: ":http",
@@ -258,7 +306,7 @@ func (engine *Engine) StartTLS(addr string, hosts ...string) error {
 			WriteTimeout:      engine.opts.effectiveWriteTimeout(),
 			IdleTimeout:       engine.opts.effectiveIdleTimeout(),
 		}
-		go engine.listenLoop(engine.httpsrv, false)
+		go engine.listenLoop(engine.httpsrv, false, takeListener(SocketRedirect, SocketHTTP), bound)
 	}
 
 	engine.httpsrvs = &http.Server{
@@ -270,7 +318,7 @@ func (engine *Engine) StartTLS(addr string, hosts ...string) error {
 		WriteTimeout:      engine.opts.effectiveWriteTimeout(),
 		IdleTimeout:       engine.opts.effectiveIdleTimeout(),
 	}
-	go engine.listenLoop(engine.httpsrvs, true)
+	go engine.listenLoop(engine.httpsrvs, true, takeListener(SocketHTTPS), bound)
 	return nil
 }
 
@@ -280,6 +328,7 @@ func (engine *Engine) StartTLSWithConfig(addr string, config *tls.Config) error
 	}
 
 	// 跟 StartTLS 行为对齐: 默认同步起 (DisableHTTPRedirect=true 时跳过) :http 做 301 重定向。
+	bound := engine.readyAfter(engine.listeners())
 	if !engine.opts.DisableHTTPRedirect {
 		engine.httpsrv = &http.Server{
 			Addr: ":http",
@@ -299,7 +348,7 @@ func (engine *Engine) StartTLSWithConfig(addr string, config *tls.Config) error
 			WriteTimeout:      engine.opts.effectiveWriteTimeout(),
 			IdleTimeout:       engine.opts.effectiveIdleTimeout(),
 		}
-		go engine.listenLoop(engine.httpsrv, false)
+		go engine.listenLoop(engine.httpsrv, false, takeListener(SocketRedirect, SocketHTTP), bound)
 	}
 
 	engine.httpsrvs = &http.Server{
@@ -311,33 +360,111 @@ func (engine *Engine) StartTLSWithConfig(addr string, config *tls.Config) error
 		WriteTimeout:      engine.opts.effectiveWriteTimeout(),
 		IdleTimeout:       engine.opts.effectiveIdleTimeout(),
 	}
-	go engine.listenLoop(engine.httpsrvs, true)
+	go engine.listenLoop(engine.httpsrvs, true, takeListener(SocketHTTPS), bound)
 	return nil
 }
 
-// listenLoop 跑 ListenAndServe (TLS), 失败时退避重试。
+// listeners 是 StartTLS / StartTLSWithConfig 要绑定的端口数: https, 加上可选的 :http 重定向。
+func (engine *Engine) listeners() int {
+	if engine.opts.DisableHTTPRedirect {
+		return 1
+	}
+	return 2
+}
+
+// readyAfter 返回给每个 listener 绑定成功后调用一次的回调; n 个都绑定后先按 User / Group
+// 降权, 再发 READY=1 并开始喂 watchdog。这样 systemctl start 会等到端口真正可用才返回。
+// 有 listener 最终放弃时不会发 READY (也不会降权, 其它 listener 一直不 Serve),
+// 交给 systemd 的启动超时判失败。
+func (engine *Engine) readyAfter(n int) func() {
+	if !engine.notifier.Enabled() && engine.dropped == nil {
+		return nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	go func() {
+		wg.Wait()
+		if engine.dropped != nil {
+			var err error
+			engine.dropOnce.Do(func() {
+				if err = dropPrivileges(engine.opts.User, engine.opts.Group, writablePaths()); err == nil {
+					close(engine.dropped)
+				}
+			})
+			if err != nil {
+				privilegeDropFailed(engine.opts.User, err)
+				return
+			}
+		}
+		if err := engine.notifier.Ready(); err != nil {
+			log.Printf("[daemon] sd_notify READY: %v", err)
+		}
+		engine.notifier.StartWatchdog()
+	}()
+	return wg.Done
+}
+
+// 降权失败时 fail closed: 不能继续以 root 服务, 直接退出让 init 系统看到失败。测试里替换。
+var privilegeDropFailed = func(user string, err error) {
+	log.Fatalf("[daemon] drop privileges to %s: %v", user, err)
+}
+
+// listenLoop 先 Listen 再 Serve (TLS), 失败时退避重试。bound 在第一次绑定成功后调用。
+// ln 非 nil 时是 systemd socket activation 传进来的 listener (见 Listeners), 直接用它,
+// 不再自己绑定 Addr — 这样不需要 root 就能服务 80/443, systemd 重启服务时也不丢连接。
 //
 // 之前 listenGo / listenTLSGo 用固定 5s sleep 死循环重试, 端口被占 / 配置错时
 // 日志会无限刷屏。这里改用指数退避 + 最大尝试次数, Graceful 关闭时直接退出。
-func (engine *Engine) listenLoop(srv *http.Server, tlsMode bool) {
+func (engine *Engine) listenLoop(srv *http.Server, tlsMode bool, ln net.Listener, bound func()) {
 	const maxRetries = 10
 	const baseDelay = 1 * time.Second
 	const maxDelay = 60 * time.Second
 
 	attempts := 0
+	if ln != nil {
+		log.Printf("[daemon] %s: using socket activation listener %s", srv.Addr, ln.Addr())
+	}
 	for {
 		var err error
-		if tlsMode {
-			err = srv.ListenAndServeTLS("", "")
-		} else {
-			err = srv.ListenAndServe()
+		if ln == nil {
+			ln, err = net.Listen("tcp", srv.Addr)
+		}
+		if err == nil {
+			if bound != nil {
+				bound()
+				bound = nil
+				if engine.dropped != nil {
+					// 降权之前不以 root 服务任何请求
+					<-engine.dropped
+				}
+			}
+			serveLn := ln
+			if engine.dropped != nil {
+				// 降权后绑不了特权端口了, Serve 出错时不关 ln, 重试沿用它
+				serveLn = &keptListener{Listener: ln, engine: engine}
+			}
+			if tlsMode {
+				err = srv.ServeTLS(serveLn, "", "")
+			} else {
+				err = srv.Serve(serveLn)
+			}
+			if engine.dropped == nil {
+				// Serve 已经关掉了 ln, 重试时自己重新绑定
+				ln = nil
+			}
 		}
 		if err == nil || errors.Is(err, http.ErrServerClosed) {
+			if ln != nil {
+				ln.Close()
+			}
 			log.Printf("[daemon] %s closed", srv.Addr)
 			return
 		}
 		attempts++
 		if attempts >= maxRetries {
+			if ln != nil {
+				ln.Close()
+			}
 			log.Printf("[daemon] %s gave up after %d retries: %v", srv.Addr, attempts, err)
 			return
 		}
@@ -360,9 +487,27 @@ func (engine *Engine) Graceful() {
 	engine.Shutdown()
 }
 
+// keptListener 是降权后交给 Serve 的 listener: Serve 出错返回时关不掉它, 只有 Shutdown 能。
+type keptListener struct {
+	net.Listener
+	engine *Engine
+}
+
+func (ln *keptListener) Close() error {
+	if !ln.engine.closing.Load() {
+		return nil
+	}
+	return ln.Listener.Close()
+}
+
 // Shutdown 主动触发 graceful shutdown (不等信号), 可在外部上下文已经收到关闭意图时调用。
 func (engine *Engine) Shutdown() {
 	engine.closeOnce.Do(func() {
+		engine.closing.Store(true)
+		if err := engine.notifier.Stopping(); err != nil {
+			log.Printf("[daemon] sd_notify STOPPING: %v", err)
+		}
+		defer engine.notifier.StopWatchdog()
 		timeout := engine.opts.effectiveShutdownTimeout()
 		shutdown := func(srv *http.Server, label string) {
 			if srv == nil {
@@ -381,6 +526,7 @@ func (engine *Engine) Shutdown() {
 
 func (engine *Engine) TUSFileComposer(p string) *tusd.StoreComposer {
 	composer := tusd.NewStoreComposer()
+	addWritablePath(p)
 	locker := filelocker.New(p)
 	locker.UseIn(composer)
 	engine.TUSFileStore = filestore.New(p)
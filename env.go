@@ -0,0 +1,125 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	takama "github.com/zdypro888/daemon/internal/daemon"
+)
+
+// EnvFile returns the path of the environment file of the service:
+// /etc/default/<name>, /etc/sysconfig/<name> on the Red Hat family, next to
+// the unit for a user service. systemd reads it through EnvironmentFile=,
+// upstart and SysV source it; its variables override the Environment of
+// the install options. Linux only.
+func (service *Service) EnvFile() (string, error) {
+	editor, ok := service.Daemon.(takama.EnvEditor)
+	if !ok {
+		return "", ErrUnsupportedSystem
+	}
+	return editor.EnvFile(), nil
+}
+
+// Env returns the variables of the environment file as KEY=VALUE, in file order
+func (service *Service) Env() ([]string, error) {
+	editor, ok := service.Daemon.(takama.EnvEditor)
+	if !ok {
+		return nil, ErrUnsupportedSystem
+	}
+	return editor.Env()
+}
+
+// GetEnv returns the value of one variable of the environment file, false
+// when it is not set
+func (service *Service) GetEnv(key string) (string, bool, error) {
+	vars, err := service.Env()
+	if err != nil {
+		return "", false, err
+	}
+	for _, v := range vars {
+		if k, value, _ := strings.Cut(v, "="); k == key {
+			return value, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// SetEnv adds or replaces variables given as KEY=VALUE in the environment
+// file. A new file is only readable by root, it may hold secrets. The
+// running service sees the change once restarted.
+func (service *Service) SetEnv(vars ...string) error {
+	editor, ok := service.Daemon.(takama.EnvEditor)
+	if !ok {
+		return ErrUnsupportedSystem
+	}
+	return editor.SetEnv(vars...)
+}
+
+// UnsetEnv removes variables from the environment file
+func (service *Service) UnsetEnv(keys ...string) error {
+	editor, ok := service.Daemon.(takama.EnvEditor)
+	if !ok {
+		return ErrUnsupportedSystem
+	}
+	return editor.UnsetEnv(keys...)
+}
+
+// The env command of Console: env list|get KEY|set KEY=VAL...|unset KEY...,
+// set and unset take --restart to restart the running service
+func (service *Service) envCommand(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: env list|get|set|unset", ErrNoCommand)
+	}
+	envCmd := service.flagSet("env " + args[0])
+	restart := envCmd.Bool("restart", false, "Restart the service after the change when it is running")
+	if err := parseFlags(envCmd, args[1:]); err != nil {
+		return err
+	}
+
+	var err error
+	switch args[0] {
+	case "list":
+		var vars []string
+		if vars, err = service.Env(); err == nil {
+			for _, v := range vars {
+				fmt.Fprintln(w, v)
+			}
+		}
+		return err
+	case "get":
+		if envCmd.NArg() != 1 {
+			return errors.New("usage: env get KEY")
+		}
+		value, found, err := service.GetEnv(envCmd.Arg(0))
+		if err == nil && !found {
+			path, _ := service.EnvFile()
+			err = fmt.Errorf("%s is not set in %s", envCmd.Arg(0), path)
+		}
+		if err == nil {
+			fmt.Fprintln(w, value)
+		}
+		return err
+	case "set":
+		if envCmd.NArg() == 0 {
+			return errors.New("usage: env set [--restart] KEY=VALUE...")
+		}
+		err = service.SetEnv(envCmd.Args()...)
+	case "unset":
+		if envCmd.NArg() == 0 {
+			return errors.New("usage: env unset [--restart] KEY...")
+		}
+		err = service.UnsetEnv(envCmd.Args()...)
+	default:
+		return fmt.Errorf("%w: env list|get|set|unset", ErrNoCommand)
+	}
+	if err != nil || !*restart {
+		return err
+	}
+	if status, err := service.Query(); err != nil || status.State != StateRunning {
+		// a stopped service reads the file when it starts
+		return err
+	}
+	return service.Restart()
+}
@@ -0,0 +1,131 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A systemd service installed under a temporary root
+func newEnvService(t *testing.T, sysconfig bool) (*Service, string) {
+	t.Helper()
+	root := t.TempDir()
+	dirs := []string{"run/systemd/system", "etc/systemd/system"}
+	if sysconfig {
+		dirs = append(dirs, "etc/sysconfig")
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	service, err := NewServiceWithConfig(Config{Name: "my-app", Description: "my app", Root: root, Runner: nopRunner{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service, root
+}
+
+// nopRunner runs no command and reports success
+type nopRunner struct{}
+
+func (nopRunner) Run(string, ...string) error              { return nil }
+func (nopRunner) Output(string, ...string) ([]byte, error) { return nil, nil }
+
+func TestEnv(t *testing.T) {
+	service, root := newEnvService(t, false)
+	if path, err := service.EnvFile(); err != nil || path != "/etc/default/my-app" {
+		t.Fatalf("env file %q, %v", path, err)
+	}
+	if vars, err := service.Env(); err != nil || len(vars) != 0 {
+		t.Fatalf("env of a missing file: %v, %v", vars, err)
+	}
+
+	if err := service.SetEnv("DB_PASSWORD=s3cr3t 'x'", "PORT=8080"); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.SetEnv("PORT=9090", "LOG_LEVEL=debug"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"DB_PASSWORD=s3cr3t 'x'", "PORT=9090", "LOG_LEVEL=debug"}
+	if vars, err := service.Env(); err != nil || !reflect.DeepEqual(vars, want) {
+		t.Errorf("got %q, %v, want %q", vars, err, want)
+	}
+	path := filepath.Join(root, "etc/default/my-app")
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("env file mode %v, %v, want 0600", info, err)
+	}
+	content, _ := os.ReadFile(path)
+	if !strings.Contains(string(content), `DB_PASSWORD='s3cr3t '\''x'\'''`+"\n") {
+		t.Errorf("value is not quoted for the shell:\n%s", content)
+	}
+
+	// comments and the mode an admin gave the file stay
+	os.WriteFile(path, append([]byte("# managed by ops\n"), content...), 0640)
+	os.Chmod(path, 0640)
+	if err := service.UnsetEnv("DB_PASSWORD", "MISSING"); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := service.GetEnv("PORT"); err != nil || !found || value != "9090" {
+		t.Errorf("get PORT: %q, %v, %v", value, found, err)
+	}
+	if _, found, _ := service.GetEnv("DB_PASSWORD"); found {
+		t.Error("DB_PASSWORD still set after unset")
+	}
+	content, _ = os.ReadFile(path)
+	if info, _ := os.Stat(path); !strings.HasPrefix(string(content), "# managed by ops\n") || info.Mode().Perm() != 0640 {
+		t.Errorf("file not kept as is (%v):\n%s", info.Mode(), content)
+	}
+
+	if err := service.SetEnv("BAD-KEY=1"); err == nil {
+		t.Error("an invalid key was accepted")
+	}
+	if err := service.SetEnv("CERT=line one\nline two"); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("a value spanning lines was accepted: %v", err)
+	}
+}
+
+func TestEnvFileReplaced(t *testing.T) {
+	service, root := newEnvService(t, false)
+	if err := service.SetEnv("PORT=8080"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "etc/default/my-app")
+	before, _ := os.Stat(path)
+	if os.Getuid() == 0 {
+		os.Chown(path, 1000, 1000)
+	}
+	if err := service.SetEnv("PORT=9090"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("env file rewritten in place")
+	}
+	if stat := after.Sys().(*syscall.Stat_t); os.Getuid() == 0 && (stat.Uid != 1000 || stat.Gid != 1000) {
+		t.Errorf("owner %d:%d not kept", stat.Uid, stat.Gid)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temporary files left: %v", entries)
+	}
+}
+
+func TestEnvFileInUnit(t *testing.T) {
+	service, _ := newEnvService(t, true)
+	plan, err := service.RenderWithOptions(InstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit := plan.Actions[0].Content; !strings.Contains(unit, "EnvironmentFile=-/etc/sysconfig/my-app\n") {
+		t.Errorf("unit does not read the env file:\n%s", unit)
+	}
+}
@@ -6,6 +6,10 @@
 //	sudo ./example-service install --args="arg1 arg2"
 //	sudo ./example-service start
 //	sudo ./example-service status
+//	sudo ./example-service status --output json
+//	sudo ./example-service restart
+//	sudo ./example-service reload
+//	sudo ./example-service logs -f -n 50
 //	sudo ./example-service stop
 //	sudo ./example-service remove
 package main
@@ -13,6 +17,7 @@ package main
 import (
 	"errors"
 	"log"
+	"os"
 
 	"github.com/zdypro888/daemon"
 )
@@ -37,9 +42,16 @@ func main() {
 			service.Usage()
 			return
 		}
-		log.Fatalf("service command failed: %v", err)
+		// 退出码是稳定的 (见 daemon.ExitCode), 脚本可以据此判断; status 没在运行时按 LSB 返回 1/3/4
+		log.Printf("service command failed: %v", err)
+		os.Exit(daemon.ExitCode(err))
 	}
 
+	// reload 子命令会给进程发 SIGHUP
+	service.OnReload(func() {
+		log.Printf("reload requested")
+	})
+
 	// 阻塞直到收到 SIGINT/SIGTERM
 	service.Graceful()
 }
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Directories the process writes to: the certificates of the Engine, the
+// TUS uploads and the RedirectLog file. Under a hardening profile the
+// system is read-only, install adds them to ReadWritePaths; dropping
+// privileges hands them to the user.
+var writable struct {
+	sync.Mutex
+	paths []string
+}
+
+// Remember a directory the process writes to
+func addWritablePath(path string) {
+	if path == "" {
+		return
+	}
+	writable.Lock()
+	defer writable.Unlock()
+	if !slices.Contains(writable.paths, path) {
+		writable.paths = append(writable.paths, path)
+	}
+}
+
+// The directories registered with addWritablePath
+func writablePaths() []string {
+	writable.Lock()
+	defer writable.Unlock()
+	return slices.Clone(writable.paths)
+}
+
+// WritablePaths declares the directories the service writes to, such as
+// the CertsDir of its Engine or its TUS upload directory. A hardened
+// install adds them to ReadWritePaths and DropPrivileges gives them to the
+// user. Call it before Console: install runs before any Engine is built,
+// the paths an Engine registers by itself are only known to the process
+// serving.
+func (service *Service) WritablePaths(paths ...string) {
+	for _, path := range paths {
+		if path != "" && !slices.Contains(service.writePaths, path) {
+			service.writePaths = append(service.writePaths, path)
+		}
+	}
+}
+
+// The directories the service writes to: those declared with WritablePaths
+// and those the process registered
+func (service *Service) writableDirs() []string {
+	paths := slices.Clone(service.writePaths)
+	for _, path := range writablePaths() {
+		if !slices.Contains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// ReadWritePaths for a hardened install: the paths of opts and those the
+// service declared or the process registered. A relative path is resolved against the working
+// directory of the service, / when it has none, as the service will see it.
+// The registered ones are prefixed with - as they may not exist yet.
+func (service *Service) readWritePaths(opts InstallOptions) []string {
+	registered := service.writableDirs()
+	if service.logFile != "" {
+		registered = append(registered, filepath.Dir(service.logFile))
+	}
+
+	paths := slices.Clone(opts.ReadWritePaths)
+	for _, path := range registered {
+		if !filepath.IsAbs(path) {
+			base := opts.WorkingDirectory
+			if base == "" {
+				base = "/"
+			}
+			path = filepath.Join(base, path)
+		}
+		path = filepath.Clean(path)
+		if path == "/" {
+			// a log next to / would make the whole system writable again
+			continue
+		}
+		if !slices.Contains(paths, path) && !slices.Contains(paths, "-"+path) {
+			paths = append(paths, "-"+path)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallWritablePaths(t *testing.T) {
+	// install runs before any Engine is built, nothing is registered
+	writable.Lock()
+	saved := writable.paths
+	writable.paths = nil
+	writable.Unlock()
+	t.Cleanup(func() {
+		writable.Lock()
+		writable.paths = saved
+		writable.Unlock()
+	})
+
+	service, root := newEnvService(t, false)
+	service.WritablePaths("/etc/my-app/certs", "/var/uploads")
+	target, flags, err := service.selectTarget([]string{"--hardening", "strict", "--read-write", "/var/lib/my-app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := target.console(os.Stdout, "install", flags); err != nil {
+		t.Fatal(err)
+	}
+	unit, err := os.ReadFile(filepath.Join(root, "etc/systemd/system/my-app.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ReadWritePaths=/var/lib/my-app -/etc/my-app/certs -/var/uploads"
+	if !strings.Contains(string(unit), want) {
+		t.Errorf("unit does not have %q:\n%s", want, unit)
+	}
+}
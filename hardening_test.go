@@ -0,0 +1,36 @@
+package daemon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadWritePaths(t *testing.T) {
+	writable.Lock()
+	saved := writable.paths
+	writable.paths = nil
+	writable.Unlock()
+	t.Cleanup(func() {
+		writable.Lock()
+		writable.paths = saved
+		writable.Unlock()
+	})
+
+	addWritablePath("/etc/my-app/certs")
+	addWritablePath("uploads")
+	addWritablePath("uploads")
+	service := &Service{logFile: "service.log"}
+
+	opts := InstallOptions{ReadWritePaths: []string{"/var/lib/my-app", "/etc/my-app/certs"}}
+	want := []string{"/var/lib/my-app", "/etc/my-app/certs", "-/uploads"}
+	if got := service.readWritePaths(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// relative paths are where the service will find them
+	opts = InstallOptions{WorkingDirectory: "/srv/my-app"}
+	want = []string{"-/etc/my-app/certs", "-/srv/my-app/uploads", "-/srv/my-app"}
+	if got := service.readWritePaths(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -6,8 +6,12 @@ package daemon
 
 import (
 	"errors"
+	"fmt"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Status constants.
@@ -26,6 +30,10 @@ type Daemon interface {
 	// Install the service into the system
 	Install(args ...string) error
 
+	// InstallWithOptions - install the service with user, environment,
+	// limits and restart policy settings
+	InstallWithOptions(opts InstallOptions) error
+
 	// Remove the service and all corresponding files from the system
 	Remove() error
 
@@ -35,13 +43,150 @@ type Daemon interface {
 	// Stop the service
 	Stop() error
 
+	// Restart the service, starts it if it is not running
+	Restart() error
+
+	// Reload - ask the running service to reload its configuration (SIGHUP)
+	Reload() error
+
 	// Status - check the service status
 	Status() (string, error)
 
+	// Query - get the structured service status
+	Query() (*ServiceStatus, error)
+
 	// Run - run executable service
 	Run(e Executable) error
 }
 
+// State is the lifecycle state of a service as reported by the init system
+type State string
+
+const (
+	// StateUnknown - the init system could not tell what the service is doing
+	StateUnknown State = "unknown"
+
+	// StateNotInstalled - the service is not installed
+	StateNotInstalled State = "not-installed"
+
+	// StateStopped - the service is installed but not running
+	StateStopped State = "stopped"
+
+	// StateStarting - the service is being started
+	StateStarting State = "starting"
+
+	// StateRunning - the service is up and running
+	StateRunning State = "running"
+
+	// StateStopping - the service is being stopped
+	StateStopping State = "stopping"
+
+	// StateFailed - the service exited abnormally and was not restarted
+	StateFailed State = "failed"
+)
+
+// ServiceStatus is the structured status of a service. Fields the backend
+// cannot determine are left at their zero value.
+type ServiceStatus struct {
+	// State - what the service is doing right now
+	State State `json:"state"`
+
+	// PID - main process id, 0 when not running or unknown
+	PID int `json:"pid,omitempty"`
+
+	// StartedAt - when the main process was started
+	StartedAt time.Time `json:"started_at,omitempty"`
+
+	// Restarts - how many times the init system restarted the service
+	Restarts int `json:"restarts"`
+
+	// ExitCode - exit code of the last main process run
+	ExitCode int `json:"exit_code"`
+
+	// Enabled - whether the service starts at boot
+	Enabled bool `json:"enabled"`
+
+	// UnitPath - path of the installed unit, init script or job file
+	UnitPath string `json:"unit_path,omitempty"`
+
+	// UpToDate - whether the installed files match what the current
+	// binary renders from the recorded install options, nil when unknown
+	UpToDate *bool `json:"up_to_date,omitempty"`
+
+	// LastTrigger - when the timer of a scheduled job last started it
+	LastTrigger time.Time `json:"last_trigger,omitempty"`
+
+	// NextTrigger - when the timer of a scheduled job starts it next, zero
+	// when the timer is not active
+	NextTrigger time.Time `json:"next_trigger,omitempty"`
+}
+
+// Uptime - how long the main process has been running
+func (status *ServiceStatus) Uptime() time.Duration {
+	if status.State != StateRunning || status.StartedAt.IsZero() {
+		return 0
+	}
+	return time.Since(status.StartedAt)
+}
+
+// String - human readable form of the status, with the runs of a job
+func (status *ServiceStatus) String() string {
+	text := status.state()
+	if !status.LastTrigger.IsZero() {
+		text += ", last run " + status.LastTrigger.Format("2006-01-02 15:04:05")
+	}
+	if !status.NextTrigger.IsZero() {
+		text += ", next run " + status.NextTrigger.Format("2006-01-02 15:04:05")
+	}
+	return text
+}
+
+// Human readable form of the state
+func (status *ServiceStatus) state() string {
+	switch status.State {
+	case StateNotInstalled:
+		return statNotInstalled
+	case StateRunning:
+		if status.PID > 0 {
+			return "Service (pid  " + strconv.Itoa(status.PID) + ") is running..."
+		}
+		return "Service is running..."
+	case StateStarting:
+		return "Service is starting..."
+	case StateStopping:
+		return "Service is stopping..."
+	case StateFailed:
+		return "Service has failed (exit code " + strconv.Itoa(status.ExitCode) + ")"
+	case StateUnknown:
+		return "Service status is unknown"
+	}
+	return "Service is stopped"
+}
+
+// Renderer is implemented by the daemons that can show what Install would
+// write and run without touching the system
+type Renderer interface {
+	// Render - the plan InstallWithOptions would apply
+	Render(opts InstallOptions) (*Plan, error)
+}
+
+// PIDFiler is implemented by the daemons whose init system expects the
+// service to write its pid to a file: the PIDFile= of the systemd unit, the
+// pidfile of the SysV script. OpenRC keeps its own, the service gets
+// another one.
+type PIDFiler interface {
+	// PIDFile - path of the pid file of the service process, empty when it
+	// has none of its own
+	PIDFile() string
+}
+
+// BackendNamer is implemented by the daemons that can name the init system
+// they install the service with, one of Backends on linux
+type BackendNamer interface {
+	// Backend - name of the init system
+	Backend() string
+}
+
 // Executable interface defines controlling methods of executable service
 type Executable interface {
 	// Start - non-blocking start service
@@ -76,8 +221,73 @@ const (
 	// system-wide daemons provided by the administrator. Valid for FreeBSD, Linux
 	// and Windows only.
 	SystemDaemon Kind = "SystemDaemon"
+
+	// UserDaemon is a user daemon managed by the systemd user manager of the
+	// current user (systemctl --user) and stored in ~/.config/systemd/user. It
+	// needs no root privileges. Valid for Linux with systemd only.
+	UserDaemon Kind = "UserDaemon"
 )
 
+// Config - parameters of a daemon created with NewWithConfig
+type Config struct {
+	// Name - name of the service
+	Name string
+
+	// Description - any explanation, what is the service, its purpose
+	Description string
+
+	// Kind - what kind of daemon to create
+	Kind Kind
+
+	// Dependencies - services this one requires and starts after, the same
+	// as listing them in both Requires and After
+	Dependencies []string
+
+	// Requires - services that must run, this one fails to start without
+	// them and stops when they are stopped
+	Requires []string
+
+	// Wants - services started along with this one, it runs without them
+	Wants []string
+
+	// After - services this one starts after, ordering only
+	After []string
+
+	// Before - services this one starts before, ordering only
+	Before []string
+
+	// BindsTo - like Requires, and this one also stops when they stop by themselves
+	BindsTo []string
+
+	// PartOf - this one is stopped and restarted along with them
+	PartOf []string
+
+	// Conflicts - services that cannot run alongside this one
+	Conflicts []string
+
+	// Instance - run the service as one instance of a template: a
+	// name@.service template unit started as name@instance.service on
+	// systemd, one name@instance script per instance on SysV and upstart.
+	// Args may use the %i specifier for the instance name. Linux only.
+	Instance string
+
+	// Backend - init system to install the service with instead of the
+	// detected one, one of Backends. Linux only.
+	Backend string
+
+	// Root - filesystem prefix the linux backends read and write their
+	// files under, the live system when empty. Root privileges are not
+	// required when a prefix is set.
+	Root string
+
+	// Runner - runs the init-system commands of the linux backends,
+	// os/exec when nil
+	Runner Runner
+}
+
+// Backends - the linux init systems Config.Backend may name
+var Backends = []string{"systemd", "openrc", "upstart", "sysv", "runit", "s6"}
+
 // New - Create a new daemon
 //
 // name: name of the service
@@ -86,24 +296,72 @@ const (
 //
 // kind: what kind of daemon to create
 func New(name, description string, kind Kind, dependencies ...string) (Daemon, error) {
+	return NewWithConfig(Config{
+		Name:         name,
+		Description:  description,
+		Kind:         kind,
+		Dependencies: dependencies,
+	})
+}
+
+// NewWithConfig - Create a new daemon from a full config
+func NewWithConfig(config Config) (Daemon, error) {
 	switch runtime.GOOS {
 	case "darwin":
-		if kind == SystemDaemon {
+		if config.Kind == SystemDaemon {
 			return nil, errors.New("invalid daemon kind specified")
 		}
 	case "freebsd":
-		if kind != SystemDaemon {
+		if config.Kind != SystemDaemon {
 			return nil, errors.New("invalid daemon kind specified")
 		}
 	case "linux":
-		if kind != SystemDaemon {
+		if config.Kind != SystemDaemon && config.Kind != UserDaemon {
 			return nil, errors.New("invalid daemon kind specified")
 		}
 	case "windows":
-		if kind != SystemDaemon {
+		if config.Kind != SystemDaemon {
 			return nil, errors.New("invalid daemon kind specified")
 		}
 	}
 
-	return newDaemon(strings.Join(strings.Fields(name), "_"), description, kind, dependencies)
+	if config.Instance != "" {
+		if runtime.GOOS != "linux" {
+			return nil, ErrUnsupportedSystem
+		}
+		if !validInstance(config.Instance) {
+			return nil, fmt.Errorf("invalid instance name %q, use letters, digits and - _ . :", config.Instance)
+		}
+	}
+
+	if err := config.ValidateDependencies(); err != nil {
+		return nil, err
+	}
+
+	// both end up on a line of the unit, script or cron file
+	if hasControl(config.Name) || hasControl(config.Description) {
+		return nil, fmt.Errorf("invalid name or description %q %q, they must fit on one line", config.Name, config.Description)
+	}
+
+	if config.Backend != "" {
+		if runtime.GOOS != "linux" {
+			return nil, ErrUnsupportedSystem
+		}
+		if !slices.Contains(Backends, config.Backend) {
+			return nil, fmt.Errorf("invalid backend %q, use one of %s", config.Backend, strings.Join(Backends, ", "))
+		}
+	}
+
+	config.Name = strings.Join(strings.Fields(config.Name), "_")
+	return newDaemon(&config)
+}
+
+// An instance name ends up in unit, script and pid file names
+func validInstance(instance string) bool {
+	for _, r := range instance {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return instance != "" && instance[0] != '.'
 }
@@ -6,11 +6,17 @@
 package daemon
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"text/template"
 )
 
@@ -19,12 +25,17 @@ type darwinRecord struct {
 	name         string
 	description  string
 	kind         Kind
-	dependencies []string
+	dependencies unitDependencies
 }
 
-func newDaemon(name, description string, kind Kind, dependencies []string) (Daemon, error) {
+// Backend - the init system the service is installed with
+func (darwin *darwinRecord) Backend() string {
+	return "launchd"
+}
+
+func newDaemon(config *Config) (Daemon, error) {
 
-	return &darwinRecord{name, description, kind, dependencies}, nil
+	return &darwinRecord{config.Name, config.Description, config.Kind, config.dependencies()}, nil
 }
 
 // Standard service path for system daemons
@@ -61,57 +72,98 @@ func execPath() (string, error) {
 
 // Check service is running
 func (darwin *darwinRecord) checkRunning() (string, bool) {
+	status := darwin.queryStatus()
+	return status.String(), status.State == StateRunning
+}
+
+// Ask launchd for the job state
+func (darwin *darwinRecord) queryStatus() *ServiceStatus {
+	// jobs are loaded at boot or login as long as the property list exists
+	status := &ServiceStatus{State: StateStopped, UnitPath: darwin.servicePath(), Enabled: true}
 	output, err := exec.Command("launchctl", "list", darwin.name).Output()
-	if err == nil {
-		if matched, err := regexp.MatchString(darwin.name, string(output)); err == nil && matched {
-			reg := regexp.MustCompile("PID\" = ([0-9]+);")
-			data := reg.FindStringSubmatch(string(output))
-			if len(data) > 1 {
-				return "Service (pid  " + data[1] + ") is running...", true
-			}
-			return "Service is running...", true
-		}
+	if err != nil {
+		return status
 	}
-
-	return "Service is stopped", false
+	if matched, err := regexp.MatchString(darwin.name, string(output)); err != nil || !matched {
+		return status
+	}
+	if data := regexp.MustCompile("\"LastExitStatus\" = (-?[0-9]+);").FindStringSubmatch(string(output)); len(data) > 1 {
+		status.ExitCode, _ = strconv.Atoi(data[1])
+	}
+	status.State = StateRunning
+	if data := regexp.MustCompile("PID\" = ([0-9]+);").FindStringSubmatch(string(output)); len(data) > 1 {
+		status.PID, _ = strconv.Atoi(data[1])
+	}
+	return status
 }
 
 // Install the service
 func (darwin *darwinRecord) Install(args ...string) error {
+	return darwin.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options, launchd honours
+// the user, group, working directory, environment and restart policy
+func (darwin *darwinRecord) InstallWithOptions(opts InstallOptions) error {
 	ok, err := checkPrivileges()
 	if !ok && darwin.kind != UserAgent {
 		return err
 	}
 
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if opts.isTimer() {
+		// no timer or cron equivalent is generated here
+		return ErrUnsupportedSystem
+	}
+
 	srvPath := darwin.servicePath()
 
 	if darwin.isInstalled() {
 		return ErrAlreadyInstalled
 	}
 
-	file, err := os.Create(srvPath)
+	execPatch, err := executablePath(darwin.name)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	execPatch, err := executablePath(darwin.name)
+	templ, err := template.New("propertyList").Parse(propertyList)
 	if err != nil {
 		return err
 	}
 
-	templ, err := template.New("propertyList").Parse(propertyList)
-	if err != nil {
+	workDir := opts.WorkingDirectory
+	if workDir == "" {
+		workDir = "/usr/local/var"
+	}
+	data := &struct {
+		Name, Path              string
+		Args                    []string
+		User, Group, WorkingDir string
+		Environment             []envVar
+		KeepAlive               bool
+	}{
+		Name:       darwin.name,
+		Path:       execPatch,
+		Args:       opts.Args,
+		User:       opts.User,
+		Group:      opts.Group,
+		WorkingDir: workDir,
+		KeepAlive:  opts.Restart != "no",
+	}
+	data.Environment = newTemplateData(darwin.name, darwin.description, darwin.dependencies, execPatch, &opts).Environment
+
+	// render fully before touching the disk so a failure leaves nothing behind
+	var content strings.Builder
+	if err := templ.Execute(&content, data); err != nil {
 		return err
 	}
 
-	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Path string
-			Args       []string
-		}{darwin.name, execPatch, args},
-	); err != nil {
+	if err := os.WriteFile(srvPath, []byte(content.String()), 0644); err != nil {
+		os.Remove(srvPath)
 		return err
 	}
 
@@ -129,7 +181,21 @@ func (darwin *darwinRecord) Remove() error {
 		return ErrNotInstalled
 	}
 
+	// unload first, launchd keeps running a job whose plist is gone
+	_, running := darwin.checkRunning()
+	if running {
+		if err := exec.Command("launchctl", "unload", darwin.servicePath()).Run(); err != nil {
+			return fmt.Errorf("run launchctl unload %s: %w", darwin.servicePath(), err)
+		}
+	}
+
 	if err := os.Remove(darwin.servicePath()); err != nil {
+		if running {
+			// put the job back as it was
+			if loadErr := exec.Command("launchctl", "load", darwin.servicePath()).Run(); loadErr != nil {
+				return fmt.Errorf("remove %s: %w; rollback failed: run launchctl load: %w", darwin.servicePath(), err, loadErr)
+			}
+		}
 		return err
 	}
 
@@ -182,21 +248,83 @@ func (darwin *darwinRecord) Stop() error {
 	return nil
 }
 
+// Restart the service
+func (darwin *darwinRecord) Restart() error {
+
+	ok, err := checkPrivileges()
+	if !ok && darwin.kind != UserAgent {
+		return err
+	}
+
+	if !darwin.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := darwin.checkRunning(); ok {
+		if err := exec.Command("launchctl", "unload", darwin.servicePath()).Run(); err != nil {
+			return err
+		}
+	}
+
+	if err := exec.Command("launchctl", "load", darwin.servicePath()).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reload the service configuration
+func (darwin *darwinRecord) Reload() error {
+
+	ok, err := checkPrivileges()
+	if !ok && darwin.kind != UserAgent {
+		return err
+	}
+
+	if !darwin.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	status := darwin.queryStatus()
+	if status.State != StateRunning || status.PID == 0 {
+		return ErrAlreadyStopped
+	}
+
+	return syscall.Kill(status.PID, syscall.SIGHUP)
+}
+
 // Status - Get service status
 func (darwin *darwinRecord) Status() (string, error) {
+	status, err := darwin.Query()
+	if status == nil {
+		return "", err
+	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (darwin *darwinRecord) Query() (*ServiceStatus, error) {
 
 	ok, err := checkPrivileges()
 	if !ok && darwin.kind != UserAgent {
-		return "", err
+		return nil, err
 	}
 
 	if !darwin.isInstalled() {
-		return statNotInstalled, ErrNotInstalled
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
 	}
 
-	statusAction, _ := darwin.checkRunning()
+	return darwin.queryStatus(), nil
+}
 
-	return statusAction, nil
+// Logs - print the files launchd redirects the service output to
+func (darwin *darwinRecord) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+
+	if !darwin.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	return Tail(ctx, w, opts, "/usr/local/var/log/"+darwin.name+".log", "/usr/local/var/log/"+darwin.name+".err")
 }
 
 // Run - Run service
@@ -221,7 +349,7 @@ var propertyList = `<?xml version="1.0" encoding="UTF-8"?>
 <plist version="1.0">
 <dict>
 	<key>KeepAlive</key>
-	<true/>
+	{{if .KeepAlive}}<true/>{{else}}<false/>{{end}}
 	<key>Label</key>
 	<string>{{.Name}}</string>
 	<key>ProgramArguments</key>
@@ -233,7 +361,16 @@ var propertyList = `<?xml version="1.0" encoding="UTF-8"?>
 	<key>RunAtLoad</key>
 	<true/>
     <key>WorkingDirectory</key>
-    <string>/usr/local/var</string>
+    <string>{{html .WorkingDir}}</string>{{if .User}}
+    <key>UserName</key>
+    <string>{{html .User}}</string>{{end}}{{if .Group}}
+    <key>GroupName</key>
+    <string>{{html .Group}}</string>{{end}}{{if .Environment}}
+    <key>EnvironmentVariables</key>
+    <dict>{{range .Environment}}
+        <key>{{html .Key}}</key>
+        <string>{{html .Value}}</string>{{end}}
+    </dict>{{end}}
     <key>StandardErrorPath</key>
     <string>/usr/local/var/log/{{.Name}}.err</string>
     <key>StandardOutPath</key>
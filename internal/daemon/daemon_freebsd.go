@@ -11,6 +11,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -20,7 +21,12 @@ type bsdRecord struct {
 	name         string
 	description  string
 	kind         Kind
-	dependencies []string
+	dependencies unitDependencies
+}
+
+// Backend - the init system the service is installed with
+func (bsd *bsdRecord) Backend() string {
+	return "rc.d"
 }
 
 // Standard service path for systemV daemons
@@ -71,8 +77,8 @@ func (bsd *bsdRecord) getCmd(cmd string) string {
 }
 
 // Get the daemon properly
-func newDaemon(name, description string, kind Kind, dependencies []string) (Daemon, error) {
-	return &bsdRecord{name, description, kind, dependencies}, nil
+func newDaemon(config *Config) (Daemon, error) {
+	return &bsdRecord{config.Name, config.Description, config.Kind, config.dependencies()}, nil
 }
 
 func execPath() (name string, err error) {
@@ -90,60 +96,82 @@ func execPath() (name string, err error) {
 
 // Check service is running
 func (bsd *bsdRecord) checkRunning() (string, bool) {
+	status := bsd.queryStatus()
+	return status.String(), status.State == StateRunning
+}
+
+// Ask rc.d for the service state, e.g. "name is running as pid 123."
+func (bsd *bsdRecord) queryStatus() *ServiceStatus {
+	status := &ServiceStatus{State: StateStopped, UnitPath: bsd.servicePath()}
+	status.Enabled, _ = bsd.isEnabled()
 	output, err := exec.Command("service", bsd.name, bsd.getCmd("status")).Output()
 	if err == nil {
 		if matched, err := regexp.MatchString(bsd.name, string(output)); err == nil && matched {
-			reg := regexp.MustCompile("pid  ([0-9]+)")
+			status.State = StateRunning
+			reg := regexp.MustCompile("pid +([0-9]+)")
 			data := reg.FindStringSubmatch(string(output))
 			if len(data) > 1 {
-				return "Service (pid  " + data[1] + ") is running...", true
+				status.PID, _ = strconv.Atoi(data[1])
 			}
-			return "Service is running...", true
 		}
 	}
-
-	return "Service is stopped", false
+	return status
 }
 
 // Install the service
 func (bsd *bsdRecord) Install(args ...string) error {
+	return bsd.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options, rc.d honours the
+// user, working directory and environment
+func (bsd *bsdRecord) InstallWithOptions(opts InstallOptions) error {
 
 	if ok, err := checkPrivileges(); !ok {
 		return err
 	}
 
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if opts.isTimer() {
+		// no timer or cron equivalent is generated here
+		return ErrUnsupportedSystem
+	}
+
 	srvPath := bsd.servicePath()
 
 	if bsd.isInstalled() {
 		return ErrAlreadyInstalled
 	}
 
-	file, err := os.Create(srvPath)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
 	execPatch, err := executablePath(bsd.name)
 	if err != nil {
 		return err
 	}
 
-	templ, err := template.New("bsdConfig").Parse(bsdConfig)
+	templ, err := template.New("bsdConfig").Funcs(templateFuncs).Parse(bsdConfig)
 	if err != nil {
 		return err
 	}
 
+	// render fully before touching the disk so a failure leaves nothing behind
+	var content strings.Builder
 	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Description, Path, Args string
-		}{bsd.name, bsd.description, execPatch, strings.Join(args, " ")},
+		&content,
+		newTemplateData(bsd.name, bsd.description, bsd.dependencies, execPatch, &opts),
 	); err != nil {
 		return err
 	}
 
+	if err := os.WriteFile(srvPath, []byte(content.String()), 0755); err != nil {
+		os.Remove(srvPath)
+		return err
+	}
+
 	if err := os.Chmod(srvPath, 0755); err != nil {
+		os.Remove(srvPath)
 		return err
 	}
 
@@ -161,7 +189,21 @@ func (bsd *bsdRecord) Remove() error {
 		return ErrNotInstalled
 	}
 
+	// stop first, rc.d cannot stop the service once the script is gone
+	_, running := bsd.checkRunning()
+	if running {
+		if err := exec.Command("service", bsd.name, bsd.getCmd("stop")).Run(); err != nil {
+			return fmt.Errorf("run service %s stop: %w", bsd.name, err)
+		}
+	}
+
 	if err := os.Remove(bsd.servicePath()); err != nil {
+		if running {
+			// put the service back as it was
+			if startErr := exec.Command("service", bsd.name, bsd.getCmd("start")).Run(); startErr != nil {
+				return fmt.Errorf("remove %s: %w; rollback failed: run service %s start: %w", bsd.servicePath(), err, bsd.name, startErr)
+			}
+		}
 		return err
 	}
 
@@ -212,20 +254,67 @@ func (bsd *bsdRecord) Stop() error {
 	return nil
 }
 
+// Restart the service
+func (bsd *bsdRecord) Restart() error {
+
+	if ok, err := checkPrivileges(); !ok {
+		return err
+	}
+
+	if !bsd.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if err := exec.Command("service", bsd.name, bsd.getCmd("restart")).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reload the service configuration
+func (bsd *bsdRecord) Reload() error {
+
+	if ok, err := checkPrivileges(); !ok {
+		return err
+	}
+
+	if !bsd.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := bsd.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := exec.Command("service", bsd.name, bsd.getCmd("reload")).Run(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // Status - Get service status
 func (bsd *bsdRecord) Status() (string, error) {
+	status, err := bsd.Query()
+	if status == nil {
+		return "", err
+	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (bsd *bsdRecord) Query() (*ServiceStatus, error) {
 
 	if ok, err := checkPrivileges(); !ok {
-		return "", err
+		return nil, err
 	}
 
 	if !bsd.isInstalled() {
-		return statNotInstalled, ErrNotInstalled
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
 	}
 
-	statusAction, _ := bsd.checkRunning()
-
-	return statusAction, nil
+	return bsd.queryStatus(), nil
 }
 
 // Run - Run service
@@ -263,8 +352,11 @@ name="{{.Name}}"
 rcvar="{{.Name}}_enable"
 command="{{.Path}}"
 pidfile="/var/run/$name.pid"
+extra_commands="reload"
+sig_reload="HUP"
 
-start_cmd="/usr/sbin/daemon -p $pidfile -f $command {{.Args}}"
+{{range .Environment}}export {{.Key}}={{shellQuote .Value}}
+{{end}}start_cmd="{{if .WorkingDirectory}}cd {{shellQuote .WorkingDirectory}} && {{end}}/usr/sbin/daemon -p $pidfile{{if .User}} -u {{.User}}{{end}} -f $command {{.Args}}"
 load_rc_config $name
 run_rc_command "$1"
 `
@@ -10,15 +10,59 @@ import (
 )
 
 // Get the daemon properly
-func newDaemon(name, description string, kind Kind, dependencies []string) (Daemon, error) {
-	// newer subsystem must be checked first
-	if _, err := os.Stat("/run/systemd/system"); err == nil {
-		return &systemDRecord{name, description, kind, dependencies}, nil
+func newDaemon(config *Config) (Daemon, error) {
+	h := newHost(config)
+	// without template units every instance is a service of its own
+	name := config.Name
+	if config.Instance != "" {
+		name += "@" + config.Instance
+	}
+	backend := config.Backend
+	if backend == "" {
+		backend = detectBackend(h)
+	}
+	if config.Kind == UserDaemon && backend != "systemd" {
+		return nil, ErrUnsupportedSystem
+	}
+	switch backend {
+	case "systemd":
+		linux := &systemDRecord{config.Name, config.Description, config.Kind, config.dependencies(), config.Instance, h}
+		h.env = linux.envFile(name)
+		return linux, nil
+	case "openrc":
+		// the configuration file OpenRC keeps for every service
+		h.env = "/etc/conf.d/" + name
+		return &openRCRecord{name, config.Description, config.Kind, config.dependencies(), config.Instance, h}, nil
 	}
-	if _, err := os.Stat("/sbin/initctl"); err == nil {
-		return &upstartRecord{name, description, kind, dependencies}, nil
+	h.env = h.envFilePath(name)
+	switch backend {
+	case "runit":
+		return &supervisedRecord{name, config.Description, config.Kind, config.dependencies(), config.Instance, h, runit}, nil
+	case "s6":
+		return &supervisedRecord{name, config.Description, config.Kind, config.dependencies(), config.Instance, h, s6}, nil
+	case "upstart":
+		return &upstartRecord{name, config.Description, config.Kind, config.dependencies(), config.Instance, h}, nil
+	}
+	return &systemVRecord{name, config.Description, config.Kind, config.dependencies(), config.Instance, h}, nil
+}
+
+// The init system running the host
+func detectBackend(h *host) string {
+	// newer subsystem must be checked first
+	switch {
+	case h.exists("/run/systemd/system"):
+		return "systemd"
+	case h.exists("/run/s6"), h.exists("/run/service/.s6-svscan"):
+		// s6-overlay and s6-linux-init
+		return "s6"
+	case h.exists("/run/runit"):
+		return "runit"
+	case h.exists("/sbin/openrc-run"):
+		return "openrc"
+	case h.exists("/sbin/initctl"):
+		return "upstart"
 	}
-	return &systemVRecord{name, description, kind, dependencies}, nil
+	return "sysv"
 }
 
 // Get executable path
@@ -0,0 +1,451 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// openRCRecord - standard record (struct) for linux OpenRC version of daemon package
+type openRCRecord struct {
+	name         string
+	description  string
+	kind         Kind
+	dependencies unitDependencies
+	instance     string
+	*host
+}
+
+// Backend - the init system the service is installed with
+func (linux *openRCRecord) Backend() string {
+	return "openrc"
+}
+
+// Standard service path for OpenRC daemons
+func (linux *openRCRecord) servicePath() string {
+	return "/etc/init.d/" + linux.name
+}
+
+// Link rc-update adds to the default runlevel
+func (linux *openRCRecord) runlevelLink() string {
+	return "/etc/runlevels/default/" + linux.name
+}
+
+// Pid file written by start-stop-daemon or supervise-daemon
+func (linux *openRCRecord) pidPath() string {
+	return "/run/" + linux.name + ".pid"
+}
+
+// PIDFile - the pid file of the service process, the one of pidPath
+// belongs to supervise-daemon
+func (linux *openRCRecord) PIDFile() string {
+	return "/run/" + linux.name + ".main.pid"
+}
+
+// Is a service installed
+func (linux *openRCRecord) isInstalled() bool {
+
+	if _, err := os.Stat(linux.path(linux.servicePath())); err == nil {
+		return true
+	}
+
+	return false
+}
+
+// Check service is running
+func (linux *openRCRecord) checkRunning() (string, bool) {
+	status := linux.queryStatus()
+	return status.String(), status.State == StateRunning
+}
+
+// Ask rc-service for the service state, e.g. " * status: started"
+func (linux *openRCRecord) queryStatus() *ServiceStatus {
+	status := &ServiceStatus{State: StateUnknown, UnitPath: linux.servicePath()}
+	if _, err := os.Lstat(linux.path(linux.runlevelLink())); err == nil {
+		status.Enabled = true
+	}
+	output, err := linux.output("rc-service", linux.name, "status")
+	var exitErr interface{ ExitCode() int }
+	if err != nil && !errors.As(err, &exitErr) {
+		return status
+	}
+	state := "started"
+	if data := regexp.MustCompile(`status: ([a-z]+)`).FindStringSubmatch(string(output)); len(data) > 1 {
+		state = data[1]
+	} else if err != nil {
+		// 3 is stopped, 32 crashed
+		state = "stopped"
+		if exitErr.ExitCode() == 32 {
+			state = "crashed"
+		}
+	}
+	switch state {
+	case "started":
+		status.State = StateRunning
+	case "starting":
+		status.State = StateStarting
+	case "stopping":
+		status.State = StateStopping
+	case "crashed":
+		status.State = StateFailed
+		return status
+	default:
+		status.State = StateStopped
+		return status
+	}
+	status.PID = linux.servicePID()
+	status.StartedAt = processStartTime(status.PID)
+	return status
+}
+
+// The pid of the service process. Under supervise-daemon pidPath names the
+// supervisor: the service is the process holding the lock of PIDFile, or
+// else the one child of the supervisor, 0 when it cannot be told.
+func (linux *openRCRecord) servicePID() int {
+	pid := readPIDFile(linux.path(linux.pidPath()))
+	if !linux.supervised() {
+		return pid
+	}
+	if main := linux.path(linux.PIDFile()); pidFileLocked(main) {
+		return readPIDFile(main)
+	}
+	return childPID(linux.path("/proc"), pid)
+}
+
+// Whether the installed script runs the service under supervise-daemon
+func (linux *openRCRecord) supervised() bool {
+	script, err := os.ReadFile(linux.path(linux.servicePath()))
+	return err == nil && strings.Contains(string(script), `supervisor="supervise-daemon"`)
+}
+
+// The only child of a process, 0 when it has none or several
+func childPID(proc string, pid int) int {
+	if pid <= 0 {
+		return 0
+	}
+	lists, _ := filepath.Glob(filepath.Join(proc, strconv.Itoa(pid), "task", "*", "children"))
+	var children []string
+	for _, list := range lists {
+		data, err := os.ReadFile(list)
+		if err == nil {
+			children = append(children, strings.Fields(string(data))...)
+		}
+	}
+	if len(children) != 1 {
+		return 0
+	}
+	child, _ := strconv.Atoi(children[0])
+	return child
+}
+
+// Install the service
+func (linux *openRCRecord) Install(args ...string) error {
+	return linux.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options
+func (linux *openRCRecord) InstallWithOptions(opts InstallOptions) error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return err
+	}
+
+	if linux.isInstalled() {
+		return ErrAlreadyInstalled
+	}
+
+	return linux.apply(plan)
+}
+
+// Render - the plan InstallWithOptions would apply
+func (linux *openRCRecord) Render(opts InstallOptions) (*Plan, error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.isTimer() {
+		// busybox crond has no /etc/cron.d to fall back to
+		return nil, fmt.Errorf("%w: scheduled jobs are not supported with OpenRC", ErrUnsupportedSystem)
+	}
+
+	execPatch, err := opts.executable(linux.name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := newTemplateData(linux.name, linux.description, linux.dependencies, execPatch, &opts)
+	data.setInstance(linux.instance)
+	data.EnvFile = linux.env
+	script, err := renderTemplate("openRCConfig", openRCConfig, data)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Backend: "openrc"}
+	plan.write(linux.servicePath(), 0755, appendInstallOptions(script, &opts))
+	plan.runUndo([]string{"rc-update", "del", linux.name, "default"}, "rc-update", "add", linux.name, "default")
+
+	return plan, nil
+}
+
+// Remove the service
+func (linux *openRCRecord) Remove() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	plan := &Plan{Backend: "openrc"}
+	if _, ok := linux.checkRunning(); ok {
+		plan.runUndo([]string{"rc-service", linux.name, "start"}, "rc-service", linux.name, "stop")
+	}
+	// a service taken out of the runlevel by hand is not an error
+	if _, err := os.Lstat(linux.path(linux.runlevelLink())); err == nil {
+		plan.runUndo([]string{"rc-update", "add", linux.name, "default"}, "rc-update", "del", linux.name, "default")
+	}
+	plan.remove(linux.servicePath())
+
+	return linux.apply(plan)
+}
+
+// Start the service
+func (linux *openRCRecord) Start() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); ok {
+		return ErrAlreadyRunning
+	}
+
+	if err := linux.run("rc-service", linux.name, "start"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stop the service
+func (linux *openRCRecord) Stop() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.run("rc-service", linux.name, "stop"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Restart the service
+func (linux *openRCRecord) Restart() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	// restart of a stopped service starts it
+	if err := linux.run("rc-service", linux.name, "restart"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reload the service configuration
+func (linux *openRCRecord) Reload() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.run("rc-service", linux.name, "reload"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Status - Get service status
+func (linux *openRCRecord) Status() (string, error) {
+	status, err := linux.Query()
+	if status == nil {
+		return "", err
+	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (linux *openRCRecord) Query() (*ServiceStatus, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return nil, err
+	}
+
+	if !linux.isInstalled() {
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
+
+	status := linux.queryStatus()
+	status.UpToDate = linux.upToDate(linux.servicePath(), linux.Render)
+	return status, nil
+}
+
+// InstalledOptions - the options the installed script was rendered with
+func (linux *openRCRecord) InstalledOptions() (*InstallOptions, error) {
+
+	if !linux.isInstalled() {
+		return nil, ErrNotInstalled
+	}
+
+	return readInstallOptions(linux.path(linux.servicePath()))
+}
+
+// Diff - changes Upgrade would make to the installed script
+func (linux *openRCRecord) Diff(opts InstallOptions) (string, error) {
+
+	if !linux.isInstalled() {
+		return "", ErrNotInstalled
+	}
+
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return linux.diff(plan), nil
+}
+
+// Upgrade - rewrite the installed script and optionally restart the
+// running service, OpenRC reads the script on every command
+func (linux *openRCRecord) Upgrade(opts InstallOptions, restart bool) (string, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return "", err
+	}
+
+	diff, err := linux.Diff(opts)
+	if err != nil || diff == "" {
+		return diff, err
+	}
+
+	plan, _ := linux.Render(opts)
+	if err := linux.rewrite(plan); err != nil {
+		return "", err
+	}
+
+	if _, ok := linux.checkRunning(); restart && ok {
+		if err := linux.run("rc-service", linux.name, "restart"); err != nil {
+			return "", err
+		}
+	}
+
+	return diff, nil
+}
+
+// Logs - print the files the script sends the service output to
+func (linux *openRCRecord) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	return Tail(ctx, w, opts, linux.path("/var/log/"+linux.name+".log"), linux.path("/var/log/"+linux.name+".err"))
+}
+
+// Run - Run service
+func (linux *openRCRecord) Run(e Executable) error {
+	e.Run()
+	return nil
+}
+
+// GetTemplate - gets service config template
+func (linux *openRCRecord) GetTemplate() string {
+	return openRCConfig
+}
+
+// SetTemplate - sets service config template
+func (linux *openRCRecord) SetTemplate(tplStr string) error {
+	openRCConfig = tplStr
+	return nil
+}
+
+var openRCConfig = `#!/sbin/openrc-run
+# {{.Name}} {{.Description}}
+
+name="{{.Name}}"
+description="{{.Description}}"
+command="{{.Path}}"
+command_args={{shellQuote .Args}}
+pidfile="/run/${RC_SVCNAME}.pid"
+{{if ne .Restart "no"}}supervisor="supervise-daemon"
+{{if .RestartSec}}respawn_delay={{.RestartSec}}
+{{end}}{{else}}command_background="yes"
+{{end}}{{if .User}}command_user="{{.User}}{{if .Group}}:{{.Group}}{{end}}"
+{{end}}{{if .WorkingDirectory}}directory={{shellQuote .WorkingDirectory}}
+{{end}}{{if .LimitNOFILE}}rc_ulimit="-n {{.LimitNOFILE}}"
+{{end}}{{if .TimeoutStopSec}}retry="TERM/{{.TimeoutStopSec}}/KILL/5"
+{{end}}output_log="/var/log/${RC_SVCNAME}.log"
+error_log="/var/log/${RC_SVCNAME}.err"
+extra_started_commands="reload"
+{{range .Environment}}export {{.Key}}={{shellQuote .Value}}
+{{end}}{{if .EnvFile}}if [ -e {{.EnvFile}} ]; then set -a; . {{.EnvFile}}; set +a; fi
+{{end}}
+depend() {
+{{.Depend}}
+}
+
+reload() {
+	ebegin "Reloading ${RC_SVCNAME}"
+{{if ne .Restart "no"}}	supervise-daemon "${RC_SVCNAME}" --signal HUP
+{{else}}	start-stop-daemon --signal HUP --pidfile "${pidfile}"
+{{end}}	eend $?
+}
+`
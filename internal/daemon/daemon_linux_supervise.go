@@ -0,0 +1,673 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// supervisor - layout and commands of a supervision suite, runit or s6
+type supervisor struct {
+	// backend - name of the suite, see Config.Backend
+	backend string
+
+	// serviceDir - where the service directories are kept
+	serviceDir string
+
+	// scanDirs - directories the scanner may watch, the first one that
+	// exists is used, the last one when none does
+	scanDirs []string
+
+	// control - the command taking up, down, restart and hangup before
+	// the service directory
+	control                   []string
+	up, down, restart, hangup string
+
+	// status - the command printing the state of the service directory
+	status      []string
+	parseStatus func(output string, status *ServiceStatus)
+
+	// rescan - tells the scanner to pick up the changes of the scan
+	// directory, nil when it looks by itself
+	rescan []string
+
+	// ready - file of the service directory created once it is supervised
+	ready string
+
+	// setuid - command prefix running the service as user and group
+	setuid func(user, group string) (string, error)
+
+	// need - shell line of the run script starting a required service
+	need func(dir string) string
+
+	// logger - the logging program, it takes the log directory last
+	logger string
+}
+
+// runit - runsvdir looks at the scan directory every 5 seconds, sv drives
+// the runsv of every service
+var runit = &supervisor{
+	backend:     "runit",
+	serviceDir:  "/etc/sv",
+	scanDirs:    []string{"/var/service", "/service", "/etc/service"},
+	control:     []string{"sv"},
+	up:          "up",
+	down:        "down",
+	restart:     "restart",
+	hangup:      "hup",
+	status:      []string{"sv", "status"},
+	parseStatus: parseRunitStatus,
+	ready:       "supervise/ok",
+	setuid: func(user, group string) (string, error) {
+		if group != "" {
+			user += ":" + group
+		}
+		return "chpst -u " + user + " ", nil
+	},
+	need: func(dir string) string {
+		return "sv start " + dir + " || exit 1"
+	},
+	logger: "svlogd -tt",
+}
+
+// s6 - s6-svscan looks at the scan directory when told to, s6-svc drives
+// the s6-supervise of every service
+var s6 = &supervisor{
+	backend:     "s6",
+	serviceDir:  "/etc/s6/sv",
+	scanDirs:    []string{"/run/service", "/service"},
+	control:     []string{"s6-svc"},
+	up:          "-u",
+	down:        "-d",
+	restart:     "-r",
+	hangup:      "-h",
+	status:      []string{"s6-svstat"},
+	parseStatus: parseS6Status,
+	rescan:      []string{"s6-svscanctl", "-a"},
+	ready:       "supervise/control",
+	setuid: func(user, group string) (string, error) {
+		if group != "" {
+			return "", optionError("Group", "s6-setuidgid runs the service with the groups of the user, a group cannot be set with s6")
+		}
+		return "s6-setuidgid " + user + " ", nil
+	},
+	need: func(dir string) string {
+		return "s6-svc -u " + dir + " && s6-svwait -u -t 10000 " + dir + " || exit 1"
+	},
+	logger: "s6-log -b n20 s1000000 T",
+}
+
+// supervisedRecord - standard record (struct) for linux runit and s6 versions of daemon package
+type supervisedRecord struct {
+	name         string
+	description  string
+	kind         Kind
+	dependencies unitDependencies
+	instance     string
+	*host
+	suite *supervisor
+}
+
+// Backend - the init system the service is installed with
+func (linux *supervisedRecord) Backend() string {
+	return linux.suite.backend
+}
+
+// superviseData - values available to the run, finish and log/run scripts
+type superviseData struct {
+	*templateData
+
+	// Backend - runit or s6
+	Backend string
+
+	// Setuid - command prefix running the service as its user
+	Setuid string
+
+	// Needs - lines starting the required services first
+	Needs []string
+
+	// Logger, LogDir - the log service, none when LogDir is empty
+	Logger, LogDir string
+}
+
+// Service directory of the service
+func (linux *supervisedRecord) servicePath() string {
+	return linux.suite.serviceDir + "/" + linux.name
+}
+
+// A file of the service directory
+func (linux *supervisedRecord) serviceFile(name string) string {
+	return linux.servicePath() + "/" + name
+}
+
+// Directory the scanner watches
+func (linux *supervisedRecord) scanDir() string {
+	for _, dir := range linux.suite.scanDirs {
+		if linux.exists(dir) {
+			return dir
+		}
+	}
+	return linux.suite.scanDirs[len(linux.suite.scanDirs)-1]
+}
+
+// Link of the service in the scan directory, the commands act on it
+func (linux *supervisedRecord) linkPath() string {
+	return linux.scanDir() + "/" + linux.name
+}
+
+// The control command taking action on the service
+func (linux *supervisedRecord) controlCommand(action string) []string {
+	return append(append([]string{}, linux.suite.control...), action, linux.linkPath())
+}
+
+// Take an action on the service through the control command
+func (linux *supervisedRecord) control(action string) error {
+	command := linux.controlCommand(action)
+	return linux.run(command[0], command[1:]...)
+}
+
+// Directory of the log service, empty when the output goes to the scanner
+func logDir(name string, opts *InstallOptions) string {
+	switch opts.LogDir {
+	case "-":
+		return ""
+	case "":
+		return "/var/log/" + name
+	}
+	return opts.LogDir
+}
+
+// Is a service installed
+func (linux *supervisedRecord) isInstalled() bool {
+
+	if _, err := os.Stat(linux.path(linux.serviceFile("run"))); err == nil {
+		return true
+	}
+
+	return false
+}
+
+// Check service is running
+func (linux *supervisedRecord) checkRunning() (string, bool) {
+	status := linux.queryStatus()
+	return status.String(), status.State == StateRunning
+}
+
+// Ask the supervisor for the service state, the service is enabled when it
+// has no down file
+func (linux *supervisedRecord) queryStatus() *ServiceStatus {
+	status := &ServiceStatus{State: StateUnknown, UnitPath: linux.serviceFile("run")}
+	status.Enabled = !linux.exists(linux.serviceFile("down"))
+	command := append(append([]string{}, linux.suite.status...), linux.linkPath())
+	output, err := linux.output(command[0], command[1:]...)
+	if err != nil && len(output) == 0 {
+		return status
+	}
+	linux.suite.parseStatus(string(output), status)
+	if status.State == StateRunning {
+		status.StartedAt = processStartTime(status.PID)
+	}
+	return status
+}
+
+// Parse sv status, e.g. "run: /var/service/app: (pid 123) 45s; run: log: ..."
+// or "down: /var/service/app: 2s, normally up, want up"
+func parseRunitStatus(output string, status *ServiceStatus) {
+	data := regexp.MustCompile(`^(\w+): [^:]*: (?:\(pid (\d+)\) )?\d+s([^;]*)`).FindStringSubmatch(output)
+	if len(data) < 4 {
+		// fail: and warning: when runsv does not supervise the service
+		return
+	}
+	switch data[1] {
+	case "run":
+		status.State = StateRunning
+		status.PID, _ = strconv.Atoi(data[2])
+		if strings.Contains(data[3], "want down") {
+			status.State = StateStopping
+		}
+	case "finish":
+		status.State = StateStopping
+	case "down":
+		status.State = StateStopped
+		if strings.Contains(data[3], "want up") {
+			// exited, runsv runs it again
+			status.State = StateStarting
+		}
+	}
+}
+
+// Parse s6-svstat, e.g. "up (pid 123) 45 seconds" or
+// "down (exitcode 1) 2 seconds, normally up, want up"
+func parseS6Status(output string, status *ServiceStatus) {
+	data := regexp.MustCompile(`^(up|down) \((pid|exitcode|signal) (\w+)\)(.*)`).FindStringSubmatch(output)
+	if len(data) < 5 {
+		return
+	}
+	if data[1] == "up" {
+		status.State = StateRunning
+		status.PID, _ = strconv.Atoi(data[3])
+		if strings.Contains(data[4], "want down") {
+			status.State = StateStopping
+		}
+		return
+	}
+	status.State = StateStopped
+	if data[2] == "exitcode" {
+		// a signal is how the service is stopped
+		status.ExitCode, _ = strconv.Atoi(data[3])
+		if status.ExitCode != 0 {
+			status.State = StateFailed
+		}
+	}
+	if strings.Contains(data[4], "want up") {
+		status.State = StateStarting
+	}
+}
+
+// Wait for the scanner to supervise a new service, runsvdir takes up to 5
+// seconds to notice it
+func (linux *supervisedRecord) waitSupervised() {
+	if !linux.isLive() {
+		return
+	}
+	for i := 0; i < 70 && !linux.exists(linux.serviceFile(linux.suite.ready)); i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Install the service
+func (linux *supervisedRecord) Install(args ...string) error {
+	return linux.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options
+func (linux *supervisedRecord) InstallWithOptions(opts InstallOptions) error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return err
+	}
+
+	if linux.isInstalled() {
+		return ErrAlreadyInstalled
+	}
+
+	return linux.apply(plan)
+}
+
+// Render - the plan InstallWithOptions would apply. The service directory
+// gets a down file so the scanner does not start the service, Start
+// removes it.
+func (linux *supervisedRecord) Render(opts InstallOptions) (*Plan, error) {
+	plan, err := linux.render(opts)
+	if err != nil {
+		return nil, err
+	}
+	plan.write(linux.serviceFile("down"), 0644, "")
+	if !linux.exists(linux.scanDir()) {
+		plan.mkdir(linux.scanDir(), 0755)
+	}
+	plan.symlink(linux.servicePath(), linux.linkPath())
+	if linux.suite.rescan != nil {
+		rescan := append(append([]string{}, linux.suite.rescan...), linux.scanDir())
+		plan.runUndo(rescan, rescan...)
+	}
+	return plan, nil
+}
+
+// The scripts of the service directory
+func (linux *supervisedRecord) render(opts InstallOptions) (*Plan, error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.isTimer() {
+		return nil, fmt.Errorf("%w: scheduled jobs are not supported with %s", ErrUnsupportedSystem, linux.suite.backend)
+	}
+
+	execPatch, err := opts.executable(linux.name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &superviseData{
+		templateData: newTemplateData(linux.name, linux.description, linux.dependencies, execPatch, &opts),
+		Backend:      linux.suite.backend,
+		Logger:       linux.suite.logger,
+		LogDir:       logDir(linux.name, &opts),
+	}
+	data.setInstance(linux.instance)
+	data.EnvFile = linux.env
+	if opts.User != "" || opts.Group != "" {
+		if data.Setuid, err = linux.suite.setuid(opts.User, opts.Group); err != nil {
+			return nil, err
+		}
+	}
+	// the suites have no targets, only services can be waited for
+	for _, name := range initNames(nil, linux.dependencies.Requires, linux.dependencies.BindsTo) {
+		data.Needs = append(data.Needs, linux.suite.need(linux.scanDir()+"/"+name))
+	}
+
+	plan := &Plan{Backend: linux.suite.backend}
+	plan.mkdir(linux.servicePath(), 0755)
+	for _, script := range []struct {
+		name, text string
+		needed     bool
+	}{
+		{"run", superviseConfig, true},
+		{"finish", superviseFinishConfig, data.Restart == "no" || data.RestartSec > 0},
+		{"log/run", superviseLogConfig, data.LogDir != ""},
+	} {
+		if !script.needed {
+			continue
+		}
+		content, err := renderTemplate(script.name, script.text, data)
+		if err != nil {
+			return nil, err
+		}
+		if script.name == "run" {
+			content = appendInstallOptions(content, &opts)
+		}
+		if script.name == "log/run" {
+			plan.mkdir(linux.serviceFile("log"), 0755)
+		}
+		plan.write(linux.serviceFile(script.name), 0755, content)
+	}
+	if linux.suite == s6 && data.RestartSec > 0 {
+		// s6-supervise kills a finish script running over 5 seconds
+		plan.write(linux.serviceFile("timeout-finish"), 0644, strconv.Itoa((data.RestartSec+5)*1000)+"\n")
+	}
+
+	return plan, nil
+}
+
+// Remove the service
+func (linux *supervisedRecord) Remove() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	plan := &Plan{Backend: linux.suite.backend}
+	if _, ok := linux.checkRunning(); ok {
+		plan.runUndo(linux.controlCommand(linux.suite.up), linux.controlCommand(linux.suite.down)...)
+	}
+	// the scanner stops supervising the service once it is unlinked
+	if _, err := os.Lstat(linux.path(linux.linkPath())); err == nil {
+		plan.remove(linux.linkPath())
+		if linux.suite.rescan != nil {
+			rescan := append(append([]string{}, linux.suite.rescan...), linux.scanDir())
+			plan.runUndo(rescan, rescan...)
+		}
+	}
+	for _, name := range []string{"run", "finish", "log/run", "down", "timeout-finish"} {
+		if _, err := os.Lstat(linux.path(linux.serviceFile(name))); err == nil {
+			plan.remove(linux.serviceFile(name))
+		}
+	}
+
+	if err := linux.apply(plan); err != nil {
+		return err
+	}
+
+	// what is left is the state the supervisor kept in the directory
+	return os.RemoveAll(linux.path(linux.servicePath()))
+}
+
+// Start the service and have it started at boot
+func (linux *supervisedRecord) Start() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); ok {
+		return ErrAlreadyRunning
+	}
+
+	if err := linux.enable(true); err != nil {
+		return err
+	}
+
+	linux.waitSupervised()
+	if err := linux.control(linux.suite.up); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Stop the service and keep it from being started at boot
+func (linux *supervisedRecord) Stop() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.control(linux.suite.down); err != nil {
+		return err
+	}
+
+	return linux.enable(false)
+}
+
+// Remove or create the down file
+func (linux *supervisedRecord) enable(up bool) error {
+	down := linux.path(linux.serviceFile("down"))
+	if !up {
+		return os.WriteFile(down, nil, 0644)
+	}
+	if err := os.Remove(down); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Restart the service
+func (linux *supervisedRecord) Restart() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	// restart of a stopped service starts it
+	if _, ok := linux.checkRunning(); !ok {
+		return linux.Start()
+	}
+
+	if err := linux.control(linux.suite.restart); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reload the service configuration
+func (linux *supervisedRecord) Reload() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.control(linux.suite.hangup); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Status - Get service status
+func (linux *supervisedRecord) Status() (string, error) {
+	status, err := linux.Query()
+	if status == nil {
+		return "", err
+	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (linux *supervisedRecord) Query() (*ServiceStatus, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return nil, err
+	}
+
+	if !linux.isInstalled() {
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
+
+	status := linux.queryStatus()
+	status.UpToDate = linux.upToDate(linux.serviceFile("run"), linux.render)
+	return status, nil
+}
+
+// InstalledOptions - the options the installed run script was rendered with
+func (linux *supervisedRecord) InstalledOptions() (*InstallOptions, error) {
+
+	if !linux.isInstalled() {
+		return nil, ErrNotInstalled
+	}
+
+	return readInstallOptions(linux.path(linux.serviceFile("run")))
+}
+
+// Diff - changes Upgrade would make to the installed scripts
+func (linux *supervisedRecord) Diff(opts InstallOptions) (string, error) {
+
+	if !linux.isInstalled() {
+		return "", ErrNotInstalled
+	}
+
+	plan, err := linux.render(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return linux.diff(plan), nil
+}
+
+// Upgrade - rewrite the installed scripts and optionally restart the
+// running service, the supervisor reads run every time it starts it. The
+// down file is left as Start and Stop set it.
+func (linux *supervisedRecord) Upgrade(opts InstallOptions, restart bool) (string, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return "", err
+	}
+
+	diff, err := linux.Diff(opts)
+	if err != nil || diff == "" {
+		return diff, err
+	}
+
+	plan, _ := linux.render(opts)
+	if err := linux.rewrite(plan); err != nil {
+		return "", err
+	}
+
+	if _, ok := linux.checkRunning(); restart && ok {
+		if err := linux.control(linux.suite.restart); err != nil {
+			return "", err
+		}
+	}
+
+	return diff, nil
+}
+
+// Logs - print the current file of the log service
+func (linux *supervisedRecord) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+
+	installed, err := linux.InstalledOptions()
+	if err != nil {
+		return err
+	}
+
+	dir := logDir(linux.name, installed)
+	if dir == "" {
+		return fmt.Errorf("%w: the service has no log service, its output goes to the %s scanner", ErrUnsupportedSystem, linux.suite.backend)
+	}
+
+	return Tail(ctx, w, opts, linux.path(dir+"/current"))
+}
+
+// Run - Run service
+func (linux *supervisedRecord) Run(e Executable) error {
+	e.Run()
+	return nil
+}
+
+// GetTemplate - gets service config template
+func (linux *supervisedRecord) GetTemplate() string {
+	return superviseConfig
+}
+
+// SetTemplate - sets service config template
+func (linux *supervisedRecord) SetTemplate(tplStr string) error {
+	superviseConfig = tplStr
+	return nil
+}
+
+var superviseConfig = `#!/bin/sh
+# {{.Name}} {{.Description}}
+exec 2>&1
+{{range .Needs}}{{.}}
+{{end}}{{range .Environment}}export {{.Key}}={{shellQuote .Value}}
+{{end}}{{if .EnvFile}}if [ -e {{.EnvFile}} ]; then set -a; . {{.EnvFile}}; set +a; fi
+{{end}}{{if .WorkingDirectory}}cd {{shellQuote .WorkingDirectory}} || exit 1
+{{end}}{{if .LimitNOFILE}}ulimit -n {{.LimitNOFILE}}
+{{end}}exec {{.Setuid}}{{.Path}} {{.Args}}
+`
+
+var superviseFinishConfig = `#!/bin/sh
+{{if eq .Restart "no"}}# {{.Name}} is not restarted
+{{if eq .Backend "s6"}}exit 125{{else}}exec sv down .{{end}}
+{{else}}# {{.Name}} is restarted after {{.RestartSec}}s
+exec sleep {{.RestartSec}}
+{{end}}`
+
+var superviseLogConfig = `#!/bin/sh
+mkdir -p {{shellQuote .LogDir}}
+exec {{.Logger}} {{shellQuote .LogDir}}
+`
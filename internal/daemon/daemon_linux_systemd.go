@@ -5,11 +5,15 @@
 package daemon
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
-	"os/exec"
-	"regexp"
+	"os/user"
+	"path/filepath"
+	"strconv"
 	"strings"
-	"text/template"
+	"time"
 )
 
 // systemDRecord - standard record (struct) for linux systemD version of daemon package
@@ -17,100 +21,375 @@ type systemDRecord struct {
 	name         string
 	description  string
 	kind         Kind
-	dependencies []string
+	dependencies unitDependencies
+	instance     string
+	*host
 }
 
-// Standard service path for systemD daemons
+// Backend - the init system the service is installed with
+func (linux *systemDRecord) Backend() string {
+	return "systemd"
+}
+
+// Standard service path for systemD daemons, the name@.service template
+// unit shared by all instances of an instance service
 func (linux *systemDRecord) servicePath() string {
-	return "/etc/systemd/system/" + linux.name + ".service"
+	if linux.instance != "" {
+		return linux.unitDir() + linux.name + "@.service"
+	}
+	return linux.unitDir() + linux.name + ".service"
+}
+
+// Path of the timer unit of a scheduled job
+func (linux *systemDRecord) timerPath() string {
+	return linux.unitDir() + linux.name + ".timer"
+}
+
+// Is the service installed as a scheduled job
+func (linux *systemDRecord) isTimer() bool {
+	return linux.instance == "" && linux.exists(linux.timerPath())
+}
+
+// Unit start and stop act on: the timer of a job, the service otherwise
+func (linux *systemDRecord) controlUnit() string {
+	if linux.isTimer() {
+		return linux.name + ".timer"
+	}
+	return linux.unitName()
+}
+
+// Name of the unit systemctl operates on, name@instance.service for an instance
+func (linux *systemDRecord) unitName() string {
+	if linux.instance != "" {
+		return linux.name + "@" + linux.instance + ".service"
+	}
+	return linux.name + ".service"
 }
 
-// Is a service installed
+// PIDFile - the PIDFile= of a system unit, user units have none
+func (linux *systemDRecord) PIDFile() string {
+	if linux.kind == UserDaemon {
+		return ""
+	}
+	return "/var/run/" + strings.TrimSuffix(linux.unitName(), ".service") + ".pid"
+}
+
+// Target the unit is wanted by once enabled
+func (linux *systemDRecord) wantedBy() string {
+	if linux.kind == UserDaemon {
+		return "default.target"
+	}
+	return "multi-user.target"
+}
+
+// Link enabling an instance, as systemctl enable creates it
+func (linux *systemDRecord) instanceLink() string {
+	return linux.unitDir() + linux.wantedBy() + ".wants/" + linux.unitName()
+}
+
+// Other instances of the template that are still installed
+func (linux *systemDRecord) otherInstances() []string {
+	links, _ := filepath.Glob(linux.path(linux.unitDir() + "*.wants/" + linux.name + "@*.service"))
+	var others []string
+	for _, link := range links {
+		if filepath.Base(link) != linux.unitName() {
+			others = append(others, filepath.Base(link))
+		}
+	}
+	return others
+}
+
+// Directory of the unit files, per-user for user services
+func (linux *systemDRecord) unitDir() string {
+	if linux.kind != UserDaemon {
+		return "/etc/systemd/system/"
+	}
+	if config := os.Getenv("XDG_CONFIG_HOME"); config != "" {
+		return filepath.Join(config, "systemd", "user") + "/"
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".config", "systemd", "user") + "/"
+}
+
+// Path of the environment file of a service or template, next to the unit
+// for a user service
+func (linux *systemDRecord) envFile(name string) string {
+	if linux.kind == UserDaemon {
+		return linux.unitDir() + name + ".env"
+	}
+	return linux.envFilePath(name)
+}
+
+// Command line of systemctl against the system or the user manager
+func (linux *systemDRecord) systemctlCommand(args ...string) []string {
+	if linux.kind == UserDaemon {
+		return append([]string{"systemctl", "--user"}, args...)
+	}
+	return append([]string{"systemctl"}, args...)
+}
+
+// Run systemctl against the system or the user manager
+func (linux *systemDRecord) systemctl(args ...string) error {
+	command := linux.systemctlCommand(args...)
+	return linux.run(command[0], command[1:]...)
+}
+
+// Run systemctl against the system or the user manager and collect its output
+func (linux *systemDRecord) systemctlOutput(args ...string) ([]byte, error) {
+	command := linux.systemctlCommand(args...)
+	return linux.output(command[0], command[1:]...)
+}
+
+// Properties of a unit, timestamps as @seconds since the epoch. systemd
+// before 248 has no --timestamp, it prints them in local time.
+func (linux *systemDRecord) show(unit, properties string) ([]byte, error) {
+	output, err := linux.systemctlOutput("show", unit, "--property="+properties, "--timestamp=unix")
+	if err != nil {
+		output, err = linux.systemctlOutput("show", unit, "--property="+properties)
+	}
+	return output, err
+}
+
+// Check root rights, user services need none
+func (linux *systemDRecord) checkPrivileges() (bool, error) {
+	if linux.kind == UserDaemon {
+		return true, nil
+	}
+	return linux.host.checkPrivileges()
+}
+
+// Is a service installed, for an instance the template and its link
 func (linux *systemDRecord) isInstalled() bool {
 
-	if _, err := os.Stat(linux.servicePath()); err == nil {
-		return true
+	if _, err := os.Stat(linux.path(linux.servicePath())); err != nil {
+		return false
+	}
+
+	if linux.instance != "" {
+		if _, err := os.Lstat(linux.path(linux.instanceLink())); err != nil {
+			return false
+		}
 	}
 
-	return false
+	return true
 }
 
-// Check service is running
+// Check service is running, for a job whether its timer is active
 func (linux *systemDRecord) checkRunning() (string, bool) {
-	output, err := exec.Command("systemctl", "status", linux.name+".service").Output()
-	if err == nil {
-		if matched, err := regexp.MatchString("Active: active", string(output)); err == nil && matched {
-			reg := regexp.MustCompile("Main PID: ([0-9]+)")
-			data := reg.FindStringSubmatch(string(output))
-			if len(data) > 1 {
-				return "Service (pid  " + data[1] + ") is running...", true
-			}
-			return "Service is running...", true
+	status := linux.queryStatus()
+	if linux.isTimer() {
+		return status.String(), linux.queryTimer(status)
+	}
+	return status.String(), status.State == StateRunning
+}
+
+// Add the last and next run of a job to its status, report whether the
+// timer is active
+func (linux *systemDRecord) queryTimer(status *ServiceStatus) bool {
+	output, err := linux.show(linux.name+".timer", "ActiveState,UnitFileState,LastTriggerUSec,NextElapseUSecRealtime")
+	if err != nil {
+		return false
+	}
+	active := false
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "ActiveState":
+			active = value == "active"
+		case "UnitFileState":
+			// the service of a job is not enabled, its timer is
+			status.Enabled = strings.HasPrefix(value, "enabled")
+		case "LastTriggerUSec":
+			status.LastTrigger = parseSystemDTime(value)
+		case "NextElapseUSecRealtime":
+			status.NextTrigger = parseSystemDTime(value)
 		}
 	}
+	return active
+}
+
+// Properties of the unit read by queryStatus
+const systemDStatusProperties = "ActiveState,SubState,MainPID,ExecMainStartTimestamp,NRestarts,ExecMainStatus,UnitFileState,FragmentPath"
 
-	return "Service is stopped", false
+// Ask systemd for the unit state
+func (linux *systemDRecord) queryStatus() *ServiceStatus {
+	status := &ServiceStatus{State: StateUnknown, UnitPath: linux.servicePath()}
+	output, err := linux.show(linux.unitName(), systemDStatusProperties)
+	if err != nil {
+		return status
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ActiveState":
+			switch value {
+			case "active", "reloading":
+				status.State = StateRunning
+			case "activating":
+				status.State = StateStarting
+			case "deactivating":
+				status.State = StateStopping
+			case "failed":
+				status.State = StateFailed
+			case "inactive":
+				status.State = StateStopped
+			}
+		case "MainPID":
+			status.PID, _ = strconv.Atoi(value)
+		case "ExecMainStartTimestamp":
+			status.StartedAt = parseSystemDTime(value)
+		case "NRestarts":
+			status.Restarts, _ = strconv.Atoi(value)
+		case "ExecMainStatus":
+			status.ExitCode, _ = strconv.Atoi(value)
+		case "UnitFileState":
+			status.Enabled = strings.HasPrefix(value, "enabled")
+		case "FragmentPath":
+			if value != "" {
+				status.UnitPath = value
+			}
+		}
+	}
+	if status.State != StateRunning {
+		status.StartedAt = time.Time{}
+	}
+	return status
 }
 
 // Install the service
 func (linux *systemDRecord) Install(args ...string) error {
+	return linux.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options
+func (linux *systemDRecord) InstallWithOptions(opts InstallOptions) error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
-	srvPath := linux.servicePath()
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return err
+	}
 
 	if linux.isInstalled() {
 		return ErrAlreadyInstalled
 	}
 
-	file, err := os.Create(srvPath)
-	if err != nil {
-		return err
+	if linux.instance != "" {
+		// the template is shared, another instance may have installed it
+		installed, err := os.ReadFile(linux.path(linux.servicePath()))
+		if err == nil && string(installed) != plan.Files()[linux.servicePath()] {
+			return fmt.Errorf("%w: %s is installed with other options, upgrade it with install --force first", ErrInvalidOptions, linux.servicePath())
+		}
 	}
-	defer file.Close()
 
-	execPatch, err := executablePath(linux.name)
-	if err != nil {
-		return err
+	return linux.apply(plan)
+}
+
+// Render - the plan InstallWithOptions would apply
+func (linux *systemDRecord) Render(opts InstallOptions) (*Plan, error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if linux.kind == UserDaemon && opts.User != "" {
+		return nil, optionError("User", "user services always run as the installing user")
+	}
+	if linux.kind == UserDaemon && opts.Group != "" {
+		return nil, optionError("Group", "user services always run as the installing user")
+	}
+
+	if linux.kind == UserDaemon && opts.Hardening != "" {
+		// the user manager cannot drop capabilities or remount the system
+		return nil, optionError("Hardening", "hardening profiles need the system manager")
 	}
 
-	templ, err := template.New("systemDConfig").Parse(systemDConfig)
+	execPatch, err := opts.executable(linux.name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Description, Dependencies, Path, Args string
-		}{
-			linux.name,
-			linux.description,
-			strings.Join(linux.dependencies, " "),
-			execPatch,
-			strings.Join(args, " "),
-		},
-	); err != nil {
-		return err
+	data := newTemplateData(linux.name, linux.description, linux.dependencies, execPatch, &opts)
+	data.UserService = linux.kind == UserDaemon
+	if linux.instance != "" {
+		if len(opts.Sockets) > 0 || data.Timer {
+			return nil, fmt.Errorf("%w: socket activation and timers are not supported for instances", ErrInvalidOptions)
+		}
+		// one template for every instance, systemd fills in %i
+		data.Name = linux.name + "@%i"
+		data.Description += " (%i)"
+		data.Instance = "%i"
 	}
+	data.EnvFile = linux.envFile(data.Name)
 
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
-		return err
+	unit, err := renderTemplate("systemDConfig", systemDConfig, data)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := exec.Command("systemctl", "enable", linux.name+".service").Run(); err != nil {
-		return err
+	units := []string{linux.unitName()}
+	plan := &Plan{Backend: "systemd", Reload: linux.systemctlCommand("daemon-reload")}
+	if linux.kind == UserDaemon {
+		plan.mkdir(linux.unitDir(), 0755)
 	}
+	plan.write(linux.servicePath(), 0644, appendInstallOptions(unit, &opts))
+	if linux.instance != "" {
+		// enable the instance by hand: systemctl enable needs the live
+		// system, and Remove tells the instances apart by their links
+		plan.mkdir(filepath.Dir(linux.instanceLink()), 0755)
+		plan.symlink(linux.servicePath(), linux.instanceLink())
+		plan.run(linux.systemctlCommand("daemon-reload")...)
+		return linux.linger(plan, opts)
+	}
+	for _, socket := range data.Sockets {
+		content, err := renderTemplate("systemDSocketConfig", systemDSocketConfig, &struct {
+			*templateData
+			Socket socketVar
+		}{data, socket})
+		if err != nil {
+			return nil, err
+		}
+		plan.write(linux.unitDir()+socket.Unit, 0644, content)
+		units = append(units, socket.Unit)
+	}
+	if data.Timer {
+		timer, err := renderTemplate("systemDTimerConfig", systemDTimerConfig, data)
+		if err != nil {
+			return nil, err
+		}
+		plan.write(linux.timerPath(), 0644, timer)
+		// the timer starts the job, the service itself is not enabled
+		units = []string{linux.name + ".timer"}
+	}
+	plan.run(linux.systemctlCommand("daemon-reload")...)
+	plan.runUndo(linux.systemctlCommand(append([]string{"disable"}, units...)...), linux.systemctlCommand(append([]string{"enable"}, units...)...)...)
 
-	return nil
+	return linux.linger(plan, opts)
+}
+
+// Finish a plan with enabling linger when asked for
+func (linux *systemDRecord) linger(plan *Plan, opts InstallOptions) (*Plan, error) {
+	if opts.Linger {
+		// keep the user manager running without an open session
+		usr, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		plan.run("loginctl", "enable-linger", usr.Username)
+	}
+	return plan, nil
 }
 
 // Remove the service
 func (linux *systemDRecord) Remove() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -118,21 +397,66 @@ func (linux *systemDRecord) Remove() error {
 		return ErrNotInstalled
 	}
 
-	if err := exec.Command("systemctl", "disable", linux.name+".service").Run(); err != nil {
-		return err
-	}
+	return linux.apply(linux.removePlan())
+}
 
-	if err := os.Remove(linux.servicePath()); err != nil {
-		return err
+// Steps of Remove: stop, disable and delete the unit and its sockets, each
+// undone if a later one fails
+func (linux *systemDRecord) removePlan() *Plan {
+	unitName := linux.unitName()
+	status := linux.queryStatus()
+	plan := &Plan{Backend: "systemd", Reload: linux.systemctlCommand("daemon-reload")}
+
+	if linux.instance != "" {
+		if status.State == StateRunning {
+			plan.runUndo(linux.systemctlCommand("start", unitName), linux.systemctlCommand("stop", unitName)...)
+		}
+		plan.remove(linux.instanceLink())
+		if len(linux.otherInstances()) == 0 {
+			// the last instance takes the template with it
+			plan.remove(linux.servicePath())
+		}
+		plan.run(linux.systemctlCommand("daemon-reload")...)
+		return plan
 	}
 
-	return nil
+	// the sockets are only known from the recorded options
+	var sockets []string
+	if opts, err := readInstallOptions(linux.path(linux.servicePath())); err == nil {
+		for _, socket := range newTemplateData(linux.name, "", unitDependencies{}, "", opts).Sockets {
+			if linux.exists(linux.unitDir() + socket.Unit) {
+				sockets = append(sockets, socket.Unit)
+			}
+		}
+	}
+	if linux.isTimer() {
+		sockets = append(sockets, linux.name+".timer")
+	}
+	if len(sockets) > 0 {
+		// a listening socket or a timer would start the service again
+		plan.runUndo(linux.systemctlCommand(append([]string{"start"}, sockets...)...), linux.systemctlCommand(append([]string{"stop"}, sockets...)...)...)
+	}
+	if status.State == StateRunning {
+		plan.runUndo(linux.systemctlCommand("start", unitName), linux.systemctlCommand("stop", unitName)...)
+	}
+	units := append([]string{unitName}, sockets...)
+	var enable []string
+	if status.Enabled {
+		enable = linux.systemctlCommand(append([]string{"enable"}, units...)...)
+	}
+	plan.runUndo(enable, linux.systemctlCommand(append([]string{"disable"}, units...)...)...)
+	for _, socket := range sockets {
+		plan.remove(linux.unitDir() + socket)
+	}
+	plan.remove(linux.servicePath())
+	plan.run(linux.systemctlCommand("daemon-reload")...)
+	return plan
 }
 
 // Start the service
 func (linux *systemDRecord) Start() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -144,7 +468,7 @@ func (linux *systemDRecord) Start() error {
 		return ErrAlreadyRunning
 	}
 
-	if err := exec.Command("systemctl", "start", linux.name+".service").Run(); err != nil {
+	if err := linux.systemctl("start", linux.controlUnit()); err != nil {
 		return err
 	}
 
@@ -154,7 +478,29 @@ func (linux *systemDRecord) Start() error {
 // Stop the service
 func (linux *systemDRecord) Stop() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.systemctl("stop", linux.controlUnit()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Restart the service
+func (linux *systemDRecord) Restart() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -162,11 +508,34 @@ func (linux *systemDRecord) Stop() error {
 		return ErrNotInstalled
 	}
 
+	if err := linux.systemctl("restart", linux.controlUnit()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reload the service configuration
+func (linux *systemDRecord) Reload() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if linux.isTimer() {
+		// a job reads its configuration on every run
+		return ErrUnsupportedSystem
+	}
+
 	if _, ok := linux.checkRunning(); !ok {
 		return ErrAlreadyStopped
 	}
 
-	if err := exec.Command("systemctl", "stop", linux.name+".service").Run(); err != nil {
+	if err := linux.systemctl("reload", linux.unitName()); err != nil {
 		return err
 	}
 
@@ -175,18 +544,110 @@ func (linux *systemDRecord) Stop() error {
 
 // Status - Get service status
 func (linux *systemDRecord) Status() (string, error) {
+	status, err := linux.Query()
+	if status == nil {
+		return "", err
+	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (linux *systemDRecord) Query() (*ServiceStatus, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return nil, err
+	}
+
+	if !linux.isInstalled() {
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
+
+	status := linux.queryStatus()
+	if linux.isTimer() {
+		linux.queryTimer(status)
+	}
+	status.UpToDate = linux.upToDate(linux.servicePath(), linux.Render)
+	return status, nil
+}
+
+// InstalledOptions - the options the installed unit was rendered with
+func (linux *systemDRecord) InstalledOptions() (*InstallOptions, error) {
+
+	if !linux.isInstalled() {
+		return nil, ErrNotInstalled
+	}
+
+	return readInstallOptions(linux.path(linux.servicePath()))
+}
+
+// Diff - changes Upgrade would make to the installed unit
+func (linux *systemDRecord) Diff(opts InstallOptions) (string, error) {
+
+	if !linux.isInstalled() {
+		return "", ErrNotInstalled
+	}
+
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return linux.diff(plan), nil
+}
+
+// Upgrade - rewrite the installed unit, reload systemd and optionally
+// restart the running service
+func (linux *systemDRecord) Upgrade(opts InstallOptions, restart bool) (string, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return "", err
+	}
+
+	diff, err := linux.Diff(opts)
+	if err != nil || diff == "" {
+		return diff, err
+	}
 
-	if ok, err := checkPrivileges(); !ok {
+	plan, _ := linux.Render(opts)
+	if err := linux.rewrite(plan); err != nil {
 		return "", err
 	}
 
+	if err := linux.systemctl("daemon-reload"); err != nil {
+		return "", err
+	}
+
+	if _, ok := linux.checkRunning(); restart && ok {
+		if err := linux.systemctl("restart", linux.controlUnit()); err != nil {
+			return "", err
+		}
+	}
+
+	return diff, nil
+}
+
+// Logs - print the unit journal through journalctl
+func (linux *systemDRecord) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+
 	if !linux.isInstalled() {
-		return statNotInstalled, ErrNotInstalled
+		return ErrNotInstalled
 	}
 
-	statusAction, _ := linux.checkRunning()
+	args := []string{"-u", linux.unitName(), "--no-pager"}
+	if linux.kind == UserDaemon {
+		args = append([]string{"--user"}, args...)
+	}
+	if opts.Lines > 0 {
+		args = append(args, "-n", strconv.Itoa(opts.Lines))
+	}
+	if !opts.Since.IsZero() {
+		args = append(args, "--since", opts.Since.Format("2006-01-02 15:04:05"))
+	}
+	if opts.Follow {
+		args = append(args, "-f")
+	}
 
-	return statusAction, nil
+	return linux.stream(ctx, w, "journalctl", args...)
 }
 
 // Run - Run service
@@ -208,15 +669,49 @@ func (linux *systemDRecord) SetTemplate(tplStr string) error {
 
 var systemDConfig = `[Unit]
 Description={{.Description}}
-Requires={{.Dependencies}}
-After={{.Dependencies}}
-
+{{if .Requires}}Requires={{.Requires}}
+{{end}}{{if .Wants}}Wants={{.Wants}}
+{{end}}{{if .BindsTo}}BindsTo={{.BindsTo}}
+{{end}}{{if .PartOf}}PartOf={{.PartOf}}
+{{end}}{{if .Conflicts}}Conflicts={{.Conflicts}}
+{{end}}{{if .After}}After={{.After}}
+{{end}}{{if .Before}}Before={{.Before}}
+{{end}}
 [Service]
-PIDFile=/var/run/{{.Name}}.pid
+{{if .Timer}}Type=oneshot
+{{else if .Notify}}Type=notify
+NotifyAccess=main
+{{else if not (or .UserService .Hardening)}}PIDFile=/var/run/{{.Name}}.pid
 ExecStartPre=/bin/rm -f /var/run/{{.Name}}.pid
-ExecStart={{.Path}} {{.Args}}
-Restart=on-failure
+{{end}}ExecStart={{.Path}} {{.Args}}
+ExecReload=/bin/kill -HUP $MAINPID
+{{if .Sockets}}Sockets={{range $i, $socket := .Sockets}}{{if $i}} {{end}}{{$socket.Unit}}{{end}}
+{{end}}{{if .User}}User={{.User}}
+{{end}}{{if .Group}}Group={{.Group}}
+{{end}}{{if .WorkingDirectory}}WorkingDirectory={{.WorkingDirectory}}
+{{end}}{{range .Environment}}Environment={{systemdQuote (printf "%s=%s" .Key .Value)}}
+{{end}}{{if .EnvFile}}EnvironmentFile=-{{.EnvFile}}
+{{end}}{{if .LimitNOFILE}}LimitNOFILE={{.LimitNOFILE}}
+{{end}}Restart={{.Restart}}
+{{if .RestartSec}}RestartSec={{.RestartSec}}
+{{end}}{{if .TimeoutStopSec}}TimeoutStopSec={{.TimeoutStopSec}}
+{{end}}{{if .WatchdogSec}}WatchdogSec={{.WatchdogSec}}
+{{end}}{{range .Hardening}}{{.Key}}={{.Value}}
+{{end}}{{if .ReadWritePaths}}ReadWritePaths={{.ReadWritePaths}}
+{{end}}{{if not .Timer}}
+[Install]
+WantedBy={{if .UserService}}default.target{{else}}multi-user.target{{end}}
+{{end}}`
+
+var systemDSocketConfig = `[Unit]
+Description={{.Description}} ({{.Socket.Name}} socket)
+PartOf={{.Name}}.service
+
+[Socket]
+ListenStream={{.Socket.Listen}}
+FileDescriptorName={{.Socket.Name}}
+Service={{.Name}}.service
 
 [Install]
-WantedBy=multi-user.target
+WantedBy=sockets.target
 `
@@ -5,11 +5,12 @@
 package daemon
 
 import (
+	"context"
+	"errors"
+	"io"
 	"os"
-	"os/exec"
 	"regexp"
-	"strings"
-	"text/template"
+	"strconv"
 )
 
 // systemVRecord - standard record (struct) for linux systemV version of daemon package
@@ -17,7 +18,14 @@ type systemVRecord struct {
 	name         string
 	description  string
 	kind         Kind
-	dependencies []string
+	dependencies unitDependencies
+	instance     string
+	*host
+}
+
+// Backend - the init system the service is installed with
+func (linux *systemVRecord) Backend() string {
+	return "sysv"
 }
 
 // Standard service path for systemV daemons
@@ -28,89 +36,148 @@ func (linux *systemVRecord) servicePath() string {
 // Is a service installed
 func (linux *systemVRecord) isInstalled() bool {
 
-	if _, err := os.Stat(linux.servicePath()); err == nil {
+	if _, err := os.Stat(linux.path(linux.mainPath())); err == nil {
 		return true
 	}
 
 	return false
 }
 
+// Is the service installed as a job in /etc/cron.d
+func (linux *systemVRecord) isCronJob() bool {
+	return linux.exists(cronPath(linux.name))
+}
+
+// The generated file recording the install options
+func (linux *systemVRecord) mainPath() string {
+	if linux.isCronJob() {
+		return cronPath(linux.name)
+	}
+	return linux.servicePath()
+}
+
+// Standard pid file path written by the init script
+func (linux *systemVRecord) pidPath() string {
+	return "/var/run/" + linux.name + ".pid"
+}
+
+// PIDFile - the pid file of the init script
+func (linux *systemVRecord) PIDFile() string {
+	return linux.pidPath()
+}
+
 // Check service is running
 func (linux *systemVRecord) checkRunning() (string, bool) {
-	output, err := exec.Command("service", linux.name, "status").Output()
-	if err == nil {
-		if matched, err := regexp.MatchString(linux.name, string(output)); err == nil && matched {
-			reg := regexp.MustCompile("pid  ([0-9]+)")
-			data := reg.FindStringSubmatch(string(output))
-			if len(data) > 1 {
-				return "Service (pid  " + data[1] + ") is running...", true
-			}
-			return "Service is running...", true
+	status := linux.queryStatus()
+	return status.String(), status.State == StateRunning
+}
+
+// Ask the init script for the service state, it follows the LSB status exit codes
+func (linux *systemVRecord) queryStatus() *ServiceStatus {
+	status := &ServiceStatus{State: StateUnknown, UnitPath: linux.servicePath()}
+	for _, i := range [...]string{"2", "3", "4", "5"} {
+		if _, err := os.Lstat(linux.path("/etc/rc" + i + ".d/S87" + linux.name)); err == nil {
+			status.Enabled = true
+			break
 		}
 	}
-
-	return "Service is stopped", false
+	output, err := linux.output("service", linux.name, "status")
+	var exitErr interface{ ExitCode() int }
+	switch {
+	case err == nil:
+		status.State = StateRunning
+	case errors.As(err, &exitErr) && (exitErr.ExitCode() == 1 || exitErr.ExitCode() == 2):
+		// program is dead and pid or lock file exists
+		status.State = StateFailed
+		return status
+	case errors.As(err, &exitErr):
+		status.State = StateStopped
+		return status
+	default:
+		return status
+	}
+	if status.PID = readPIDFile(linux.path(linux.pidPath())); status.PID == 0 {
+		if data := regexp.MustCompile("pid +([0-9]+)").FindStringSubmatch(string(output)); len(data) > 1 {
+			status.PID, _ = strconv.Atoi(data[1])
+		}
+	}
+	status.StartedAt = processStartTime(status.PID)
+	return status
 }
 
 // Install the service
 func (linux *systemVRecord) Install(args ...string) error {
-	if ok, err := checkPrivileges(); !ok {
+	return linux.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options
+func (linux *systemVRecord) InstallWithOptions(opts InstallOptions) error {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
-	srvPath := linux.servicePath()
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return err
+	}
 
 	if linux.isInstalled() {
 		return ErrAlreadyInstalled
 	}
 
-	file, err := os.Create(srvPath)
-	if err != nil {
-		return err
+	return linux.apply(plan)
+}
+
+// Start links of runlevels 2-5 and kill links of runlevels 0, 1 and 6
+func (linux *systemVRecord) runlevelLinks() []string {
+	var links []string
+	for _, i := range [...]string{"2", "3", "4", "5"} {
+		links = append(links, "/etc/rc"+i+".d/S87"+linux.name)
 	}
-	defer file.Close()
+	for _, i := range [...]string{"0", "1", "6"} {
+		links = append(links, "/etc/rc"+i+".d/K17"+linux.name)
+	}
+	return links
+}
 
-	execPatch, err := executablePath(linux.name)
-	if err != nil {
-		return err
+// Render - the plan InstallWithOptions would apply
+func (linux *systemVRecord) Render(opts InstallOptions) (*Plan, error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
 
-	templ, err := template.New("systemVConfig").Parse(systemVConfig)
+	execPatch, err := opts.executable(linux.name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Description, Path, Args string
-		}{linux.name, linux.description, execPatch, strings.Join(args, " ")},
-	); err != nil {
-		return err
+	data := newTemplateData(linux.name, linux.description, linux.dependencies, execPatch, &opts)
+	data.setInstance(linux.instance)
+	data.EnvFile = linux.env
+	if data.Timer {
+		// no timers, cron runs the job
+		return cronPlan("sysv", linux.name, data, &opts)
 	}
-
-	if err := os.Chmod(srvPath, 0755); err != nil {
-		return err
+	script, err := renderTemplate("systemVConfig", systemVConfig, data)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, i := range [...]string{"2", "3", "4", "5"} {
-		if err := os.Symlink(srvPath, "/etc/rc"+i+".d/S87"+linux.name); err != nil {
-			continue
-		}
-	}
-	for _, i := range [...]string{"0", "1", "6"} {
-		if err := os.Symlink(srvPath, "/etc/rc"+i+".d/K17"+linux.name); err != nil {
-			continue
-		}
+	srvPath := linux.servicePath()
+	plan := &Plan{Backend: "sysv"}
+	plan.write(srvPath, 0755, appendInstallOptions(script, &opts))
+	for _, link := range linux.runlevelLinks() {
+		plan.symlink(srvPath, link)
 	}
 
-	return nil
+	return plan, nil
 }
 
 // Remove the service
 func (linux *systemVRecord) Remove() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -118,28 +185,31 @@ func (linux *systemVRecord) Remove() error {
 		return ErrNotInstalled
 	}
 
-	if err := os.Remove(linux.servicePath()); err != nil {
-		return err
+	if linux.isCronJob() {
+		plan := &Plan{Backend: "sysv"}
+		plan.remove(cronPath(linux.name))
+		return linux.apply(plan)
 	}
 
-	for _, i := range [...]string{"2", "3", "4", "5"} {
-		if err := os.Remove("/etc/rc" + i + ".d/S87" + linux.name); err != nil {
-			continue
-		}
+	plan := &Plan{Backend: "sysv"}
+	if _, ok := linux.checkRunning(); ok {
+		plan.runUndo([]string{"service", linux.name, "start"}, "service", linux.name, "stop")
 	}
-	for _, i := range [...]string{"0", "1", "6"} {
-		if err := os.Remove("/etc/rc" + i + ".d/K17" + linux.name); err != nil {
-			continue
+	for _, link := range linux.runlevelLinks() {
+		// links removed by hand are not an error
+		if _, err := os.Lstat(linux.path(link)); err == nil {
+			plan.remove(link)
 		}
 	}
+	plan.remove(linux.servicePath())
 
-	return nil
+	return linux.apply(plan)
 }
 
 // Start the service
 func (linux *systemVRecord) Start() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -147,11 +217,15 @@ func (linux *systemVRecord) Start() error {
 		return ErrNotInstalled
 	}
 
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
 	if _, ok := linux.checkRunning(); ok {
 		return ErrAlreadyRunning
 	}
 
-	if err := exec.Command("service", linux.name, "start").Run(); err != nil {
+	if err := linux.run("service", linux.name, "start"); err != nil {
 		return err
 	}
 
@@ -161,7 +235,7 @@ func (linux *systemVRecord) Start() error {
 // Stop the service
 func (linux *systemVRecord) Stop() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -169,11 +243,63 @@ func (linux *systemVRecord) Stop() error {
 		return ErrNotInstalled
 	}
 
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
 	if _, ok := linux.checkRunning(); !ok {
 		return ErrAlreadyStopped
 	}
 
-	if err := exec.Command("service", linux.name, "stop").Run(); err != nil {
+	if err := linux.run("service", linux.name, "stop"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Restart the service
+func (linux *systemVRecord) Restart() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
+	if err := linux.run("service", linux.name, "restart"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reload the service configuration
+func (linux *systemVRecord) Reload() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return err
+	}
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.run("service", linux.name, "reload"); err != nil {
 		return err
 	}
 
@@ -182,18 +308,92 @@ func (linux *systemVRecord) Stop() error {
 
 // Status - Get service status
 func (linux *systemVRecord) Status() (string, error) {
-
-	if ok, err := checkPrivileges(); !ok {
+	status, err := linux.Query()
+	if status == nil {
 		return "", err
 	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (linux *systemVRecord) Query() (*ServiceStatus, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return nil, err
+	}
 
 	if !linux.isInstalled() {
-		return statNotInstalled, ErrNotInstalled
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
+
+	status := &ServiceStatus{State: StateStopped, UnitPath: cronPath(linux.name), Enabled: true}
+	if !linux.isCronJob() {
+		status = linux.queryStatus()
 	}
+	status.UpToDate = linux.upToDate(linux.mainPath(), linux.Render)
+	return status, nil
+}
+
+// InstalledOptions - the options the installed init script was rendered with
+func (linux *systemVRecord) InstalledOptions() (*InstallOptions, error) {
 
-	statusAction, _ := linux.checkRunning()
+	if !linux.isInstalled() {
+		return nil, ErrNotInstalled
+	}
 
-	return statusAction, nil
+	return readInstallOptions(linux.path(linux.mainPath()))
+}
+
+// Diff - changes Upgrade would make to the installed init script
+func (linux *systemVRecord) Diff(opts InstallOptions) (string, error) {
+
+	if !linux.isInstalled() {
+		return "", ErrNotInstalled
+	}
+
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return linux.diff(plan), nil
+}
+
+// Upgrade - rewrite the installed init script and optionally
+// restart the running service
+func (linux *systemVRecord) Upgrade(opts InstallOptions, restart bool) (string, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return "", err
+	}
+
+	diff, err := linux.Diff(opts)
+	if err != nil || diff == "" {
+		return diff, err
+	}
+
+	plan, _ := linux.Render(opts)
+	if err := linux.rewrite(plan); err != nil {
+		return "", err
+	}
+
+	if _, ok := linux.checkRunning(); restart && ok && !linux.isCronJob() {
+		if err := linux.run("service", linux.name, "restart"); err != nil {
+			return "", err
+		}
+	}
+
+	return diff, nil
+}
+
+// Logs - print the files the init script appends the service output to
+func (linux *systemVRecord) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	return Tail(ctx, w, opts, linux.path("/var/log/"+linux.name+".log"), linux.path("/var/log/"+linux.name+".err"))
 }
 
 // Run - Run service
@@ -224,9 +424,11 @@ var systemVConfig = `#! /bin/sh
 
 ### BEGIN INIT INFO
 # Provides: {{.Name}} 
-# Required-Start: $network $named
-# Required-Stop: $network $named
-# Default-Start: 2 3 4 5
+# Required-Start: {{.RequiredStart}}
+# Required-Stop: {{.RequiredStart}}
+{{if .ShouldStart}}# Should-Start: {{.ShouldStart}}
+# Should-Stop: {{.ShouldStart}}
+{{end}}# Default-Start: 2 3 4 5
 # Default-Stop: 0 1 6
 # Short-Description: This service manages the {{.Description}}.
 # Description: {{.Description}}
@@ -250,8 +452,9 @@ stderrlog="/var/log/$proc.err"
 
 [ -d $(dirname $lockfile) ] || mkdir -p $(dirname $lockfile)
 
-[ -e /etc/sysconfig/$proc ] && . /etc/sysconfig/$proc
-
+{{range .Environment}}export {{.Key}}={{shellQuote .Value}}
+{{end}}{{if .EnvFile}}if [ -e {{.EnvFile}} ]; then set -a; . {{.EnvFile}}; set +a; fi
+{{end}}
 start() {
     [ -x $exec ] || exit 5
 
@@ -267,7 +470,9 @@ start() {
     if ! [ -f $pidfile ]; then
         printf "Starting $servname:\t"
         echo "$(date)" >> $stdoutlog
-        $exec {{.Args}} >> $stdoutlog 2>> $stderrlog &
+        {{if .WorkingDirectory}}cd {{shellQuote .WorkingDirectory}} || exit 4
+        {{end}}{{if .LimitNOFILE}}ulimit -n {{.LimitNOFILE}}
+        {{end}}{{if .User}}setpriv --reuid {{.User}} --regid {{if .Group}}{{.Group}}{{else}}$(id -gn {{.User}}){{end}} --init-groups {{else if .Group}}setpriv --regid {{.Group}} --keep-groups {{end}}$exec {{.Args}} >> $stdoutlog 2>> $stderrlog &
         echo $! > $pidfile
         touch $lockfile
         success
@@ -282,7 +487,7 @@ start() {
 
 stop() {
     echo -n $"Stopping $servname: "
-    killproc -p $pidfile $proc
+    killproc -p $pidfile{{if .TimeoutStopSec}} -d {{.TimeoutStopSec}}{{end}} $proc
     retval=$?
     echo
     [ $retval -eq 0 ] && rm -f $lockfile
@@ -290,10 +495,18 @@ stop() {
 }
 
 restart() {
-    stop
+    rh_status_q && stop
     start
 }
 
+reload() {
+    echo -n $"Reloading $servname: "
+    killproc -p $pidfile $proc -HUP
+    retval=$?
+    echo
+    return $retval
+}
+
 rh_status() {
     status -p $pidfile $proc
 }
@@ -314,11 +527,15 @@ case "$1" in
     restart)
         $1
         ;;
+    reload)
+        rh_status_q || exit 7
+        $1
+        ;;
     status)
         rh_status
         ;;
     *)
-        echo $"Usage: $0 {start|stop|status|restart}"
+        echo $"Usage: $0 {start|stop|status|restart|reload}"
         exit 2
 esac
 
@@ -0,0 +1,1555 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// exitError - error carrying an exit code, as *exec.ExitError does
+type exitError int
+
+func (code exitError) Error() string { return "exit status " + strconv.Itoa(int(code)) }
+func (code exitError) ExitCode() int { return int(code) }
+
+// fakeRunner records the commands and answers them from a script keyed by
+// the command line
+type fakeRunner struct {
+	calls   []string
+	outputs map[string]string
+	errors  map[string]error
+}
+
+func newFakeRunner() *fakeRunner {
+	return &fakeRunner{outputs: map[string]string{}, errors: map[string]error{}}
+}
+
+func (runner *fakeRunner) Run(name string, args ...string) error {
+	_, err := runner.Output(name, args...)
+	return err
+}
+
+func (runner *fakeRunner) Output(name string, args ...string) ([]byte, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+	runner.calls = append(runner.calls, line)
+	return []byte(runner.outputs[line]), runner.errors[line]
+}
+
+// Has the command been run
+func (runner *fakeRunner) ran(line string) bool {
+	for _, call := range runner.calls {
+		if call == line {
+			return true
+		}
+	}
+	return false
+}
+
+// Create a filesystem root with the given directories and files
+func newTestRoot(t *testing.T, dirs []string, files ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func newTestDaemon(t *testing.T, root string, runner Runner) Daemon {
+	t.Helper()
+	d, err := NewWithConfig(Config{
+		Name:         "test service",
+		Description:  "test daemon",
+		Kind:         SystemDaemon,
+		Dependencies: []string{"network.target"},
+		Root:         root,
+		Runner:       runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSystemDLifecycle(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	if _, ok := d.(*systemDRecord); !ok {
+		t.Fatalf("got %T, want *systemDRecord", d)
+	}
+	unit := filepath.Join(root, "etc/systemd/system/test_service.service")
+
+	if _, err := d.Query(); !errors.Is(err, ErrNotInstalled) {
+		t.Fatalf("Query before install: got %v, want ErrNotInstalled", err)
+	}
+
+	err := d.InstallWithOptions(InstallOptions{
+		Args:        []string{"--port", "80"},
+		User:        "app",
+		Environment: []string{"APP_ENV=prod"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, unit)
+	for _, line := range []string{"Description=test daemon", "Requires=network.target", " --port 80\n", "User=app\n", `Environment="APP_ENV=prod"`} {
+		if !strings.Contains(content, line) {
+			t.Errorf("unit is missing %q:\n%s", line, content)
+		}
+	}
+	if !runner.ran("systemctl daemon-reload") || !runner.ran("systemctl enable test_service.service") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	if err := d.Install(); !errors.Is(err, ErrAlreadyInstalled) {
+		t.Errorf("second install: got %v, want ErrAlreadyInstalled", err)
+	}
+
+	show := "systemctl show test_service.service --property=" + systemDStatusProperties + " --timestamp=unix"
+	runner.outputs[show] = "ActiveState=inactive\nMainPID=0\nUnitFileState=enabled\n"
+	if err := d.Stop(); !errors.Is(err, ErrAlreadyStopped) {
+		t.Errorf("stop while stopped: got %v, want ErrAlreadyStopped", err)
+	}
+	if err := d.Start(); err != nil || !runner.ran("systemctl start test_service.service") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+
+	runner.outputs[show] = "ActiveState=active\nSubState=running\nMainPID=4242\nNRestarts=2\nExecMainStatus=0\nUnitFileState=enabled\nFragmentPath=/etc/systemd/system/test_service.service\n"
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateRunning || status.PID != 4242 || status.Restarts != 2 || !status.Enabled {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if text, _ := d.Status(); text != "Service (pid  4242) is running..." {
+		t.Errorf("unexpected status text %q", text)
+	}
+	if err := d.Start(); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("start while running: got %v, want ErrAlreadyRunning", err)
+	}
+	if err := d.Stop(); err != nil || !runner.ran("systemctl stop test_service.service") {
+		t.Errorf("stop: %v, commands %v", err, runner.calls)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(unit); !os.IsNotExist(err) {
+		t.Errorf("unit still exists after remove: %v", err)
+	}
+	if !runner.ran("systemctl disable test_service.service") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	if err := d.Remove(); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("second remove: got %v, want ErrNotInstalled", err)
+	}
+}
+
+func TestUpstartLifecycle(t *testing.T) {
+	root := newTestRoot(t, []string{"etc/init"}, "sbin/initctl")
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	if _, ok := d.(*upstartRecord); !ok {
+		t.Fatalf("got %T, want *upstartRecord", d)
+	}
+	job := filepath.Join(root, "etc/init/test_service.conf")
+
+	if err := d.InstallWithOptions(InstallOptions{Args: []string{"-v"}, Restart: "no", WorkingDirectory: "/srv"}); err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, job)
+	if !strings.Contains(content, "chdir /srv\n") || strings.Contains(content, "respawn") {
+		t.Errorf("unexpected job file:\n%s", content)
+	}
+
+	runner.outputs["status test_service"] = "test_service stop/waiting\n"
+	if err := d.Start(); err != nil || !runner.ran("start test_service") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+	if err := d.Restart(); err != nil || runner.ran("restart test_service") {
+		t.Errorf("restart of a stopped job must start it: %v, commands %v", err, runner.calls)
+	}
+
+	runner.outputs["status test_service"] = "test_service start/running, process 321\n"
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateRunning || status.PID != 321 || !status.Enabled {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := d.Stop(); err != nil || !runner.ran("stop test_service") {
+		t.Errorf("stop: %v, commands %v", err, runner.calls)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(job); !os.IsNotExist(err) {
+		t.Errorf("job still exists after remove: %v", err)
+	}
+}
+
+func TestSystemVLifecycle(t *testing.T) {
+	dirs := []string{"etc/init.d", "var/run"}
+	for _, i := range []string{"0", "1", "2", "3", "4", "5", "6"} {
+		dirs = append(dirs, "etc/rc"+i+".d")
+	}
+	root := newTestRoot(t, dirs)
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	if _, ok := d.(*systemVRecord); !ok {
+		t.Fatalf("got %T, want *systemVRecord", d)
+	}
+	script := filepath.Join(root, "etc/init.d/test_service")
+
+	if err := d.Install("-v"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(script); err != nil || info.Mode().Perm() != 0755 {
+		t.Fatalf("init script: %v %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "etc/rc3.d/S87test_service")); err != nil || target != "/etc/init.d/test_service" {
+		t.Errorf("start link: %q %v", target, err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc/rc0.d/K17test_service")); err != nil {
+		t.Errorf("kill link: %v", err)
+	}
+
+	runner.errors["service test_service status"] = exitError(3)
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateStopped || !status.Enabled {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := d.Start(); err != nil || !runner.ran("service test_service start") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+
+	runner.errors["service test_service status"] = exitError(1)
+	if status, _ := d.Query(); status.State != StateFailed {
+		t.Errorf("dead service with pid file: got %v, want failed", status.State)
+	}
+
+	delete(runner.errors, "service test_service status")
+	runner.outputs["service test_service status"] = "test_service (pid  99) is running...\n"
+	if status, _ := d.Query(); status.State != StateRunning || status.PID != 99 {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := d.Stop(); err != nil || !runner.ran("service test_service stop") {
+		t.Errorf("stop: %v, commands %v", err, runner.calls)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{script, filepath.Join(root, "etc/rc3.d/S87test_service"), filepath.Join(root, "etc/rc6.d/K17test_service")} {
+		if _, err := os.Lstat(name); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after remove: %v", name, err)
+		}
+	}
+}
+
+func TestSystemVUser(t *testing.T) {
+	root := newTestRoot(t, []string{"etc/init.d"})
+	d := newTestDaemon(t, root, newFakeRunner())
+	for _, test := range []struct {
+		opts InstallOptions
+		want string
+	}{
+		{InstallOptions{User: "app"}, "setpriv --reuid app --regid $(id -gn app) --init-groups $exec"},
+		{InstallOptions{User: "app", Group: "web"}, "setpriv --reuid app --regid web --init-groups $exec"},
+		{InstallOptions{Group: "web"}, "setpriv --regid web --keep-groups $exec"},
+		{InstallOptions{}, "\n        $exec"},
+	} {
+		plan, err := d.(Renderer).Render(test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the program is exec'd, the pid file gets its pid and not the one
+		// of a wrapper waiting for it
+		script := plan.Actions[0].Content
+		if !strings.Contains(script, test.want+"  >> $stdoutlog 2>> $stderrlog &\n        echo $! > $pidfile\n") || strings.Contains(script, "runuser") {
+			t.Errorf("%+v: start line is not %q:\n%s", test.opts, test.want, script)
+		}
+	}
+}
+
+func TestInstallOptionsValidation(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	d := newTestDaemon(t, root, newFakeRunner())
+	for _, test := range []struct {
+		opts   InstallOptions
+		option string
+	}{
+		{InstallOptions{Restart: "sometimes"}, "Restart"},
+		{InstallOptions{Environment: []string{"NOVALUE"}}, "Environment"},
+		{InstallOptions{LimitNOFILE: -1}, "LimitNOFILE"},
+		{InstallOptions{RestartSec: -time.Second}, "RestartSec"},
+		{InstallOptions{WatchdogSec: time.Second}, "WatchdogSec"},
+		{InstallOptions{Persistent: true}, "Persistent"},
+		{InstallOptions{OnCalendar: "daily", Notify: true}, "Notify"},
+		{InstallOptions{OnCalendar: "daily", Restart: "always"}, "Restart"},
+		// a newline would add a directive, a script line or a cron job
+		{InstallOptions{Args: []string{"-v\nExecStartPre=/bin/sh"}}, "Args"},
+		{InstallOptions{Executable: "/usr/bin/app\nUser=root"}, "Executable"},
+		{InstallOptions{User: "app\nUser=root"}, "User"},
+		{InstallOptions{Group: "app\r"}, "Group"},
+		{InstallOptions{WorkingDirectory: "/srv\nExecStartPre=/bin/sh"}, "WorkingDirectory"},
+		{InstallOptions{Environment: []string{"KEY=value\nExecStartPre=/bin/sh"}}, "Environment"},
+		{InstallOptions{Sockets: []string{"https=443\r"}}, "Sockets"},
+		{InstallOptions{OnCalendar: "daily\n* * * * * root /bin/sh"}, "OnCalendar"},
+		{InstallOptions{Hardening: "strict\n"}, "Hardening"},
+		{InstallOptions{HardeningOverrides: []string{"ProtectHome=yes\nUser=root"}}, "HardeningOverrides"},
+		{InstallOptions{ReadWritePaths: []string{"/var/lib/app\nUser=root"}}, "ReadWritePaths"},
+		{InstallOptions{LogDir: "/var/log/app\x00"}, "LogDir"},
+	} {
+		err := d.InstallWithOptions(test.opts)
+		var optionErr *OptionError
+		if !errors.Is(err, ErrInvalidOptions) || !errors.As(err, &optionErr) || optionErr.Option != test.option {
+			t.Errorf("%+v: got %v, want an OptionError about %s", test.opts, err, test.option)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/systemd/system/test_service.service")); !os.IsNotExist(err) {
+		t.Errorf("invalid options left a unit behind: %v", err)
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/init.d", "etc/cron.d"})
+	for _, config := range []Config{
+		{Name: "test", Description: "test\nExecStartPre=/bin/sh"},
+		{Name: "test\n", Description: "test"},
+		{Name: "test", Dependencies: []string{"network.target\r"}},
+	} {
+		config.Kind, config.Root = SystemDaemon, root
+		if _, err := NewWithConfig(config); err == nil {
+			t.Errorf("%q %q %q: accepted", config.Name, config.Description, config.Dependencies)
+		}
+	}
+
+	// a job installed into a root-owned /etc/cron.d file
+	d, err := NewWithConfig(Config{Name: "test", Kind: SystemDaemon, Backend: "sysv", Root: root, Runner: newFakeRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := InstallOptions{OnCalendar: "daily", Environment: []string{"KEY=value\n* * * * * root /bin/sh"}}
+	if err := d.InstallWithOptions(opts); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("cron job: got %v, want ErrInvalidOptions", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/cron.d/test")); !os.IsNotExist(err) {
+		t.Errorf("invalid options left a cron file behind: %v", err)
+	}
+}
+
+func TestSystemDUserService(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system"})
+	t.Setenv("XDG_CONFIG_HOME", "/home/test/.config")
+	runner := newFakeRunner()
+	d, err := NewWithConfig(Config{Name: "agent", Description: "user agent", Kind: UserDaemon, Root: root, Runner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.InstallWithOptions(InstallOptions{User: "other"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("install as another user: got %v, want ErrInvalidOptions", err)
+	}
+	if err := d.InstallWithOptions(InstallOptions{Linger: true}); err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, filepath.Join(root, "home/test/.config/systemd/user/agent.service"))
+	if !strings.Contains(content, "WantedBy=default.target") || strings.Contains(content, "PIDFile=") {
+		t.Errorf("unexpected user unit:\n%s", content)
+	}
+	if !runner.ran("systemctl --user daemon-reload") || !runner.ran("systemctl --user enable agent.service") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	linger := false
+	for _, call := range runner.calls {
+		linger = linger || strings.HasPrefix(call, "loginctl enable-linger ")
+	}
+	if !linger {
+		t.Errorf("linger was not enabled: %v", runner.calls)
+	}
+}
+
+func TestRender(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+
+	plan, err := d.(Renderer).Render(InstallOptions{Executable: "/usr/local/bin/app", Args: []string{"serve"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runner.calls) != 0 {
+		t.Errorf("render ran commands: %v", runner.calls)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/systemd/system/test_service.service")); !os.IsNotExist(err) {
+		t.Errorf("render wrote the unit: %v", err)
+	}
+
+	var actions []string
+	for _, action := range plan.Actions {
+		actions = append(actions, action.String())
+	}
+	want := []string{
+		"write /etc/systemd/system/test_service.service (0644)",
+		"run systemctl daemon-reload",
+		"run systemctl enable test_service.service",
+	}
+	if strings.Join(actions, "\n") != strings.Join(want, "\n") {
+		t.Errorf("actions:\n%s\nwant:\n%s", strings.Join(actions, "\n"), strings.Join(want, "\n"))
+	}
+	unit := plan.Files()["/etc/systemd/system/test_service.service"]
+	if !strings.Contains(unit, "ExecStart=/usr/local/bin/app serve\n") {
+		t.Errorf("unexpected unit:\n%s", unit)
+	}
+	if !strings.Contains(plan.String(), unit) {
+		t.Errorf("plan text lacks the unit content:\n%s", plan.String())
+	}
+
+	// installing applies exactly the rendered plan
+	if err := d.InstallWithOptions(InstallOptions{Executable: "/usr/local/bin/app", Args: []string{"serve"}}); err != nil {
+		t.Fatal(err)
+	}
+	if content := readFile(t, filepath.Join(root, "etc/systemd/system/test_service.service")); content != unit {
+		t.Errorf("installed unit differs from the rendered one:\n%s", content)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	upgrader := d.(Upgrader)
+	unit := filepath.Join(root, "etc/systemd/system/test_service.service")
+	show := "systemctl show test_service.service --property=" + systemDStatusProperties + " --timestamp=unix"
+	runner.outputs[show] = "ActiveState=active\nMainPID=7\n"
+
+	if _, err := upgrader.Upgrade(InstallOptions{}, false); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("upgrade before install: got %v, want ErrNotInstalled", err)
+	}
+	installed := InstallOptions{Executable: "/usr/local/bin/app", Args: []string{"serve"}, User: "app"}
+	if err := d.InstallWithOptions(installed); err != nil {
+		t.Fatal(err)
+	}
+	if opts, err := upgrader.InstalledOptions(); err != nil || opts.User != "app" || strings.Join(opts.Args, " ") != "serve" {
+		t.Errorf("installed options: %+v %v", opts, err)
+	}
+	if status, err := d.Query(); err != nil || status.UpToDate == nil || !*status.UpToDate {
+		t.Errorf("fresh install is not up to date: %+v %v", status, err)
+	}
+	if diff, err := upgrader.Diff(installed); err != nil || diff != "" {
+		t.Errorf("diff of unchanged options: %q %v", diff, err)
+	}
+
+	// a new release changes the arguments
+	changed := installed
+	changed.Args = []string{"serve", "--fast"}
+	diff, err := upgrader.Diff(changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "-ExecStart=/usr/local/bin/app serve\n") || !strings.Contains(diff, "+ExecStart=/usr/local/bin/app serve --fast\n") {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+	runner.calls = nil
+	if applied, err := upgrader.Upgrade(changed, true); err != nil || applied != diff {
+		t.Fatalf("upgrade: %v, applied:\n%s", err, applied)
+	}
+	if content := readFile(t, unit); !strings.Contains(content, "ExecStart=/usr/local/bin/app serve --fast\n") {
+		t.Errorf("unit not rewritten:\n%s", content)
+	}
+	if !runner.ran("systemctl daemon-reload") || !runner.ran("systemctl restart test_service.service") || runner.ran("systemctl enable test_service.service") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	if status, _ := d.Query(); status.UpToDate == nil || !*status.UpToDate {
+		t.Errorf("upgraded unit is not up to date: %+v", status)
+	}
+
+	// nothing left to do the second time
+	runner.calls = nil
+	if applied, err := upgrader.Upgrade(changed, true); err != nil || applied != "" || len(runner.calls) > 1 {
+		t.Errorf("second upgrade: %q %v, commands %v", applied, err, runner.calls)
+	}
+
+	// hand edits are drift as well
+	if err := os.WriteFile(unit, []byte(strings.Replace(readFile(t, unit), "User=app", "User=root", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := d.Query(); status.UpToDate == nil || *status.UpToDate {
+		t.Errorf("edited unit reported up to date: %+v", status)
+	}
+}
+
+func TestInstallRollback(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	unit := filepath.Join(root, "etc/systemd/system/test_service.service")
+
+	runner.errors["systemctl enable test_service.service"] = exitError(1)
+	err := d.Install()
+	var stepErr *StepError
+	if !errors.As(err, &stepErr) || stepErr.Step.String() != "run systemctl enable test_service.service" || len(stepErr.RollbackErrors) != 0 {
+		t.Fatalf("install with failing enable: %v", err)
+	}
+	if !errors.Is(err, exitError(1)) || !strings.Contains(err.Error(), "rolled back: ") {
+		t.Errorf("unexpected error text: %v", err)
+	}
+	if _, err := os.Stat(unit); !os.IsNotExist(err) {
+		t.Errorf("unit left behind after a failed install: %v", err)
+	}
+	if calls := strings.Join(runner.calls, "\n"); calls != "systemctl daemon-reload\nsystemctl enable test_service.service\nsystemctl daemon-reload" {
+		t.Errorf("unexpected commands:\n%s", calls)
+	}
+
+	// the next attempt starts from scratch
+	delete(runner.errors, "systemctl enable test_service.service")
+	if err := d.Install(); err != nil {
+		t.Fatal(err)
+	}
+
+	// remove stops first and puts everything back when a step fails
+	runner.outputs["systemctl show test_service.service --property="+systemDStatusProperties+" --timestamp=unix"] = "ActiveState=active\nMainPID=7\nUnitFileState=enabled\n"
+	runner.errors["systemctl daemon-reload"] = exitError(1)
+	runner.calls = nil
+	if err := d.Remove(); !errors.As(err, &stepErr) || stepErr.Step.String() != "run systemctl daemon-reload" {
+		t.Fatalf("remove with failing reload: %v", err)
+	}
+	if _, err := os.Stat(unit); err != nil {
+		t.Errorf("unit not restored: %v", err)
+	}
+	for _, line := range []string{"systemctl stop test_service.service", "systemctl enable test_service.service", "systemctl start test_service.service"} {
+		if !runner.ran(line) {
+			t.Errorf("%q not run: %v", line, runner.calls)
+		}
+	}
+
+	delete(runner.errors, "systemctl daemon-reload")
+	runner.calls = nil
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if runner.calls[1] != "systemctl stop test_service.service" || runner.calls[2] != "systemctl disable test_service.service" {
+		t.Errorf("remove must stop before disabling: %v", runner.calls)
+	}
+}
+
+func TestSystemVInstallRollback(t *testing.T) {
+	dirs := []string{"etc/init.d", "var/run"}
+	for _, i := range []string{"0", "1", "2", "3", "4", "5", "6"} {
+		dirs = append(dirs, "etc/rc"+i+".d")
+	}
+	// a stale file where a kill link goes
+	root := newTestRoot(t, dirs, "etc/rc1.d/K17test_service")
+	d := newTestDaemon(t, root, newFakeRunner())
+
+	var stepErr *StepError
+	if err := d.Install(); !errors.As(err, &stepErr) || stepErr.Step.Op != OpSymlink || len(stepErr.Undone) != 6 {
+		t.Fatalf("install over a stale link: %v", err)
+	}
+	for _, name := range []string{"etc/init.d/test_service", "etc/rc2.d/S87test_service", "etc/rc0.d/K17test_service"} {
+		if _, err := os.Lstat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/rc1.d/K17test_service")); err != nil {
+		t.Errorf("pre-existing file removed by the rollback: %v", err)
+	}
+}
+
+func TestSystemDNotify(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	d := newTestDaemon(t, root, newFakeRunner()).(Renderer)
+
+	if _, err := d.Render(InstallOptions{WatchdogSec: time.Minute}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("watchdog without notify: got %v, want ErrInvalidOptions", err)
+	}
+	plan, err := d.Render(InstallOptions{Executable: "/usr/local/bin/app", Notify: true, WatchdogSec: 30 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := plan.Files()["/etc/systemd/system/test_service.service"]
+	for _, line := range []string{"Type=notify\n", "NotifyAccess=main\n", "WatchdogSec=30\n"} {
+		if !strings.Contains(unit, line) {
+			t.Errorf("unit is missing %q:\n%s", line, unit)
+		}
+	}
+	if strings.Contains(unit, "PIDFile=") {
+		t.Errorf("notify unit waits for a pid file:\n%s", unit)
+	}
+}
+
+func TestSystemDSockets(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+
+	if err := d.InstallWithOptions(InstallOptions{Sockets: []string{"https"}}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("socket without an address: got %v, want ErrInvalidOptions", err)
+	}
+	if err := d.InstallWithOptions(InstallOptions{Sockets: []string{"https=443", "redirect=0.0.0.0:80"}}); err != nil {
+		t.Fatal(err)
+	}
+	unit := readFile(t, filepath.Join(root, "etc/systemd/system/test_service.service"))
+	if !strings.Contains(unit, "Sockets=test_service-https.socket test_service-redirect.socket\n") {
+		t.Errorf("unit does not name its sockets:\n%s", unit)
+	}
+	socket := readFile(t, filepath.Join(root, "etc/systemd/system/test_service-redirect.socket"))
+	for _, line := range []string{"ListenStream=0.0.0.0:80\n", "FileDescriptorName=redirect\n", "Service=test_service.service\n", "WantedBy=sockets.target\n"} {
+		if !strings.Contains(socket, line) {
+			t.Errorf("socket unit is missing %q:\n%s", line, socket)
+		}
+	}
+	if !runner.ran("systemctl enable test_service.service test_service-https.socket test_service-redirect.socket") {
+		t.Errorf("sockets not enabled: %v", runner.calls)
+	}
+
+	runner.calls = nil
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.ran("systemctl stop test_service-https.socket test_service-redirect.socket") ||
+		!runner.ran("systemctl disable test_service.service test_service-https.socket test_service-redirect.socket") {
+		t.Errorf("sockets not stopped and disabled: %v", runner.calls)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/systemd/system/test_service-https.socket")); !os.IsNotExist(err) {
+		t.Errorf("socket unit left behind: %v", err)
+	}
+}
+
+func TestSystemDLogs(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	var out strings.Builder
+	if err := d.(LogReader).Logs(context.Background(), &out, LogOptions{}); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("logs before install: got %v, want ErrNotInstalled", err)
+	}
+	if err := d.Install(); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2026, 1, 2, 15, 4, 5, 0, time.Local)
+	command := "journalctl -u test_service.service --no-pager -n 20 --since 2026-01-02 15:04:05"
+	runner.outputs[command] = "line\n"
+	if err := d.(LogReader).Logs(context.Background(), &out, LogOptions{Lines: 20, Since: since}); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.ran(command) || out.String() != "line\n" {
+		t.Errorf("output %q, commands %v", out.String(), runner.calls)
+	}
+}
+
+func TestUpstartLogs(t *testing.T) {
+	root := newTestRoot(t, []string{"etc/init", "var/log"}, "sbin/initctl")
+	d := newTestDaemon(t, root, newFakeRunner())
+	if err := d.Install(); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(root, "var/log/test_service.log")
+	if err := os.WriteFile(logFile, []byte("one\ntwo\nthree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := d.(LogReader).Logs(context.Background(), &out, LogOptions{Lines: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "==> "+logFile+" <==\ntwo\nthree\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestTailFollow(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(logFile, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(interval time.Duration) { tailInterval = interval }(tailInterval)
+	tailInterval = time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Tail(ctx, writer, LogOptions{Follow: true, Lines: 1}, logFile)
+		writer.Close()
+	}()
+	buf := make([]byte, 64)
+	if n, _ := reader.Read(buf); string(buf[:n]) != "old\n" {
+		t.Errorf("tail: %q", buf[:n])
+	}
+
+	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("new\n")
+	file.Close()
+	if n, _ := reader.Read(buf); string(buf[:n]) != "new\n" {
+		t.Errorf("follow: %q", buf[:n])
+	}
+	cancel()
+	go io.Copy(io.Discard, reader)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTailSince(t *testing.T) {
+	dir := t.TempDir()
+	since := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		name, content, want string
+	}{
+		{
+			"log.log",
+			"2026/03/01 11:59:59 old\n2026/03/01 12:00:00 new\npanic: trace\n2026/03/01 12:30:00 newer\n",
+			"2026/03/01 12:00:00 new\npanic: trace\n2026/03/01 12:30:00 newer\n",
+		},
+		{
+			"rfc3339.log",
+			"2026-03-01T10:00:00Z old\ngoroutine 1\n" + since.Add(time.Minute).Format(time.RFC3339Nano) + " new\n",
+			since.Add(time.Minute).Format(time.RFC3339Nano) + " new\n",
+		},
+		{"old.log", "2026-03-01 11:00:00 old\n2026-03-01 11:30:00 older\n", ""},
+		{"plain.log", "no timestamps\nat all\n", "no timestamps\nat all\n"},
+	} {
+		path := filepath.Join(dir, test.name)
+		if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := Tail(context.Background(), &out, LogOptions{Since: since}, path); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), test.want)
+		}
+	}
+}
+
+func newTestInstance(t *testing.T, root string, runner Runner, instance string) Daemon {
+	t.Helper()
+	d, err := NewWithConfig(Config{
+		Name:        "test service",
+		Description: "test daemon",
+		Kind:        SystemDaemon,
+		Instance:    instance,
+		Root:        root,
+		Runner:      runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestSystemDInstances(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	eu1 := newTestInstance(t, root, runner, "eu1")
+	us1 := newTestInstance(t, root, runner, "us1")
+	template := filepath.Join(root, "etc/systemd/system/test_service@.service")
+	wants := filepath.Join(root, "etc/systemd/system/multi-user.target.wants")
+
+	opts := InstallOptions{Args: []string{"--config", "/etc/app/%i.yaml"}}
+	if err := eu1.InstallWithOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, template)
+	for _, line := range []string{"Description=test daemon (%i)", " --config /etc/app/%i.yaml\n", "PIDFile=/var/run/test_service@%i.pid"} {
+		if !strings.Contains(content, line) {
+			t.Errorf("template is missing %q:\n%s", line, content)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(wants, "test_service@eu1.service")); err != nil || target != "/etc/systemd/system/test_service@.service" {
+		t.Errorf("instance link: %q %v", target, err)
+	}
+	if err := eu1.InstallWithOptions(opts); !errors.Is(err, ErrAlreadyInstalled) {
+		t.Errorf("second install: got %v, want ErrAlreadyInstalled", err)
+	}
+	if _, err := us1.Query(); !errors.Is(err, ErrNotInstalled) {
+		t.Errorf("other instance: got %v, want ErrNotInstalled", err)
+	}
+	if err := us1.InstallWithOptions(InstallOptions{Args: []string{"-v"}}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("instance with other options: got %v, want ErrInvalidOptions", err)
+	}
+	if err := us1.InstallWithOptions(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	runner.outputs["systemctl show test_service@eu1.service --property="+systemDStatusProperties+" --timestamp=unix"] = "ActiveState=inactive\n"
+	if err := eu1.Start(); err != nil || !runner.ran("systemctl start test_service@eu1.service") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+	if err := eu1.InstallWithOptions(InstallOptions{Sockets: []string{"http=80"}}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("instance with sockets: got %v, want ErrInvalidOptions", err)
+	}
+
+	// the template stays while another instance uses it
+	if err := eu1.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(wants, "test_service@eu1.service")); !os.IsNotExist(err) {
+		t.Errorf("instance link still exists: %v", err)
+	}
+	if _, err := os.Stat(template); err != nil {
+		t.Errorf("template removed with an instance left: %v", err)
+	}
+	if err := us1.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(template); !os.IsNotExist(err) {
+		t.Errorf("template still exists after the last instance: %v", err)
+	}
+
+	if _, err := NewWithConfig(Config{Name: "test", Kind: SystemDaemon, Instance: "../eu1"}); err == nil {
+		t.Error("invalid instance name accepted")
+	}
+}
+
+func TestSystemVInstances(t *testing.T) {
+	dirs := []string{"etc/init.d"}
+	for _, i := range []string{"0", "1", "2", "3", "4", "5", "6"} {
+		dirs = append(dirs, "etc/rc"+i+".d")
+	}
+	root := newTestRoot(t, dirs)
+	runner := newFakeRunner()
+	eu1 := newTestInstance(t, root, runner, "eu1")
+	us1 := newTestInstance(t, root, runner, "us1")
+
+	opts := InstallOptions{Args: []string{"--config", "/etc/app/%i.yaml"}}
+	for _, d := range []Daemon{eu1, us1} {
+		if err := d.InstallWithOptions(opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, instance := range []string{"eu1", "us1"} {
+		script := readFile(t, filepath.Join(root, "etc/init.d/test_service@"+instance))
+		if !strings.Contains(script, "--config /etc/app/"+instance+".yaml") {
+			t.Errorf("%s script does not expand %%i:\n%s", instance, script)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc/rc3.d/S87test_service@us1")); err != nil {
+		t.Errorf("start link: %v", err)
+	}
+	runner.errors["service test_service@eu1 status"] = exitError(3)
+	if err := eu1.Start(); err != nil || !runner.ran("service test_service@eu1 start") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+}
+
+func TestSystemDTimer(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	unit := filepath.Join(root, "etc/systemd/system/test_service.service")
+	timer := filepath.Join(root, "etc/systemd/system/test_service.timer")
+
+	err := d.InstallWithOptions(InstallOptions{
+		Args:               []string{"--cleanup"},
+		OnCalendar:         "Mon..Fri *-*-* 02:30",
+		RandomizedDelaySec: 10 * time.Minute,
+		Persistent:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, unit)
+	for _, line := range []string{"Type=oneshot\n", "Restart=no\n"} {
+		if !strings.Contains(content, line) {
+			t.Errorf("unit is missing %q:\n%s", line, content)
+		}
+	}
+	for _, line := range []string{"PIDFile=", "[Install]"} {
+		if strings.Contains(content, line) {
+			t.Errorf("unit of a job has %q:\n%s", line, content)
+		}
+	}
+	content = readFile(t, timer)
+	for _, line := range []string{"OnCalendar=Mon..Fri *-*-* 02:30\n", "RandomizedDelaySec=600\n", "Persistent=true\n", "Unit=test_service.service\n", "WantedBy=timers.target\n"} {
+		if !strings.Contains(content, line) {
+			t.Errorf("timer is missing %q:\n%s", line, content)
+		}
+	}
+	if !runner.ran("systemctl enable test_service.timer") || runner.ran("systemctl enable test_service.service") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+
+	runner.outputs["systemctl show test_service.service --property="+systemDStatusProperties+" --timestamp=unix"] = "ActiveState=inactive\nExecMainStatus=0\n"
+	show := "systemctl show test_service.timer --property=ActiveState,UnitFileState,LastTriggerUSec,NextElapseUSecRealtime --timestamp=unix"
+	runner.outputs[show] = "ActiveState=inactive\nUnitFileState=enabled\nLastTriggerUSec=n/a\nNextElapseUSecRealtime=\n"
+	if err := d.Start(); err != nil || !runner.ran("systemctl start test_service.timer") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+	runner.outputs[show] = "ActiveState=active\nUnitFileState=enabled\nLastTriggerUSec=@1792117800\nNextElapseUSecRealtime=@1792377000\n"
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateStopped || !status.Enabled || status.NextTrigger.IsZero() || status.LastTrigger.IsZero() {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if text := status.String(); !strings.Contains(text, "next run 2026-10-19") {
+		t.Errorf("status text %q has no next run", text)
+	}
+	if err := d.Start(); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("start with an active timer: got %v, want ErrAlreadyRunning", err)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.ran("systemctl stop test_service.timer") || !runner.ran("systemctl disable test_service.service test_service.timer") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	for _, name := range []string{unit, timer} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after remove: %v", name, err)
+		}
+	}
+
+	for _, opts := range []InstallOptions{
+		{OnCalendar: "daily", Restart: "always"},
+		{OnCalendar: "daily", Notify: true},
+		{OnBootSec: time.Minute, Persistent: true},
+		{RandomizedDelaySec: time.Minute},
+	} {
+		if _, err := d.(Renderer).Render(opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%+v: got %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+}
+
+func TestSystemVCronJob(t *testing.T) {
+	root := newTestRoot(t, []string{"etc/init.d", "etc/cron.d"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	cron := filepath.Join(root, "etc/cron.d/test_service")
+
+	err := d.InstallWithOptions(InstallOptions{
+		Executable:  "/usr/bin/report",
+		Args:        []string{"--date", "+%F"},
+		User:        "app",
+		Environment: []string{"APP_ENV=prod"},
+		OnCalendar:  "*-*-01 06:00",
+		OnBootSec:   5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, cron)
+	for _, line := range []string{
+		"APP_ENV=prod\n",
+		"0 6 1 * * app /usr/bin/report --date +\\%F >> /var/log/test_service.log 2>> /var/log/test_service.err\n",
+		"@reboot app sleep 300 && /usr/bin/report",
+	} {
+		if !strings.Contains(content, line) {
+			t.Errorf("cron file is missing %q:\n%s", line, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/init.d/test_service")); !os.IsNotExist(err) {
+		t.Errorf("a job got an init script: %v", err)
+	}
+
+	status, err := d.Query()
+	if err != nil || status.State != StateStopped || status.UnitPath != "/etc/cron.d/test_service" || status.UpToDate == nil || !*status.UpToDate {
+		t.Errorf("unexpected status %+v, %v", status, err)
+	}
+	if err := d.Start(); !errors.Is(err, ErrCronJob) {
+		t.Errorf("start: got %v, want ErrCronJob", err)
+	}
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(cron); !os.IsNotExist(err) {
+		t.Errorf("cron file still exists after remove: %v", err)
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	for spec, want := range map[string]string{
+		"daily":                "0 0 * * *",
+		"weekly":               "0 0 * * 1",
+		"*-*-* 02:30":          "30 2 * * *",
+		"Mon..Fri 08:00:00":    "0 8 * * 1-5",
+		"Sat,Sun *-*-* 10:00":  "0 10 * * 6,0",
+		"*-1,7-01 00:00":       "0 0 1 1,7 *",
+		"*:0/15":               "*/15 * * * *",
+		"*-*-* 9..17:5/20":     "5-59/20 9-17 * * *",
+		"Mon..Sun *-*-* 12:00": "0 12 * * 1-7",
+		"Sat..Mon 06:00":       "0 6 * * 6-7,1",
+		"Fri..Tue 06:00":       "0 6 * * 5-7,1-2",
+		"Sun..Tue 06:00":       "0 6 * * 0-2",
+		"Sun..Sun 06:00":       "0 6 * * 0",
+	} {
+		got, err := cronSchedule(spec)
+		if err != nil || got != want {
+			t.Errorf("%q: got %q, %v, want %q", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"2026-*-* 00:00", "*-*-* 02:30:15", "Someday 10:00", "*-*-* 25:00", "every day", "*:*/0", "*-*-* 0/0:00", "*:0/x"} {
+		if _, err := cronSchedule(spec); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%q: got %v, want ErrInvalidOptions", spec, err)
+		}
+	}
+}
+
+func TestSystemDHardening(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	d := newTestDaemon(t, root, newFakeRunner())
+
+	plan, err := d.(Renderer).Render(InstallOptions{
+		Hardening:          "network-service",
+		HardeningOverrides: []string{"ProtectHome=read-only", "SystemCallFilter=", "MemoryDenyWriteExecute=yes"},
+		ReadWritePaths:     []string{"/var/lib/test", "-/etc/test/certs"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := plan.Actions[0].Content
+	for _, line := range []string{
+		"NoNewPrivileges=yes\n",
+		"ProtectSystem=strict\n",
+		"ProtectHome=read-only\n",
+		"PrivateTmp=yes\n",
+		"CapabilityBoundingSet=CAP_NET_BIND_SERVICE\n",
+		"AmbientCapabilities=CAP_NET_BIND_SERVICE\n",
+		"RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK\n",
+		"MemoryDenyWriteExecute=yes\n",
+		"ReadWritePaths=/var/lib/test -/etc/test/certs\n",
+	} {
+		if !strings.Contains(unit, line) {
+			t.Errorf("unit is missing %q:\n%s", line, unit)
+		}
+	}
+	for _, line := range []string{"\nSystemCallFilter=", "PIDFile=", "ProtectHome=yes"} {
+		if strings.Contains(unit, line) {
+			t.Errorf("unit has %q:\n%s", line, unit)
+		}
+	}
+
+	plan, err = d.(Renderer).Render(InstallOptions{Hardening: "strict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unit := plan.Actions[0].Content; !strings.Contains(unit, "\nCapabilityBoundingSet=\n") || strings.Contains(unit, "AmbientCapabilities") {
+		t.Errorf("strict unit keeps capabilities:\n%s", unit)
+	}
+
+	for _, opts := range []InstallOptions{
+		{Hardening: "paranoid"},
+		{HardeningOverrides: []string{"Protect Home=yes"}},
+		{HardeningOverrides: []string{"ProtectHome"}},
+		{ReadWritePaths: []string{"data"}},
+	} {
+		if _, err := d.(Renderer).Render(opts); !errors.Is(err, ErrInvalidOptions) {
+			t.Errorf("%+v: got %v, want ErrInvalidOptions", opts, err)
+		}
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	config := Config{
+		Name:        "test service",
+		Description: "test daemon",
+		Kind:        SystemDaemon,
+		Requires:    []string{"postgresql.service"},
+		Wants:       []string{"network-online.target"},
+		After:       []string{"network-online.target", "postgresql.service", "redis.service"},
+		PartOf:      []string{"app.target"},
+		Conflicts:   []string{"legacy.service"},
+		Runner:      newFakeRunner(),
+	}
+	render := func(dirs []string, files ...string) string {
+		t.Helper()
+		config.Root = newTestRoot(t, dirs, files...)
+		d, err := NewWithConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := d.(Renderer).Render(InstallOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan.Actions[0].Content
+	}
+
+	unit := render([]string{"run/systemd/system", "etc/systemd/system"})
+	for _, line := range []string{
+		"Requires=postgresql.service\n",
+		"Wants=network-online.target\n",
+		"PartOf=app.target\n",
+		"Conflicts=legacy.service\n",
+		"After=network-online.target postgresql.service redis.service\n",
+	} {
+		if !strings.Contains(unit, line) {
+			t.Errorf("unit is missing %q:\n%s", line, unit)
+		}
+	}
+	if strings.Contains(unit, "Before=") || strings.Contains(unit, "BindsTo=") {
+		t.Errorf("unit has empty dependencies:\n%s", unit)
+	}
+
+	script := render([]string{"etc/init.d"})
+	for _, line := range []string{
+		"# Required-Start: $network $named postgresql\n",
+		"# Should-Start: $network postgresql redis\n",
+	} {
+		if !strings.Contains(script, line) {
+			t.Errorf("script is missing %q:\n%s", line, script)
+		}
+	}
+
+	job := render([]string{"etc/init"}, "sbin/initctl")
+	for _, line := range []string{
+		"start on (runlevel [2345] and started postgresql and started redis)\n",
+		"stop on (runlevel [016] or stopping postgresql)\n",
+	} {
+		if !strings.Contains(job, line) {
+			t.Errorf("job is missing %q:\n%s", line, job)
+		}
+	}
+
+	// no dependencies, no empty directives
+	config = Config{Name: "test service", Description: "test daemon", Kind: SystemDaemon, Runner: newFakeRunner()}
+	unit = render([]string{"run/systemd/system", "etc/systemd/system"})
+	if strings.Contains(unit, "Requires=") || strings.Contains(unit, "After=") {
+		t.Errorf("unit has empty dependencies:\n%s", unit)
+	}
+	if job := render([]string{"etc/init"}, "sbin/initctl"); !strings.Contains(job, "start on runlevel [2345]\nstop on runlevel [016]\n") {
+		t.Errorf("unexpected job events:\n%s", job)
+	}
+
+	config.Wants = []string{"bad name"}
+	if _, err := NewWithConfig(config); err == nil {
+		t.Error("a dependency with a space was accepted")
+	}
+}
+
+func TestEnvFileSourced(t *testing.T) {
+	source := "if [ -e /etc/default/test_service ]; then set -a; . /etc/default/test_service; set +a; fi\n"
+
+	root := newTestRoot(t, []string{"etc/init"}, "sbin/initctl")
+	d := newTestDaemon(t, root, newFakeRunner())
+	plan, err := d.(Renderer).Render(InstallOptions{Environment: []string{"PORT=80"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job := plan.Actions[0].Content; !strings.Contains(job, "script\n    "+source+"    exec ") || !strings.Contains(job, "env PORT='80'\n") {
+		t.Errorf("job does not source the env file:\n%s", job)
+	}
+
+	root = newTestRoot(t, []string{"etc/init.d"})
+	d = newTestDaemon(t, root, newFakeRunner())
+	plan, err = d.(Renderer).Render(InstallOptions{Environment: []string{"PORT=80"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script := plan.Actions[0].Content; !strings.Contains(script, "export PORT='80'\n"+source) {
+		t.Errorf("script does not source the env file after the options:\n%s", script)
+	}
+	if editor, ok := d.(EnvEditor); !ok || editor.EnvFile() != "/etc/default/test_service" {
+		t.Errorf("SysV daemon is not an EnvEditor of /etc/default/test_service")
+	}
+}
+
+func TestOpenRCLifecycle(t *testing.T) {
+	root := newTestRoot(t, []string{"etc/init.d", "etc/runlevels/default", "run"}, "sbin/openrc-run")
+	runner := newFakeRunner()
+	d, err := NewWithConfig(Config{
+		Name:        "test service",
+		Description: "test daemon",
+		Kind:        SystemDaemon,
+		Requires:    []string{"postgresql.service"},
+		After:       []string{"nss-lookup.target"},
+		Root:        root,
+		Runner:      runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.(*openRCRecord); !ok {
+		t.Fatalf("got %T, want *openRCRecord", d)
+	}
+	script := filepath.Join(root, "etc/init.d/test_service")
+
+	err = d.InstallWithOptions(InstallOptions{Executable: "/usr/bin/app", Args: []string{"-v", "--port", "80"}, User: "app", Group: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := readFile(t, script)
+	for _, line := range []string{
+		"#!/sbin/openrc-run\n",
+		`command="/usr/bin/app"` + "\n",
+		"command_args='-v --port 80'\n",
+		`command_user="app:app"` + "\n",
+		`supervisor="supervise-daemon"` + "\n",
+		"if [ -e /etc/conf.d/test_service ]; then set -a; . /etc/conf.d/test_service; set +a; fi\n",
+		"depend() {\n\tuse net\n\tneed postgresql\n\tafter dns\n}\n",
+		`supervise-daemon "${RC_SVCNAME}" --signal HUP`,
+	} {
+		if !strings.Contains(content, line) {
+			t.Errorf("script is missing %q:\n%s", line, content)
+		}
+	}
+	if !runner.ran("rc-update add test_service default") {
+		t.Errorf("not added to the default runlevel: %v", runner.calls)
+	}
+	if editor, ok := d.(EnvEditor); !ok || editor.EnvFile() != "/etc/conf.d/test_service" {
+		t.Error("OpenRC daemon is not an EnvEditor of /etc/conf.d/test_service")
+	}
+
+	runner.outputs["rc-service test_service status"] = " * status: stopped\n"
+	runner.errors["rc-service test_service status"] = exitError(3)
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateStopped || status.Enabled || status.UpToDate == nil || !*status.UpToDate {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := d.Start(); err != nil || !runner.ran("rc-service test_service start") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+
+	// rc-update would have linked it into the runlevel
+	os.Symlink("/etc/init.d/test_service", filepath.Join(root, "etc/runlevels/default/test_service"))
+	os.WriteFile(filepath.Join(root, "run/test_service.pid"), []byte(strconv.Itoa(os.Getpid())), 0644)
+	delete(runner.errors, "rc-service test_service status")
+	runner.outputs["rc-service test_service status"] = " * status: started\n"
+	// the pid file is the one of supervise-daemon, the service is its child
+	if status, _ := d.Query(); status.State != StateRunning || status.PID != 0 || !status.Enabled {
+		t.Errorf("supervisor taken for the service: %+v", status)
+	}
+	tasks := filepath.Join(root, "proc", strconv.Itoa(os.Getpid()), "task", strconv.Itoa(os.Getpid()))
+	os.MkdirAll(tasks, 0755)
+	os.WriteFile(filepath.Join(tasks, "children"), []byte(strconv.Itoa(os.Getppid())+" "), 0644)
+	if status, _ := d.Query(); status.PID != os.Getppid() {
+		t.Errorf("service pid: got %d, want the child %d", status.PID, os.Getppid())
+	}
+	// the service holding its own pid file, see Service.Lock
+	main := filepath.Join(root, "run/test_service.main.pid")
+	os.WriteFile(main, []byte(strconv.Itoa(os.Getpid())), 0644)
+	lock, err := os.Open(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	if status, _ := d.Query(); status.PID != os.Getpid() {
+		t.Errorf("service pid: got %d, want the holder of the lock %d", status.PID, os.Getpid())
+	}
+	lock.Close()
+	// start-stop-daemon writes the pid of the service itself
+	plan, err := d.(Renderer).Render(InstallOptions{Executable: "/usr/bin/app", Restart: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(script, []byte(plan.Actions[0].Content), 0755)
+	if status, _ := d.Query(); status.PID != os.Getpid() {
+		t.Errorf("service pid: got %d, want the one of the pid file %d", status.PID, os.Getpid())
+	}
+	runner.outputs["rc-service test_service status"] = " * status: crashed\n"
+	runner.errors["rc-service test_service status"] = exitError(32)
+	if status, _ := d.Query(); status.State != StateFailed {
+		t.Errorf("crashed service: got %v, want failed", status.State)
+	}
+
+	runner.outputs["rc-service test_service status"] = " * status: started\n"
+	delete(runner.errors, "rc-service test_service status")
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.ran("rc-service test_service stop") || !runner.ran("rc-update del test_service default") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	if _, err := os.Stat(script); !os.IsNotExist(err) {
+		t.Errorf("script still exists after remove: %v", err)
+	}
+
+	if _, err := d.(Renderer).Render(InstallOptions{OnCalendar: "daily"}); !errors.Is(err, ErrUnsupportedSystem) {
+		t.Errorf("timer: got %v, want ErrUnsupportedSystem", err)
+	}
+}
+
+func TestRunitLifecycle(t *testing.T) {
+	root := newTestRoot(t, []string{"run/runit", "var/service", "etc/sv"})
+	runner := newFakeRunner()
+	d, err := NewWithConfig(Config{
+		Name:        "test service",
+		Description: "test daemon",
+		Kind:        SystemDaemon,
+		Requires:    []string{"postgresql.service", "network-online.target"},
+		Root:        root,
+		Runner:      runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record, ok := d.(*supervisedRecord); !ok || record.suite != runit {
+		t.Fatalf("got %T, want the runit record", d)
+	}
+	dir := filepath.Join(root, "etc/sv/test_service")
+
+	err = d.InstallWithOptions(InstallOptions{Executable: "/usr/bin/app", Args: []string{"-v"}, User: "app", Group: "app", Restart: "no"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := readFile(t, filepath.Join(dir, "run"))
+	for _, line := range []string{
+		"#!/bin/sh\n# test_service test daemon\nexec 2>&1\n",
+		"sv start /var/service/postgresql || exit 1\n",
+		"if [ -e /etc/default/test_service ]; then set -a; . /etc/default/test_service; set +a; fi\n",
+		"exec chpst -u app:app /usr/bin/app -v\n",
+	} {
+		if !strings.Contains(run, line) {
+			t.Errorf("run is missing %q:\n%s", line, run)
+		}
+	}
+	if strings.Contains(run, "network-online") {
+		t.Errorf("run waits for a target:\n%s", run)
+	}
+	if finish := readFile(t, filepath.Join(dir, "finish")); !strings.Contains(finish, "exec sv down .\n") {
+		t.Errorf("finish does not keep the service down:\n%s", finish)
+	}
+	if logRun := readFile(t, filepath.Join(dir, "log/run")); !strings.Contains(logRun, "exec svlogd -tt '/var/log/test_service'\n") {
+		t.Errorf("unexpected log/run:\n%s", logRun)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "down")); err != nil {
+		t.Errorf("installed without a down file: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "var/service/test_service")); err != nil || target != "/etc/sv/test_service" {
+		t.Errorf("scan directory link: %q, %v", target, err)
+	}
+
+	runner.outputs["sv status /var/service/test_service"] = "down: /var/service/test_service: 3s; run: log: (pid 100) 3s\n"
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateStopped || status.Enabled || status.UpToDate == nil || !*status.UpToDate {
+		t.Errorf("unexpected status %+v", status)
+	}
+	if err := d.Start(); err != nil || !runner.ran("sv up /var/service/test_service") {
+		t.Errorf("start: %v, commands %v", err, runner.calls)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "down")); !os.IsNotExist(err) {
+		t.Errorf("down file left after start: %v", err)
+	}
+
+	runner.outputs["sv status /var/service/test_service"] = fmt.Sprintf("run: /var/service/test_service: (pid %d) 45s; run: log: (pid 100) 50s\n", os.Getpid())
+	if status, _ := d.Query(); status.State != StateRunning || status.PID != os.Getpid() || !status.Enabled {
+		t.Errorf("unexpected status %+v", status)
+	}
+	runner.outputs["sv status /var/service/test_service"] = "down: /var/service/test_service: 1s, normally up, want up\n"
+	if status, _ := d.Query(); status.State != StateStarting {
+		t.Errorf("exited service: got %v, want starting", status.State)
+	}
+
+	runner.outputs["sv status /var/service/test_service"] = fmt.Sprintf("run: /var/service/test_service: (pid %d) 45s\n", os.Getpid())
+	if err := d.Stop(); err != nil || !runner.ran("sv down /var/service/test_service") {
+		t.Errorf("stop: %v, commands %v", err, runner.calls)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "down")); err != nil {
+		t.Errorf("no down file after stop: %v", err)
+	}
+
+	diff, err := d.(Upgrader).Upgrade(InstallOptions{Executable: "/usr/bin/app", Args: []string{"-v"}, User: "app", Group: "app", Restart: "no", LogDir: "/srv/log"}, false)
+	if err != nil || !strings.Contains(diff, "+exec svlogd -tt '/srv/log'") {
+		t.Errorf("upgrade: %v\n%s", err, diff)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "down")); err != nil {
+		t.Errorf("upgrade touched the down file: %v", err)
+	}
+
+	if err := d.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if !runner.ran("sv down /var/service/test_service") {
+		t.Errorf("unexpected commands: %v", runner.calls)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "var/service/test_service")); !os.IsNotExist(err) {
+		t.Errorf("link still exists after remove: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("service directory still exists after remove: %v", err)
+	}
+}
+
+func TestS6(t *testing.T) {
+	root := newTestRoot(t, []string{"run/s6", "run/service"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	if record, ok := d.(*supervisedRecord); !ok || record.suite != s6 {
+		t.Fatalf("got %T, want the s6 record", d)
+	}
+	dir := filepath.Join(root, "etc/s6/sv/test_service")
+
+	if _, err := d.(Renderer).Render(InstallOptions{Executable: "/usr/bin/app", Group: "app"}); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("group: got %v, want ErrInvalidOptions", err)
+	}
+	err := d.InstallWithOptions(InstallOptions{Executable: "/usr/bin/app", User: "app", RestartSec: 10 * time.Second, LogDir: "-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run := readFile(t, filepath.Join(dir, "run")); !strings.Contains(run, "exec s6-setuidgid app /usr/bin/app") {
+		t.Errorf("unexpected run:\n%s", run)
+	}
+	if finish := readFile(t, filepath.Join(dir, "finish")); !strings.Contains(finish, "exec sleep 10\n") {
+		t.Errorf("unexpected finish:\n%s", finish)
+	}
+	if timeout := readFile(t, filepath.Join(dir, "timeout-finish")); timeout != "15000\n" {
+		t.Errorf("timeout-finish: got %q", timeout)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "log")); !os.IsNotExist(err) {
+		t.Errorf("log service installed with log dir -: %v", err)
+	}
+	if !runner.ran("s6-svscanctl -a /run/service") {
+		t.Errorf("scanner not told: %v", runner.calls)
+	}
+	if err := d.(LogReader).Logs(context.Background(), io.Discard, LogOptions{}); !errors.Is(err, ErrUnsupportedSystem) {
+		t.Errorf("logs without a log service: got %v, want ErrUnsupportedSystem", err)
+	}
+
+	for output, want := range map[string]State{
+		fmt.Sprintf("up (pid %d) 45 seconds\n", os.Getpid()):                   StateRunning,
+		"down (exitcode 0) 2 seconds, normally up\n":                           StateStopped,
+		"down (signal SIGTERM) 2 seconds\n":                                    StateStopped,
+		"down (exitcode 1) 2 seconds, normally up, ready 2 seconds\n":          StateFailed,
+		"down (exitcode 1) 0 seconds, normally up, want up, ready 0 seconds\n": StateStarting,
+	} {
+		runner.outputs["s6-svstat /run/service/test_service"] = output
+		if status, _ := d.Query(); status.State != want {
+			t.Errorf("%q: got %v, want %v", output, status.State, want)
+		}
+	}
+
+	runner.outputs["s6-svstat /run/service/test_service"] = "down (exitcode 0) 2 seconds\n"
+	if err := d.Restart(); err != nil || !runner.ran("s6-svc -u /run/service/test_service") {
+		t.Errorf("restart of a stopped service: %v, commands %v", err, runner.calls)
+	}
+}
+
+func TestForceBackend(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system"}, "sbin/openrc-run")
+	for backend, want := range map[string]string{
+		"":        "*daemon.systemDRecord",
+		"openrc":  "*daemon.openRCRecord",
+		"upstart": "*daemon.upstartRecord",
+		"sysv":    "*daemon.systemVRecord",
+		"runit":   "*daemon.supervisedRecord",
+	} {
+		d, err := NewWithConfig(Config{Name: "test", Kind: SystemDaemon, Backend: backend, Root: root, Runner: newFakeRunner()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%T", d); got != want {
+			t.Errorf("backend %q: got %s, want %s", backend, got, want)
+		}
+		if name := d.(BackendNamer).Backend(); backend != "" && name != backend || backend == "" && name != "systemd" {
+			t.Errorf("backend %q: named %s", backend, name)
+		}
+	}
+	if _, err := NewWithConfig(Config{Name: "test", Kind: SystemDaemon, Backend: "launchd", Root: root}); err == nil {
+		t.Error("unknown backend accepted")
+	}
+	if _, err := NewWithConfig(Config{Name: "test", Kind: UserDaemon, Backend: "runit", Root: root}); !errors.Is(err, ErrUnsupportedSystem) {
+		t.Errorf("user service with runit: got %v, want ErrUnsupportedSystem", err)
+	}
+}
+
+func TestPIDFile(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system"})
+	for backend, want := range map[string]string{
+		"systemd": "/var/run/test_service@eu1.pid",
+		"sysv":    "/var/run/test_service@eu1.pid",
+		"openrc":  "/run/test_service@eu1.main.pid",
+	} {
+		d, err := NewWithConfig(Config{Name: "test service", Kind: SystemDaemon, Instance: "eu1", Backend: backend, Root: root, Runner: newFakeRunner()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filer, ok := d.(PIDFiler); !ok || filer.PIDFile() != want {
+			t.Errorf("%s: not a PIDFiler of %s", backend, want)
+		}
+	}
+	user, err := NewWithConfig(Config{Name: "test service", Kind: UserDaemon, Root: root, Runner: newFakeRunner()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := user.(PIDFiler).PIDFile(); path != "" {
+		t.Errorf("user service has pid file %s", path)
+	}
+}
+
+func TestParseSystemDTime(t *testing.T) {
+	want := time.Date(2026, 10, 16, 2, 30, 0, 0, time.UTC)
+	for value, want := range map[string]time.Time{
+		"@1792117800":                 want,
+		"Fri 2026-10-16 02:30:00 UTC": want,
+		"n/a":                         {},
+		"":                            {},
+		"@soon":                       {},
+		// an abbreviation Go does not know would be read as UTC
+		"Fri 2026-10-16 04:30:00 XYZT": {},
+	} {
+		if got := parseSystemDTime(value); !got.Equal(want) {
+			t.Errorf("%q: got %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestSystemDShowFallback(t *testing.T) {
+	root := newTestRoot(t, []string{"run/systemd/system", "etc/systemd/system"})
+	runner := newFakeRunner()
+	d := newTestDaemon(t, root, runner)
+	if err := d.Install(); err != nil {
+		t.Fatal(err)
+	}
+	show := "systemctl show test_service.service --property=" + systemDStatusProperties
+	// systemd before 248
+	runner.errors[show+" --timestamp=unix"] = exitError(1)
+	runner.outputs[show] = "ActiveState=active\nMainPID=7\nExecMainStartTimestamp=Fri 2026-10-16 02:30:00 UTC\n"
+	status, err := d.Query()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.State != StateRunning || status.PID != 7 || !status.StartedAt.Equal(time.Date(2026, 10, 16, 2, 30, 0, 0, time.UTC)) {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
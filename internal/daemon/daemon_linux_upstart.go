@@ -5,11 +5,12 @@
 package daemon
 
 import (
+	"context"
+	"io"
 	"os"
-	"os/exec"
 	"regexp"
+	"strconv"
 	"strings"
-	"text/template"
 )
 
 // upstartRecord - standard record (struct) for linux upstart version of daemon package
@@ -17,7 +18,14 @@ type upstartRecord struct {
 	name         string
 	description  string
 	kind         Kind
-	dependencies []string
+	dependencies unitDependencies
+	instance     string
+	*host
+}
+
+// Backend - the init system the service is installed with
+func (linux *upstartRecord) Backend() string {
+	return "upstart"
 }
 
 // Standard service path for systemV daemons
@@ -28,79 +36,177 @@ func (linux *upstartRecord) servicePath() string {
 // Is a service installed
 func (linux *upstartRecord) isInstalled() bool {
 
-	if _, err := os.Stat(linux.servicePath()); err == nil {
+	if _, err := os.Stat(linux.path(linux.mainPath())); err == nil {
 		return true
 	}
 
 	return false
 }
 
+// Is the service installed as a job in /etc/cron.d
+func (linux *upstartRecord) isCronJob() bool {
+	return linux.exists(cronPath(linux.name))
+}
+
+// The generated file recording the install options
+func (linux *upstartRecord) mainPath() string {
+	if linux.isCronJob() {
+		return cronPath(linux.name)
+	}
+	return linux.servicePath()
+}
+
 // Check service is running
 func (linux *upstartRecord) checkRunning() (string, bool) {
-	output, err := exec.Command("status", linux.name).Output()
-	if err == nil {
-		if matched, err := regexp.MatchString(linux.name+" start/running", string(output)); err == nil && matched {
-			reg := regexp.MustCompile("process ([0-9]+)")
-			data := reg.FindStringSubmatch(string(output))
-			if len(data) > 1 {
-				return "Service (pid  " + data[1] + ") is running...", true
-			}
-			return "Service is running...", true
-		}
-	}
+	status := linux.queryStatus()
+	return status.String(), status.State == StateRunning
+}
 
-	return "Service is stopped", false
+// Ask upstart for the job state, e.g. "name start/running, process 123"
+func (linux *upstartRecord) queryStatus() *ServiceStatus {
+	status := &ServiceStatus{State: StateUnknown, UnitPath: linux.servicePath(), Enabled: true}
+	if data, err := os.ReadFile(linux.path("/etc/init/" + linux.name + ".override")); err == nil && strings.Contains(string(data), "manual") {
+		status.Enabled = false
+	}
+	output, err := linux.output("status", linux.name)
+	if err != nil {
+		return status
+	}
+	data := regexp.MustCompile(regexp.QuoteMeta(linux.name) + ` (start|stop)/([a-z-]+)`).FindStringSubmatch(string(output))
+	if len(data) < 3 {
+		return status
+	}
+	switch {
+	case data[1] == "start" && data[2] == "running":
+		status.State = StateRunning
+	case data[1] == "start":
+		status.State = StateStarting
+	case data[2] == "waiting":
+		status.State = StateStopped
+	default:
+		status.State = StateStopping
+	}
+	if data := regexp.MustCompile("process ([0-9]+)").FindStringSubmatch(string(output)); len(data) > 1 {
+		status.PID, _ = strconv.Atoi(data[1])
+	}
+	if status.State == StateRunning {
+		status.StartedAt = processStartTime(status.PID)
+	}
+	return status
 }
 
 // Install the service
 func (linux *upstartRecord) Install(args ...string) error {
+	return linux.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options
+func (linux *upstartRecord) InstallWithOptions(opts InstallOptions) error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
-	srvPath := linux.servicePath()
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return err
+	}
 
 	if linux.isInstalled() {
 		return ErrAlreadyInstalled
 	}
 
-	file, err := os.Create(srvPath)
-	if err != nil {
-		return err
+	return linux.apply(plan)
+}
+
+// Render - the plan InstallWithOptions would apply
+func (linux *upstartRecord) Render(opts InstallOptions) (*Plan, error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
 	}
-	defer file.Close()
 
-	execPatch, err := executablePath(linux.name)
+	execPatch, err := opts.executable(linux.name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	templ, err := template.New("upstatConfig").Parse(upstatConfig)
+	data := newTemplateData(linux.name, linux.description, linux.dependencies, execPatch, &opts)
+	data.setInstance(linux.instance)
+	data.EnvFile = linux.env
+	if data.Timer {
+		// no timers, cron runs the job
+		return cronPlan("upstart", linux.name, data, &opts)
+	}
+	job, err := renderTemplate("upstatConfig", upstatConfig, data)
 	if err != nil {
+		return nil, err
+	}
+
+	// upstart watches /etc/init and picks the job up by itself
+	plan := &Plan{Backend: "upstart"}
+	plan.write(linux.servicePath(), 0755, appendInstallOptions(job, &opts))
+
+	return plan, nil
+}
+
+// Remove the service
+func (linux *upstartRecord) Remove() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
-	if err := templ.Execute(
-		file,
-		&struct {
-			Name, Description, Path, Args string
-		}{linux.name, linux.description, execPatch, strings.Join(args, " ")},
-	); err != nil {
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if linux.isCronJob() {
+		plan := &Plan{Backend: "upstart"}
+		plan.remove(cronPath(linux.name))
+		return linux.apply(plan)
+	}
+
+	// stop before the job file goes, upstart cannot stop it afterwards
+	plan := &Plan{Backend: "upstart"}
+	if _, ok := linux.checkRunning(); ok {
+		plan.runUndo([]string{"start", linux.name}, "stop", linux.name)
+	}
+	plan.remove(linux.servicePath())
+
+	return linux.apply(plan)
+}
+
+// Start the service
+func (linux *upstartRecord) Start() error {
+
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
-	if err := os.Chmod(srvPath, 0755); err != nil {
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
+
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
+	if _, ok := linux.checkRunning(); ok {
+		return ErrAlreadyRunning
+	}
+
+	if err := linux.run("start", linux.name); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Remove the service
-func (linux *upstartRecord) Remove() error {
+// Stop the service
+func (linux *upstartRecord) Stop() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -108,17 +214,25 @@ func (linux *upstartRecord) Remove() error {
 		return ErrNotInstalled
 	}
 
-	if err := os.Remove(linux.servicePath()); err != nil {
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
+	if _, ok := linux.checkRunning(); !ok {
+		return ErrAlreadyStopped
+	}
+
+	if err := linux.run("stop", linux.name); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Start the service
-func (linux *upstartRecord) Start() error {
+// Restart the service
+func (linux *upstartRecord) Restart() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -126,21 +240,27 @@ func (linux *upstartRecord) Start() error {
 		return ErrNotInstalled
 	}
 
-	if _, ok := linux.checkRunning(); ok {
-		return ErrAlreadyRunning
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
+	// upstart refuses to restart a job which is not running
+	command := "restart"
+	if _, ok := linux.checkRunning(); !ok {
+		command = "start"
 	}
 
-	if err := exec.Command("start", linux.name).Run(); err != nil {
+	if err := linux.run(command, linux.name); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// Stop the service
-func (linux *upstartRecord) Stop() error {
+// Reload the service configuration
+func (linux *upstartRecord) Reload() error {
 
-	if ok, err := checkPrivileges(); !ok {
+	if ok, err := linux.checkPrivileges(); !ok {
 		return err
 	}
 
@@ -148,11 +268,15 @@ func (linux *upstartRecord) Stop() error {
 		return ErrNotInstalled
 	}
 
+	if linux.isCronJob() {
+		return ErrCronJob
+	}
+
 	if _, ok := linux.checkRunning(); !ok {
 		return ErrAlreadyStopped
 	}
 
-	if err := exec.Command("stop", linux.name).Run(); err != nil {
+	if err := linux.run("reload", linux.name); err != nil {
 		return err
 	}
 
@@ -161,18 +285,96 @@ func (linux *upstartRecord) Stop() error {
 
 // Status - Get service status
 func (linux *upstartRecord) Status() (string, error) {
-
-	if ok, err := checkPrivileges(); !ok {
+	status, err := linux.Query()
+	if status == nil {
 		return "", err
 	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (linux *upstartRecord) Query() (*ServiceStatus, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return nil, err
+	}
+
+	if !linux.isInstalled() {
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
+
+	status := &ServiceStatus{State: StateStopped, UnitPath: cronPath(linux.name), Enabled: true}
+	if !linux.isCronJob() {
+		status = linux.queryStatus()
+	}
+	status.UpToDate = linux.upToDate(linux.mainPath(), linux.Render)
+	return status, nil
+}
+
+// InstalledOptions - the options the installed job was rendered with
+func (linux *upstartRecord) InstalledOptions() (*InstallOptions, error) {
+
+	if !linux.isInstalled() {
+		return nil, ErrNotInstalled
+	}
+
+	return readInstallOptions(linux.path(linux.mainPath()))
+}
+
+// Diff - changes Upgrade would make to the installed job
+func (linux *upstartRecord) Diff(opts InstallOptions) (string, error) {
 
 	if !linux.isInstalled() {
-		return statNotInstalled, ErrNotInstalled
+		return "", ErrNotInstalled
+	}
+
+	plan, err := linux.Render(opts)
+	if err != nil {
+		return "", err
+	}
+
+	return linux.diff(plan), nil
+}
+
+// Upgrade - rewrite the installed job, reload upstart and optionally
+// restart the running service
+func (linux *upstartRecord) Upgrade(opts InstallOptions, restart bool) (string, error) {
+
+	if ok, err := linux.checkPrivileges(); !ok {
+		return "", err
+	}
+
+	diff, err := linux.Diff(opts)
+	if err != nil || diff == "" {
+		return diff, err
+	}
+
+	plan, _ := linux.Render(opts)
+	if err := linux.rewrite(plan); err != nil {
+		return "", err
+	}
+
+	if err := linux.run("initctl", "reload-configuration"); err != nil {
+		return "", err
+	}
+
+	if _, ok := linux.checkRunning(); restart && ok && !linux.isCronJob() {
+		if err := linux.run("restart", linux.name); err != nil {
+			return "", err
+		}
 	}
 
-	statusAction, _ := linux.checkRunning()
+	return diff, nil
+}
+
+// Logs - print the files the job appends the service output to
+func (linux *upstartRecord) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+
+	if !linux.isInstalled() {
+		return ErrNotInstalled
+	}
 
-	return statusAction, nil
+	return Tail(ctx, w, opts, linux.path("/var/log/"+linux.name+".log"), linux.path("/var/log/"+linux.name+".err"))
 }
 
 // Run - Run service
@@ -197,11 +399,21 @@ var upstatConfig = `# {{.Name}} {{.Description}}
 description     "{{.Description}}"
 author          "Pichu Chen <pichu@tih.tw>"
 
-start on runlevel [2345]
-stop on runlevel [016]
-
-respawn
-#kill timeout 5
-
-exec {{.Path}} {{.Args}} >> /var/log/{{.Name}}.log 2>> /var/log/{{.Name}}.err
-`
+start on {{.StartOn}}
+stop on {{.StopOn}}
+
+{{if ne .Restart "no"}}respawn
+{{end}}{{if .TimeoutStopSec}}kill timeout {{.TimeoutStopSec}}
+{{else}}#kill timeout 5
+{{end}}{{if .User}}setuid {{.User}}
+{{end}}{{if .Group}}setgid {{.Group}}
+{{end}}{{if .WorkingDirectory}}chdir {{.WorkingDirectory}}
+{{end}}{{range .Environment}}env {{.Key}}={{shellQuote .Value}}
+{{end}}{{if .LimitNOFILE}}limit nofile {{.LimitNOFILE}} {{.LimitNOFILE}}
+{{end}}
+{{if .EnvFile}}script
+    if [ -e {{.EnvFile}} ]; then set -a; . {{.EnvFile}}; set +a; fi
+    exec {{.Path}} {{.Args}} >> /var/log/{{.Name}}.log 2>> /var/log/{{.Name}}.err
+end script
+{{else}}exec {{.Path}} {{.Args}} >> /var/log/{{.Name}}.log 2>> /var/log/{{.Name}}.err
+{{end}}`
@@ -15,6 +15,7 @@ import (
 	"unicode/utf16"
 	"unsafe"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/mgr"
@@ -25,15 +26,35 @@ type windowsRecord struct {
 	name         string
 	description  string
 	kind         Kind
-	dependencies []string
+	dependencies unitDependencies
 }
 
-func newDaemon(name, description string, kind Kind, dependencies []string) (Daemon, error) {
-	return &windowsRecord{name, description, kind, dependencies}, nil
+// Backend - the init system the service is installed with
+func (windows *windowsRecord) Backend() string {
+	return "windows"
+}
+
+func newDaemon(config *Config) (Daemon, error) {
+	return &windowsRecord{config.Name, config.Description, config.Kind, config.dependencies()}, nil
 }
 
 // Install the service
 func (windows *windowsRecord) Install(args ...string) error {
+	return windows.InstallWithOptions(InstallOptions{Args: args})
+}
+
+// InstallWithOptions - Install the service with options, the service
+// manager only honours the arguments and the restart policy
+func (windows *windowsRecord) InstallWithOptions(opts InstallOptions) error {
+
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if opts.isTimer() {
+		// no timer or cron equivalent is generated here
+		return ErrUnsupportedSystem
+	}
 
 	execp, err := execPath()
 
@@ -57,13 +78,17 @@ func (windows *windowsRecord) Install(args ...string) error {
 		DisplayName:  windows.name,
 		Description:  windows.description,
 		StartType:    mgr.StartAutomatic,
-		Dependencies: windows.dependencies,
-	}, args...)
+		Dependencies: merge(windows.dependencies.Requires, windows.dependencies.BindsTo),
+	}, opts.Args...)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
+	if opts.Restart == "no" {
+		return nil
+	}
+
 	// set recovery action for service
 	// restart after 5 seconds for the first 3 times
 	// restart after 1 minute, otherwise
@@ -86,7 +111,13 @@ func (windows *windowsRecord) Install(args ...string) error {
 		},
 	}
 	// set reset period as a day
-	s.SetRecoveryActions(r, uint32(86400))
+	if err := s.SetRecoveryActions(r, uint32(86400)); err != nil {
+		// do not leave a service without its restart policy behind
+		if deleteErr := s.Delete(); deleteErr != nil {
+			return fmt.Errorf("set recovery actions: %w; rollback failed: delete service: %w", err, deleteErr)
+		}
+		return fmt.Errorf("set recovery actions: %w", err)
+	}
 
 	return nil
 }
@@ -104,8 +135,22 @@ func (windows *windowsRecord) Remove() error {
 		return getWindowsError(err)
 	}
 	defer s.Close()
+	// stop first, a deleted service keeps running until it exits
+	status, err := s.Query()
+	running := err == nil && status.State != svc.Stopped
+	if running {
+		if err := stopAndWait(s); err != nil {
+			return getWindowsError(err)
+		}
+	}
 	err = s.Delete()
 	if err != nil {
+		if running {
+			// put the service back as it was
+			if startErr := s.Start(); startErr != nil {
+				return fmt.Errorf("delete service: %w; rollback failed: start service: %w", getWindowsError(err), startErr)
+			}
+		}
 		return getWindowsError(err)
 	}
 
@@ -152,6 +197,40 @@ func (windows *windowsRecord) Stop() error {
 	return nil
 }
 
+// Restart the service
+func (windows *windowsRecord) Restart() error {
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return getWindowsError(err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(windows.name)
+	if err != nil {
+		return getWindowsError(err)
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return getWindowsError(err)
+	}
+	if status.State != svc.Stopped {
+		if err := stopAndWait(s); err != nil {
+			return getWindowsError(err)
+		}
+	}
+	if err = s.Start(); err != nil {
+		return getWindowsError(err)
+	}
+
+	return nil
+}
+
+// Reload is not supported by the windows service manager
+func (windows *windowsRecord) Reload() error {
+	return ErrUnsupportedSystem
+}
+
 func stopAndWait(s *mgr.Service) error {
 	// First stop the service. Then wait for the service to
 	// actually stop before starting it.
@@ -200,22 +279,59 @@ func getStopTimeout() time.Duration {
 
 // Status - Get service status
 func (windows *windowsRecord) Status() (string, error) {
+	status, err := windows.Query()
+	if status == nil {
+		return "", err
+	}
+	return status.String(), err
+}
+
+// Query - Get structured service status
+func (windows *windowsRecord) Query() (*ServiceStatus, error) {
 	m, err := mgr.Connect()
 	if err != nil {
-		return "", getWindowsError(err)
+		return nil, getWindowsError(err)
 	}
 	defer m.Disconnect()
 	s, err := m.OpenService(windows.name)
+	if serviceMissing(err) {
+		return &ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
 	if err != nil {
-		return "", getWindowsError(err)
+		return nil, getWindowsError(err)
 	}
 	defer s.Close()
 	status, err := s.Query()
 	if err != nil {
-		return "", getWindowsError(err)
+		return nil, getWindowsError(err)
+	}
+	result := &ServiceStatus{
+		PID:      int(status.ProcessId),
+		ExitCode: int(status.Win32ExitCode),
 	}
+	switch status.State {
+	case svc.Stopped:
+		result.State = StateStopped
+	case svc.StartPending, svc.ContinuePending:
+		result.State = StateStarting
+	case svc.StopPending:
+		result.State = StateStopping
+	case svc.Running, svc.Paused, svc.PausePending:
+		result.State = StateRunning
+	default:
+		result.State = StateUnknown
+	}
+	if config, err := s.Config(); err == nil {
+		result.Enabled = config.StartType == mgr.StartAutomatic
+		result.UnitPath = config.BinaryPathName
+	}
+	return result, nil
+}
 
-	return "Status: " + getWindowsServiceStateFromUint32(status.State), nil
+// Whether OpenService failed because the service does not exist, and not
+// for a reason such as access denied
+func serviceMissing(err error) bool {
+	return errors.Is(err, windows.ERROR_SERVICE_DOES_NOT_EXIST)
 }
 
 // Get executable path
@@ -249,27 +365,6 @@ func getWindowsError(inputError error) error {
 	return inputError
 }
 
-// Get windows service state
-func getWindowsServiceStateFromUint32(state svc.State) string {
-	switch state {
-	case svc.Stopped:
-		return "SERVICE_STOPPED"
-	case svc.StartPending:
-		return "SERVICE_START_PENDING"
-	case svc.StopPending:
-		return "SERVICE_STOP_PENDING"
-	case svc.Running:
-		return "SERVICE_RUNNING"
-	case svc.ContinuePending:
-		return "SERVICE_CONTINUE_PENDING"
-	case svc.PausePending:
-		return "SERVICE_PAUSE_PENDING"
-	case svc.Paused:
-		return "SERVICE_PAUSED"
-	}
-	return "SERVICE_UNKNOWN"
-}
-
 type serviceHandler struct {
 	executable Executable
 }
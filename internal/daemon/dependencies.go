@@ -0,0 +1,155 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// unitDependencies - the typed dependencies of a service, see Config.Requires
+type unitDependencies struct {
+	Requires, Wants, After, Before, BindsTo, PartOf, Conflicts []string
+}
+
+// The typed dependencies of the config, the untyped Dependencies are
+// required and ordered after as they always were
+func (config *Config) dependencies() unitDependencies {
+	return unitDependencies{
+		Requires:  merge(config.Dependencies, config.Requires),
+		Wants:     merge(config.Wants),
+		After:     merge(config.Dependencies, config.After),
+		Before:    merge(config.Before),
+		BindsTo:   merge(config.BindsTo),
+		PartOf:    merge(config.PartOf),
+		Conflicts: merge(config.Conflicts),
+	}
+}
+
+// ValidateDependencies - check the names of the dependencies, they end up
+// space separated in units and script headers
+func (config *Config) ValidateDependencies() error {
+	for _, list := range [][]string{config.Dependencies, config.Requires, config.Wants, config.After, config.Before, config.BindsTo, config.PartOf, config.Conflicts} {
+		for _, name := range list {
+			if name == "" || strings.ContainsAny(name, " \"'") || hasControl(name) {
+				return fmt.Errorf("invalid dependency %q, use the name of a unit such as network-online.target", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Lists joined without duplicates, in order
+func merge(lists ...[]string) []string {
+	var merged []string
+	for _, list := range lists {
+		for _, name := range list {
+			if !slices.Contains(merged, name) {
+				merged = append(merged, name)
+			}
+		}
+	}
+	return merged
+}
+
+// LSB facilities standing for the systemd targets of the same meaning
+var lsbFacilities = map[string]string{
+	"network.target":        "$network",
+	"network-online.target": "$network",
+	"nss-lookup.target":     "$named",
+	"time-sync.target":      "$time",
+	"local-fs.target":       "$local_fs",
+	"remote-fs.target":      "$remote_fs",
+	"rpcbind.target":        "$portmap",
+	"syslog.service":        "$syslog",
+}
+
+// Names of the dependencies as SysV knows them: facilities for the targets
+// it has one for, scripts for services. Other targets have no equivalent.
+func lsbNames(names ...[]string) []string {
+	return initNames(lsbFacilities, names...)
+}
+
+// OpenRC services standing for the systemd targets of the same meaning
+var openrcServices = map[string]string{
+	"network.target":        "net",
+	"network-online.target": "net",
+	"nss-lookup.target":     "dns",
+	"local-fs.target":       "localmount",
+	"remote-fs.target":      "netmount",
+	"syslog.service":        "logger",
+}
+
+// Names of the dependencies for an init system with scripts named after
+// the services and its own names for some targets, other targets are dropped
+func initNames(targets map[string]string, names ...[]string) []string {
+	var mapped []string
+	for _, name := range merge(names...) {
+		if target, ok := targets[name]; ok {
+			name = target
+		} else if strings.HasSuffix(name, ".target") {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".service")
+		if !slices.Contains(mapped, name) {
+			mapped = append(mapped, name)
+		}
+	}
+	return mapped
+}
+
+// The depend() body of an OpenRC script: need for the services it
+// requires, use for the ones it wants, after and before for the ordering
+func (deps *unitDependencies) openrcDepend() string {
+	lines := []string{"\tuse " + strings.Join(initNames(openrcServices, []string{"network.target"}, deps.Wants), " ")}
+	for _, dep := range []struct {
+		keyword string
+		names   []string
+	}{
+		{"need", initNames(openrcServices, deps.Requires, deps.BindsTo)},
+		{"after", initNames(openrcServices, deps.After)},
+		{"before", initNames(openrcServices, deps.Before)},
+	} {
+		if len(dep.names) > 0 {
+			lines = append(lines, "\t"+dep.keyword+" "+strings.Join(dep.names, " "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Names of the dependencies as upstart jobs, it has no targets
+func upstartJobs(names ...[]string) []string {
+	var jobs []string
+	for _, name := range merge(names...) {
+		if strings.Contains(name, ".") && !strings.HasSuffix(name, ".service") {
+			continue
+		}
+		jobs = append(jobs, strings.TrimSuffix(name, ".service"))
+	}
+	return jobs
+}
+
+// The start on / stop on conditions of an upstart job: it starts in the
+// multi-user runlevels once the jobs it requires or comes after have
+// started, and stops with the jobs it requires, is bound to or part of
+func (deps *unitDependencies) upstartEvents() (start, stop string) {
+	start, stop = "runlevel [2345]", "runlevel [016]"
+	after := upstartJobs(deps.Requires, deps.BindsTo, deps.After)
+	for _, job := range after {
+		start += " and started " + job
+	}
+	if len(after) > 0 {
+		start = "(" + start + ")"
+	}
+	with := upstartJobs(deps.Requires, deps.BindsTo, deps.PartOf)
+	for _, job := range with {
+		stop += " or stopping " + job
+	}
+	if len(with) > 0 {
+		stop = "(" + stop + ")"
+	}
+	return start, stop
+}
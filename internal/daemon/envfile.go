@@ -0,0 +1,216 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// EnvEditor is implemented by the daemons whose service reads an
+// environment file: EnvironmentFile= of the systemd unit, sourced by the
+// upstart job and the SysV script. Variables of the file override the
+// Environment of the install options.
+type EnvEditor interface {
+	// EnvFile - path of the environment file
+	EnvFile() string
+
+	// Env - the variables of the file as KEY=VALUE, in file order
+	Env() ([]string, error)
+
+	// SetEnv - add or replace variables given as KEY=VALUE
+	SetEnv(vars ...string) error
+
+	// UnsetEnv - remove variables, missing ones are ignored
+	UnsetEnv(keys ...string) error
+}
+
+// Path of the environment file of a system service: /etc/sysconfig on the
+// Red Hat family, /etc/default elsewhere
+func (h *host) envFilePath(name string) string {
+	if h.exists("/etc/sysconfig") {
+		return "/etc/sysconfig/" + name
+	}
+	return "/etc/default/" + name
+}
+
+// EnvFile - path of the environment file
+func (h *host) EnvFile() string {
+	return h.env
+}
+
+// Env - the variables of the file as KEY=VALUE, in file order
+func (h *host) Env() ([]string, error) {
+	lines, err := h.readEnvFile()
+	if err != nil {
+		return nil, err
+	}
+	var vars []string
+	for _, line := range lines {
+		if key, value, ok := parseEnvLine(line); ok {
+			vars = append(vars, key+"="+value)
+		}
+	}
+	return vars, nil
+}
+
+// SetEnv - add or replace variables given as KEY=VALUE
+func (h *host) SetEnv(vars ...string) error {
+	for _, v := range vars {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || !validEnvKey(key) {
+			return fmt.Errorf("%w: environment %q is not in KEY=VALUE form", ErrInvalidOptions, v)
+		}
+		// the file is read line by line
+		if hasControl(value) {
+			return fmt.Errorf("%w: environment %s has a newline or another control character", ErrInvalidOptions, key)
+		}
+	}
+	lines, err := h.readEnvFile()
+	if err != nil {
+		return err
+	}
+	for _, v := range vars {
+		key, value, _ := strings.Cut(v, "=")
+		line := key + "=" + quoteEnvValue(value)
+		found := false
+		for i := range lines {
+			if k, _, ok := parseEnvLine(lines[i]); ok && k == key {
+				lines[i], found = line, true
+			}
+		}
+		if !found {
+			lines = append(lines, line)
+		}
+	}
+	return h.writeEnvFile(lines)
+}
+
+// UnsetEnv - remove variables, missing ones are ignored
+func (h *host) UnsetEnv(keys ...string) error {
+	lines, err := h.readEnvFile()
+	if err != nil {
+		return err
+	}
+	kept := lines[:0]
+	for _, line := range lines {
+		if key, _, ok := parseEnvLine(line); ok && slices.Contains(keys, key) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return h.writeEnvFile(kept)
+}
+
+// Lines of the environment file, none when it does not exist yet
+func (h *host) readEnvFile() ([]string, error) {
+	content, err := os.ReadFile(h.path(h.env))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n"), nil
+}
+
+// Replace the environment file through a rename, the service never reads
+// half of it. The file holds secrets: a new one is only readable by root,
+// an existing one keeps the mode and owner given to it.
+func (h *host) writeEnvFile(lines []string) error {
+	if ok, err := h.checkPrivileges(); !ok {
+		return err
+	}
+	path := h.path(h.env)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return writeFileAtomic(path, []byte(content), 0600)
+	}
+	if err := writeFileAtomic(path, []byte(content), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return keepOwner(path, info)
+}
+
+// A key of the environment file is sourced by /bin/sh, it has to be a
+// shell variable name
+func validEnvKey(key string) bool {
+	for i, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// The key and the unquoted value of a KEY=VALUE line, false for comments,
+// blank lines and anything else
+func parseEnvLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "export "))
+	key, value, ok := strings.Cut(line, "=")
+	if !ok || !validEnvKey(key) {
+		return "", "", false
+	}
+	return key, unquoteEnvValue(value), true
+}
+
+// Quote a value the way both /bin/sh and systemd read it back: bare when
+// it is plain, single quoted otherwise
+func quoteEnvValue(value string) string {
+	plain := value != ""
+	for _, r := range value {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:,@+%=", r)) {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return value
+	}
+	return shellQuote(value)
+}
+
+// Undo the shell quoting of a value: single quotes, double quotes with
+// backslash escapes and bare backslash escapes, concatenated
+func unquoteEnvValue(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\'':
+			end := strings.IndexByte(value[i+1:], '\'')
+			if end < 0 {
+				end = len(value) - i - 1
+			}
+			out.WriteString(value[i+1 : i+1+end])
+			i += end + 1
+		case '"':
+			for i++; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) && strings.IndexByte("\"\\$`", value[i+1]) >= 0 {
+					i++
+				}
+				out.WriteByte(value[i])
+			}
+		case '\\':
+			if i+1 < len(value) {
+				i++
+				out.WriteByte(value[i])
+			}
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
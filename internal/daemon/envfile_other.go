@@ -0,0 +1,15 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package daemon
+
+import "os"
+
+// Give a rewritten file the owner of the file it replaced, files have no
+// unix owner here
+func keepOwner(path string, info os.FileInfo) error {
+	return nil
+}
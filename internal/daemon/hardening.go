@@ -0,0 +1,124 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// directive - one sandboxing setting of a systemd unit
+type directive struct {
+	Key, Value string
+}
+
+// Directives every profile shares: no privilege gain, a read-only system,
+// no access to homes, devices, kernel settings or namespaces
+var baseHardening = []directive{
+	{"NoNewPrivileges", "yes"},
+	{"ProtectSystem", "strict"},
+	{"ProtectHome", "yes"},
+	{"PrivateTmp", "yes"},
+	{"PrivateDevices", "yes"},
+	{"ProtectKernelTunables", "yes"},
+	{"ProtectKernelModules", "yes"},
+	{"ProtectKernelLogs", "yes"},
+	{"ProtectControlGroups", "yes"},
+	{"ProtectClock", "yes"},
+	{"ProtectHostname", "yes"},
+	{"RestrictNamespaces", "yes"},
+	{"RestrictRealtime", "yes"},
+	{"RestrictSUIDSGID", "yes"},
+	{"LockPersonality", "yes"},
+	{"SystemCallArchitectures", "native"},
+	{"SystemCallFilter", "@system-service"},
+}
+
+// Profiles accepted in InstallOptions.Hardening with the
+// directives they add to the unit
+var hardeningProfiles = map[string][]directive{
+	// no capabilities at all, IP and unix sockets as a client or on high ports
+	"strict": append(baseHardening[:len(baseHardening):len(baseHardening)],
+		directive{"CapabilityBoundingSet", ""},
+		directive{"RestrictAddressFamilies", "AF_UNIX AF_INET AF_INET6"},
+	),
+	// a server: may bind ports below 1024 without running with root powers
+	"network-service": append(baseHardening[:len(baseHardening):len(baseHardening)],
+		directive{"CapabilityBoundingSet", "CAP_NET_BIND_SERVICE"},
+		directive{"AmbientCapabilities", "CAP_NET_BIND_SERVICE"},
+		directive{"RestrictAddressFamilies", "AF_UNIX AF_INET AF_INET6 AF_NETLINK"},
+	),
+}
+
+// Names of the hardening profiles in order, for error messages
+func hardeningProfileNames() []string {
+	names := make([]string, 0, len(hardeningProfiles))
+	for name := range hardeningProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check the hardening profile, overrides and writable paths
+func (opts *InstallOptions) validateHardening() error {
+	if _, ok := hardeningProfiles[opts.Hardening]; opts.Hardening != "" && !ok {
+		return optionError("Hardening", "hardening profile %q is not one of %s", opts.Hardening, strings.Join(hardeningProfileNames(), ", "))
+	}
+	for _, override := range opts.HardeningOverrides {
+		key, value, ok := strings.Cut(override, "=")
+		if !ok || !validDirective(key) || strings.ContainsAny(value, "\n") {
+			return optionError("HardeningOverrides", "hardening override %q is not in Directive=value form", override)
+		}
+	}
+	for _, path := range opts.ReadWritePaths {
+		// systemd ignores a missing path prefixed with -
+		if p := strings.TrimPrefix(path, "-"); !filepath.IsAbs(p) || strings.ContainsAny(p, " \t\n") {
+			return optionError("ReadWritePaths", "read-write path %q is not an absolute path without spaces", path)
+		}
+	}
+	return nil
+}
+
+// A directive name is a word such as ProtectHome
+func validDirective(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// The sandboxing directives of the unit: the profile with the overrides
+// applied in order. An override replaces the directive of the profile or
+// adds one, an empty value removes it.
+func (opts *InstallOptions) hardening() []directive {
+	directives := append([]directive(nil), hardeningProfiles[opts.Hardening]...)
+	for _, override := range opts.HardeningOverrides {
+		key, value, _ := strings.Cut(override, "=")
+		index := -1
+		for i := range directives {
+			if directives[i].Key == key {
+				index = i
+				break
+			}
+		}
+		switch {
+		case value == "" && index >= 0:
+			directives = append(directives[:index], directives[index+1:]...)
+		case value == "":
+		case index >= 0:
+			directives[index].Value = value
+		default:
+			directives = append(directives, directive{key, value})
+		}
+	}
+	return directives
+}
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -52,14 +53,69 @@ func executablePath(name string) (string, error) {
 
 // Check root rights to use system service
 func checkPrivileges() (bool, error) {
+	switch uid := os.Geteuid(); {
+	case uid == 0:
+		return true, nil
+	case uid > 0:
+		return false, ErrRootPrivileges
+	}
+	return false, ErrUnsupportedSystem
+}
+
+// Kernel clock ticks per second used by /proc/<pid>/stat (USER_HZ)
+const clockTicks = 100
 
-	if output, err := exec.Command("id", "-u").Output(); err == nil {
-		if uid, parseErr := strconv.ParseUint(strings.TrimSpace(string(output)), 10, 32); parseErr == nil {
-			if uid == 0 {
-				return true, nil
+// Get the start time of a process from /proc, zero time if unknown
+func processStartTime(pid int) time.Time {
+	if pid <= 0 {
+		return time.Time{}
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	// the command name may contain spaces, fields are counted after it
+	data := string(stat)
+	if i := strings.LastIndexByte(data, ')'); i >= 0 {
+		data = data[i+1:]
+	}
+	fields := strings.Fields(data)
+	// starttime is field 22, the 20th one after "pid (comm)"
+	if len(fields) < 20 {
+		return time.Time{}
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	procStat, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}
+	}
+	for _, line := range strings.Split(string(procStat), "\n") {
+		if strings.HasPrefix(line, "btime ") {
+			boot, err := strconv.ParseInt(strings.TrimSpace(line[len("btime "):]), 10, 64)
+			if err != nil {
+				return time.Time{}
 			}
-			return false, ErrRootPrivileges
+			return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / clockTicks)
 		}
 	}
-	return false, ErrUnsupportedSystem
+	return time.Time{}
+}
+
+// Read a pid file, returns 0 if it does not exist or the process is gone
+func readPIDFile(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	if _, err := os.Stat("/proc/" + strconv.Itoa(pid)); err != nil {
+		return 0
+	}
+	return pid
 }
@@ -0,0 +1,123 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Runner runs the external commands (systemctl, service, initctl, ...) the
+// init-system backends drive. Replace it to test the backends or to record
+// what they would do.
+type Runner interface {
+	// Run - run the command and wait for it to finish
+	Run(name string, args ...string) error
+
+	// Output - run the command and return its standard output
+	Output(name string, args ...string) ([]byte, error)
+}
+
+// Streamer is implemented by the runners that can copy the output of a
+// long running command (journalctl -f) as it is produced
+type Streamer interface {
+	// Stream - run the command until it exits or ctx is done, writing its
+	// standard output to w
+	Stream(ctx context.Context, w io.Writer, name string, args ...string) error
+}
+
+// execRunner - default Runner backed by os/exec
+type execRunner struct{}
+
+func (execRunner) Stream(ctx context.Context, w io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+func (execRunner) Run(name string, args ...string) error {
+	return exec.Command(name, args...).Run()
+}
+
+func (execRunner) Output(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// host - the system a linux backend operates on: the filesystem root its
+// files are written under and the runner for init-system commands
+type host struct {
+	root   string
+	runner Runner
+
+	// env - path of the environment file of the service, see EnvEditor
+	env string
+}
+
+// Create the host described by the config
+func newHost(config *Config) *host {
+	h := &host{root: config.Root, runner: config.Runner}
+	if h.runner == nil {
+		h.runner = execRunner{}
+	}
+	return h
+}
+
+// Run a command writing its output to w as it comes, runners that cannot
+// stream return it once the command exited
+func (h *host) stream(ctx context.Context, w io.Writer, name string, args ...string) error {
+	if streamer, ok := h.runner.(Streamer); ok {
+		return streamer.Stream(ctx, w, name, args...)
+	}
+	output, err := h.runner.Output(name, args...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(output)
+	return err
+}
+
+// Is the host the live system rather than a prefix
+func (h *host) isLive() bool {
+	return h.root == "" || h.root == "/"
+}
+
+// Path of a system file under the host root
+func (h *host) path(name string) string {
+	if h.isLive() {
+		return name
+	}
+	return filepath.Join(h.root, name)
+}
+
+// Does a system file exist under the host root
+func (h *host) exists(name string) bool {
+	_, err := os.Stat(h.path(name))
+	return err == nil
+}
+
+// Run an init-system command
+func (h *host) run(name string, args ...string) error {
+	return h.runner.Run(name, args...)
+}
+
+// Run an init-system command and collect its output
+func (h *host) output(name string, args ...string) ([]byte, error) {
+	return h.runner.Output(name, args...)
+}
+
+// Check root rights, files written under a prefix need none
+func (h *host) checkPrivileges() (bool, error) {
+	if !h.isLive() {
+		return true, nil
+	}
+	return checkPrivileges()
+}
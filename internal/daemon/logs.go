@@ -0,0 +1,192 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// LogOptions selects the part of the service output Logs prints
+type LogOptions struct {
+	// Follow - keep printing new output until the context is done
+	Follow bool
+
+	// Lines - print only the last lines, everything when 0
+	Lines int
+
+	// Since - print only output written after this time. Plain log files
+	// are read from the first line stamped at or after Since, in RFC 3339
+	// or the layout of the log package; a file whose lines carry no
+	// timestamp is printed whole unless it was last written before Since.
+	Since time.Time
+}
+
+// LogReader is implemented by the daemons that know where the output of
+// the service goes: journald for systemd, the log files of the upstart
+// job, SysV script or launchd plist
+type LogReader interface {
+	// Logs - copy the service output to w
+	Logs(ctx context.Context, w io.Writer, opts LogOptions) error
+}
+
+// How often followed files are checked for new output
+var tailInterval = 250 * time.Millisecond
+
+// Tail - copy the end of log files to w, like tail(1); with more than one
+// file each part gets a "==> name <==" header. Missing files are skipped
+// unless none exists.
+func Tail(ctx context.Context, w io.Writer, opts LogOptions, files ...string) error {
+	type tailed struct {
+		name   string
+		offset int64
+	}
+	var found []*tailed
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		file := &tailed{name: name}
+		found = append(found, file)
+		if !opts.Since.IsZero() && info.ModTime().Before(opts.Since) {
+			// nothing new in it, follow from the end
+			file.offset = info.Size()
+			continue
+		}
+		if len(files) > 1 {
+			fmt.Fprintf(w, "==> %s <==\n", name)
+		}
+		if file.offset, err = tailLines(w, name, opts.Lines, opts.Since); err != nil {
+			return err
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no log file found: %v", files)
+	}
+	if !opts.Follow {
+		return nil
+	}
+
+	ticker := time.NewTicker(tailInterval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		for _, file := range found {
+			info, err := os.Stat(file.name)
+			if err != nil || info.Size() == file.offset {
+				continue
+			}
+			if info.Size() < file.offset {
+				// truncated or rotated in place, start over
+				file.offset = 0
+			}
+			if len(found) > 1 && last != file.name {
+				fmt.Fprintf(w, "\n==> %s <==\n", file.name)
+				last = file.name
+			}
+			if file.offset, err = copyFrom(w, file.name, file.offset); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Print the last n lines of a file, all when n is 0, logged since a time
+// when it is set, and return the size read
+func tailLines(w io.Writer, name string, n int, since time.Time) (int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(data))
+	if !since.IsZero() {
+		data = data[sinceOffset(data, since):]
+	}
+	if n > 0 {
+		end := bytes.TrimSuffix(data, []byte("\n"))
+		start := len(end)
+		for i := 0; i < n && start > 0; i++ {
+			start = bytes.LastIndexByte(end[:start], '\n')
+			if start < 0 {
+				start = 0
+				break
+			}
+		}
+		if start > 0 {
+			// skip the newline ending the previous line
+			start++
+		}
+		data = data[start:]
+	}
+	_, err = w.Write(data)
+	return size, err
+}
+
+// Layouts of the timestamp a log line starts with: the log package, RFC
+// 3339 and its variants without a zone, read as local time
+var lineTimeLayouts = []string{"2006/01/02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+// Offset of the first line logged at or after since. Lines are in time
+// order, one without a timestamp, such as the rest of a panic, goes with
+// the line before it. A file without timestamps is printed whole.
+func sinceOffset(data []byte, since time.Time) int {
+	stamped := false
+	for offset := 0; offset < len(data); {
+		line, _, _ := bytes.Cut(data[offset:], []byte("\n"))
+		if at, ok := lineTime(line); ok {
+			if !at.Before(since) {
+				return offset
+			}
+			stamped = true
+		}
+		offset += len(line) + 1
+	}
+	if !stamped {
+		return 0
+	}
+	return len(data)
+}
+
+// The timestamp a log line starts with
+func lineTime(line []byte) (time.Time, bool) {
+	field, _, _ := bytes.Cut(line, []byte(" "))
+	if at, err := time.Parse(time.RFC3339Nano, string(field)); err == nil {
+		return at, true
+	}
+	for _, layout := range lineTimeLayouts {
+		if len(line) < len(layout) {
+			continue
+		}
+		// fractions of a second after it are ignored
+		if at, err := time.ParseInLocation(layout, string(line[:len(layout)]), time.Local); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Copy a file from offset to its current end, return the new offset
+func copyFrom(w io.Writer, name string, offset int64) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return offset, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(w, file)
+	return offset + n, err
+}
@@ -0,0 +1,409 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// InstallOptions describes how the service is registered with the init
+// system. Zero values keep the defaults of the generated unit; backends
+// ignore the settings they have no equivalent for.
+type InstallOptions struct {
+	// Args - command line arguments passed to the executable
+	Args []string `json:"args,omitempty"`
+
+	// Executable - path of the program to run, the running binary when empty
+	Executable string `json:"executable,omitempty"`
+
+	// User - account the service runs as, root when empty
+	User string `json:"user,omitempty"`
+
+	// Group - primary group of the service process
+	Group string `json:"group,omitempty"`
+
+	// WorkingDirectory - working directory of the service process
+	WorkingDirectory string `json:"working_directory,omitempty"`
+
+	// Environment - extra variables in KEY=VALUE form
+	Environment []string `json:"environment,omitempty"`
+
+	// LimitNOFILE - maximum number of open files, 0 keeps the system default
+	LimitNOFILE int `json:"limit_nofile,omitempty"`
+
+	// Restart - restart policy using the systemd names (no, always,
+	// on-success, on-failure, on-abnormal, on-abort, on-watchdog),
+	// on-failure when empty
+	Restart string `json:"restart,omitempty"`
+
+	// RestartSec - delay before the service is restarted
+	RestartSec time.Duration `json:"restart_sec,omitempty"`
+
+	// TimeoutStopSec - how long to wait for the service to stop before it is killed
+	TimeoutStopSec time.Duration `json:"timeout_stop_sec,omitempty"`
+
+	// Notify - the service reports readiness over sd_notify (READY=1), the
+	// unit gets Type=notify so start waits for it. systemd only.
+	Notify bool `json:"notify,omitempty"`
+
+	// WatchdogSec - systemd restarts the service when it does not ping the
+	// watchdog (WATCHDOG=1) within this time. Requires Notify.
+	WatchdogSec time.Duration `json:"watchdog_sec,omitempty"`
+
+	// Sockets - systemd socket activation, NAME=LISTEN entries such as
+	// https=443 or redirect=0.0.0.0:80. Each gets a <service>-NAME.socket
+	// unit with FileDescriptorName=NAME and ListenStream=LISTEN. systemd only.
+	Sockets []string `json:"sockets,omitempty"`
+
+	// Linger - keep the user manager running after logout so the service
+	// starts at boot (loginctl enable-linger). UserDaemon only.
+	Linger bool `json:"linger,omitempty"`
+
+	// OnCalendar - run the program as a scheduled job instead of a daemon,
+	// at the times of a systemd calendar spec such as daily or
+	// "Mon..Fri *-*-* 02:30". systemd gets a oneshot service and a .timer,
+	// SysV and upstart a file in /etc/cron.d.
+	OnCalendar string `json:"on_calendar,omitempty"`
+
+	// OnBootSec - run the job this long after boot, alone or with OnCalendar
+	OnBootSec time.Duration `json:"on_boot_sec,omitempty"`
+
+	// RandomizedDelaySec - delay every run by a random time up to this
+	RandomizedDelaySec time.Duration `json:"randomized_delay_sec,omitempty"`
+
+	// Persistent - catch up on a run missed while the machine was off.
+	// systemd only.
+	Persistent bool `json:"persistent,omitempty"`
+
+	// Hardening - sandboxing profile of the unit: "strict" (read-only
+	// system, no capabilities) or "network-service" (the same, but may bind
+	// ports below 1024). systemd only.
+	Hardening string `json:"hardening,omitempty"`
+
+	// HardeningOverrides - Directive=value entries applied over the profile
+	// such as ProtectHome=read-only; an empty value removes the directive
+	HardeningOverrides []string `json:"hardening_overrides,omitempty"`
+
+	// ReadWritePaths - paths the service may write to under the read-only
+	// system of a profile, a missing path is skipped when prefixed with -
+	ReadWritePaths []string `json:"read_write_paths,omitempty"`
+
+	// LogDir - directory the log service of runit (svlogd) and s6 (s6-log)
+	// writes to, /var/log/<name> when empty; - leaves the output to the
+	// scanner. runit and s6 only.
+	LogDir string `json:"log_dir,omitempty"`
+}
+
+// Is the service a scheduled job rather than a daemon
+func (opts *InstallOptions) isTimer() bool {
+	return opts.OnCalendar != "" || opts.OnBootSec > 0
+}
+
+// ErrInvalidOptions appears if the install options cannot be rendered
+var ErrInvalidOptions = errors.New("invalid install options")
+
+// OptionError - an install option that cannot be rendered, Validate
+// returns one. It is an ErrInvalidOptions.
+type OptionError struct {
+	// Option - name of the InstallOptions field, such as Restart
+	Option string
+
+	// Reason - what is wrong with it
+	Reason string
+}
+
+// Error - the install options are invalid and why
+func (err *OptionError) Error() string {
+	return ErrInvalidOptions.Error() + ": " + err.Reason
+}
+
+// Unwrap - ErrInvalidOptions
+func (err *OptionError) Unwrap() error {
+	return ErrInvalidOptions
+}
+
+// An OptionError about an option
+func optionError(option, format string, args ...any) error {
+	return &OptionError{Option: option, Reason: fmt.Sprintf(format, args...)}
+}
+
+// Restart policies accepted in InstallOptions.Restart
+var restartPolicies = []string{"no", "always", "on-success", "on-failure", "on-abnormal", "on-abort", "on-watchdog"}
+
+// Validate - check the options can be rendered, errors are an OptionError
+func (opts *InstallOptions) Validate() error {
+	if opts.Restart != "" {
+		valid := false
+		for _, policy := range restartPolicies {
+			if opts.Restart == policy {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return optionError("Restart", "restart policy %q is not one of %s", opts.Restart, strings.Join(restartPolicies, ", "))
+		}
+	}
+	if err := opts.validateLines(); err != nil {
+		return err
+	}
+	for _, env := range opts.Environment {
+		if key, _, ok := strings.Cut(env, "="); !ok || key == "" || strings.ContainsAny(key, " \t\n\"'=$") {
+			return optionError("Environment", "environment %q is not in KEY=VALUE form", env)
+		}
+	}
+	for _, socket := range opts.Sockets {
+		name, listen, ok := strings.Cut(socket, "=")
+		if !ok || !validSocketName(name) || listen == "" || strings.ContainsAny(listen, " \t\n") {
+			return optionError("Sockets", "socket %q is not in NAME=LISTEN form", socket)
+		}
+	}
+	if opts.WatchdogSec > 0 && !opts.Notify {
+		return optionError("WatchdogSec", "a watchdog needs notify, the service pings it over sd_notify")
+	}
+	for _, limit := range []struct {
+		option string
+		value  int64
+	}{
+		{"LimitNOFILE", int64(opts.LimitNOFILE)},
+		{"RestartSec", int64(opts.RestartSec)},
+		{"TimeoutStopSec", int64(opts.TimeoutStopSec)},
+		{"WatchdogSec", int64(opts.WatchdogSec)},
+		{"OnBootSec", int64(opts.OnBootSec)},
+		{"RandomizedDelaySec", int64(opts.RandomizedDelaySec)},
+	} {
+		if limit.value < 0 {
+			return optionError(limit.option, "limits and timeouts must not be negative")
+		}
+	}
+	if err := opts.validateHardening(); err != nil {
+		return err
+	}
+	return opts.validateTimer()
+}
+
+// Every value ends up on a line of a unit, a script or a cron file, where
+// a newline or another control character would start a directive, a
+// command or a job of its own
+func (opts *InstallOptions) validateLines() error {
+	fields := []struct {
+		option, name string
+		values       []string
+	}{
+		{"Args", "argument", opts.Args},
+		{"Executable", "executable", []string{opts.Executable}},
+		{"User", "user", []string{opts.User}},
+		{"Group", "group", []string{opts.Group}},
+		{"WorkingDirectory", "working directory", []string{opts.WorkingDirectory}},
+		{"Environment", "environment", opts.Environment},
+		{"Sockets", "socket", opts.Sockets},
+		{"OnCalendar", "calendar spec", []string{opts.OnCalendar}},
+		{"Hardening", "hardening profile", []string{opts.Hardening}},
+		{"HardeningOverrides", "hardening override", opts.HardeningOverrides},
+		{"ReadWritePaths", "read-write path", opts.ReadWritePaths},
+		{"LogDir", "log directory", []string{opts.LogDir}},
+	}
+	for _, field := range fields {
+		for _, value := range field.values {
+			if hasControl(value) {
+				return optionError(field.option, "%s %q has a control character", field.name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// Whether a value has a newline or another control character
+func hasControl(value string) bool {
+	return strings.IndexFunc(value, unicode.IsControl) >= 0
+}
+
+// A socket name is used in the unit name and FileDescriptorName
+func validSocketName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Path of the program the service runs
+func (opts *InstallOptions) executable(name string) (string, error) {
+	if opts.Executable != "" {
+		return opts.Executable, nil
+	}
+	return executablePath(name)
+}
+
+// envVar - one entry of InstallOptions.Environment as seen by the templates
+type envVar struct {
+	Key, Value string
+}
+
+// socketVar - one entry of InstallOptions.Sockets as seen by the templates
+type socketVar struct {
+	Name, Listen, Unit string
+}
+
+// templateData - values available to the service config templates
+type templateData struct {
+	Name, Description, Path, Args string
+
+	// Requires ... Conflicts - the typed dependencies, space separated.
+	// Dependencies is the Requires list, for templates written before them.
+	Dependencies                                               string
+	Requires, Wants, After, Before, BindsTo, PartOf, Conflicts string
+
+	// StartOn, StopOn - the events of an upstart job
+	StartOn, StopOn string
+
+	// RequiredStart, ShouldStart - the dependencies of a SysV script as
+	// LSB facilities and script names
+	RequiredStart, ShouldStart string
+
+	// Depend - the body of depend() in an OpenRC script
+	Depend string
+
+	User, Group, WorkingDirectory string
+	Environment                   []envVar
+	LimitNOFILE                   int
+	Restart                       string
+	RestartSec, TimeoutStopSec    int
+	Notify                        bool
+	WatchdogSec                   int
+	Sockets                       []socketVar
+
+	// Timer - rendering a scheduled job, see InstallOptions.OnCalendar
+	Timer                         bool
+	OnCalendar                    string
+	OnBootSec, RandomizedDelaySec int
+	Persistent                    bool
+
+	// Hardening - sandboxing directives, see InstallOptions.Hardening. The
+	// system is read-only in the sandbox, hardened units have no PID file.
+	Hardening      []directive
+	ReadWritePaths string
+
+	// EnvFile - the environment file the service reads, see EnvEditor
+	EnvFile string
+
+	// Instance - the instance name, %i in a systemd template unit
+	Instance string
+
+	// UserService - rendering a unit for the systemd user manager
+	UserService bool
+}
+
+// Build the template values from the record and install options
+func newTemplateData(name, description string, deps unitDependencies, path string, opts *InstallOptions) *templateData {
+	data := &templateData{
+		Name:             name,
+		Description:      description,
+		Dependencies:     strings.Join(deps.Requires, " "),
+		Requires:         strings.Join(deps.Requires, " "),
+		Wants:            strings.Join(deps.Wants, " "),
+		After:            strings.Join(deps.After, " "),
+		Before:           strings.Join(deps.Before, " "),
+		BindsTo:          strings.Join(deps.BindsTo, " "),
+		PartOf:           strings.Join(deps.PartOf, " "),
+		Conflicts:        strings.Join(deps.Conflicts, " "),
+		RequiredStart:    strings.Join(append([]string{"$network", "$named"}, lsbNames(deps.Requires, deps.BindsTo)...), " "),
+		ShouldStart:      strings.Join(lsbNames(deps.Wants, deps.After), " "),
+		Path:             path,
+		Args:             strings.Join(opts.Args, " "),
+		User:             opts.User,
+		Group:            opts.Group,
+		WorkingDirectory: opts.WorkingDirectory,
+		LimitNOFILE:      opts.LimitNOFILE,
+		Restart:          opts.Restart,
+		RestartSec:       int(opts.RestartSec / time.Second),
+		TimeoutStopSec:   int(opts.TimeoutStopSec / time.Second),
+		Notify:           opts.Notify,
+		WatchdogSec:      seconds(opts.WatchdogSec),
+
+		Timer:              opts.isTimer(),
+		OnCalendar:         opts.OnCalendar,
+		OnBootSec:          seconds(opts.OnBootSec),
+		RandomizedDelaySec: seconds(opts.RandomizedDelaySec),
+		Persistent:         opts.Persistent,
+
+		Hardening:      opts.hardening(),
+		ReadWritePaths: strings.Join(opts.ReadWritePaths, " "),
+	}
+	if data.Restart == "" {
+		data.Restart = "on-failure"
+		if data.Timer {
+			// the next run comes with the timer
+			data.Restart = "no"
+		}
+	}
+	data.StartOn, data.StopOn = deps.upstartEvents()
+	data.Depend = deps.openrcDepend()
+	for _, env := range opts.Environment {
+		key, value, _ := strings.Cut(env, "=")
+		data.Environment = append(data.Environment, envVar{key, value})
+	}
+	for _, socket := range opts.Sockets {
+		socketName, listen, _ := strings.Cut(socket, "=")
+		data.Sockets = append(data.Sockets, socketVar{socketName, listen, name + "-" + socketName + ".socket"})
+	}
+	return data
+}
+
+// Whole seconds for the templates, a duration under a second is rounded up
+// so it never turns into 0, which means off
+func seconds(d time.Duration) int {
+	if d > 0 && d < time.Second {
+		return 1
+	}
+	return int(d / time.Second)
+}
+
+// Set the instance of a service rendered for an init system without
+// template units, the %i specifier of the arguments becomes its name
+func (data *templateData) setInstance(instance string) {
+	if instance == "" {
+		return
+	}
+	data.Instance = instance
+	data.Args = strings.ReplaceAll(data.Args, "%i", instance)
+}
+
+// Render a service config template
+func renderTemplate(name, text string, data interface{}) (string, error) {
+	templ, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var content strings.Builder
+	if err := templ.Execute(&content, data); err != nil {
+		return "", err
+	}
+	return content.String(), nil
+}
+
+// Functions available to the service config templates
+var templateFuncs = template.FuncMap{
+	// quote a value for a systemd directive, specifiers are escaped
+	"systemdQuote": func(value string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace(value) + `"`
+	},
+	// quote a value for /bin/sh
+	"shellQuote": shellQuote,
+}
+
+// Quote a value for /bin/sh
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,13 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package daemon
+
+// Whether a process holds the lock on a pid file, pid files are never
+// locked here
+func pidFileLocked(path string) bool {
+	return false
+}
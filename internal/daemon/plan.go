@@ -0,0 +1,314 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Op is the kind of step an Action takes
+type Op string
+
+const (
+	// OpMkdir - create a directory and its parents
+	OpMkdir Op = "mkdir"
+
+	// OpWrite - create a file with the given content and mode
+	OpWrite Op = "write"
+
+	// OpSymlink - create a symbolic link to Target
+	OpSymlink Op = "symlink"
+
+	// OpRemove - remove a file or symbolic link
+	OpRemove Op = "remove"
+
+	// OpRun - run an init-system command
+	OpRun Op = "run"
+)
+
+// Action is one filesystem or init-system step taken by an install or remove
+type Action struct {
+	// Op - what the step does
+	Op Op `json:"op"`
+
+	// Path - file, directory or link the step creates
+	Path string `json:"path,omitempty"`
+
+	// Target - where a symlink points to
+	Target string `json:"target,omitempty"`
+
+	// Mode - permissions of a written file or directory
+	Mode os.FileMode `json:"mode,omitempty"`
+
+	// Content - contents of a written file
+	Content string `json:"content,omitempty"`
+
+	// Command - command line of a run step
+	Command []string `json:"command,omitempty"`
+
+	// Undo - command line that reverts a run step when a later step fails,
+	// the step is not reverted when empty
+	Undo []string `json:"undo,omitempty"`
+}
+
+// String - one line description of the action
+func (action *Action) String() string {
+	switch action.Op {
+	case OpMkdir:
+		return fmt.Sprintf("mkdir %s (%04o)", action.Path, action.Mode.Perm())
+	case OpWrite:
+		return fmt.Sprintf("write %s (%04o)", action.Path, action.Mode.Perm())
+	case OpSymlink:
+		return "symlink " + action.Path + " -> " + action.Target
+	case OpRemove:
+		return "remove " + action.Path
+	case OpRun:
+		return "run " + strings.Join(action.Command, " ")
+	}
+	return string(action.Op)
+}
+
+// Plan is everything an install or remove would write and run, in order
+type Plan struct {
+	// Backend - init system the plan is for: systemd, upstart, openrc, sysv, runit, s6
+	Backend string `json:"backend"`
+
+	// Actions - the steps to take
+	Actions []Action `json:"actions"`
+
+	// Reload - command that makes the init system pick up restored files
+	// while a failed plan is rolled back
+	Reload []string `json:"reload,omitempty"`
+}
+
+// Add a directory creation to the plan
+func (plan *Plan) mkdir(path string, mode os.FileMode) {
+	plan.Actions = append(plan.Actions, Action{Op: OpMkdir, Path: path, Mode: mode})
+}
+
+// Add a file write to the plan
+func (plan *Plan) write(path string, mode os.FileMode, content string) {
+	plan.Actions = append(plan.Actions, Action{Op: OpWrite, Path: path, Mode: mode, Content: content})
+}
+
+// Add a symlink creation to the plan
+func (plan *Plan) symlink(target, path string) {
+	plan.Actions = append(plan.Actions, Action{Op: OpSymlink, Path: path, Target: target})
+}
+
+// Add a file or symlink removal to the plan
+func (plan *Plan) remove(path string) {
+	plan.Actions = append(plan.Actions, Action{Op: OpRemove, Path: path})
+}
+
+// Add a command to the plan
+func (plan *Plan) run(command ...string) {
+	plan.Actions = append(plan.Actions, Action{Op: OpRun, Command: command})
+}
+
+// Add a command to the plan which is reverted by undo
+func (plan *Plan) runUndo(undo []string, command ...string) {
+	plan.Actions = append(plan.Actions, Action{Op: OpRun, Command: command, Undo: undo})
+}
+
+// Files - contents of every file the plan writes, by path
+func (plan *Plan) Files() map[string]string {
+	files := map[string]string{}
+	for _, action := range plan.Actions {
+		if action.Op == OpWrite {
+			files[action.Path] = action.Content
+		}
+	}
+	return files
+}
+
+// String - the actions of the plan with the full content of written files
+func (plan *Plan) String() string {
+	var text strings.Builder
+	text.WriteString("# backend: " + plan.Backend + "\n")
+	for _, action := range plan.Actions {
+		text.WriteString("==> " + action.String() + "\n")
+		if action.Op == OpWrite {
+			text.WriteString(action.Content)
+			if !strings.HasSuffix(action.Content, "\n") {
+				text.WriteString("\n")
+			}
+		}
+	}
+	return text.String()
+}
+
+// StepError describes a failed install or remove: the step that failed,
+// the completed steps which were undone and the ones that could not be
+type StepError struct {
+	// Step - the action that failed
+	Step Action
+
+	// Err - why it failed
+	Err error
+
+	// Undone - completed actions that were reverted, latest first
+	Undone []Action
+
+	// RollbackErrors - failures while reverting, the system is left
+	// half changed when not empty
+	RollbackErrors []error
+}
+
+// Error - the failed step, what was rolled back and what was not
+func (e *StepError) Error() string {
+	text := e.Step.String() + ": " + e.Err.Error()
+	if len(e.Undone) > 0 {
+		var undone []string
+		for _, action := range e.Undone {
+			undone = append(undone, action.String())
+		}
+		text += "; rolled back: " + strings.Join(undone, ", ")
+	}
+	for _, err := range e.RollbackErrors {
+		text += "; rollback failed: " + err.Error()
+	}
+	return text
+}
+
+// Unwrap - the step error and the rollback errors
+func (e *StepError) Unwrap() []error {
+	return append([]error{e.Err}, e.RollbackErrors...)
+}
+
+// A completed action and how to revert it
+type appliedAction struct {
+	action *Action
+	undo   func() error
+}
+
+// Take the actions of the plan on the host in order, all or nothing: when
+// an action fails the completed ones are reverted in reverse order
+func (h *host) apply(plan *Plan) error {
+	var applied []appliedAction
+	for i := range plan.Actions {
+		action := &plan.Actions[i]
+		undo, err := h.applyAction(action)
+		if err != nil {
+			return h.rollback(plan, &StepError{Step: *action, Err: err}, applied)
+		}
+		applied = append(applied, appliedAction{action, undo})
+	}
+	return nil
+}
+
+// Revert the applied actions and complete the error with the outcome
+func (h *host) rollback(plan *Plan, stepErr *StepError, applied []appliedAction) error {
+	// files restored since the last reload of the init system
+	restored := false
+	reload := func() {
+		if restored && len(plan.Reload) > 0 {
+			if err := h.run(plan.Reload[0], plan.Reload[1:]...); err != nil {
+				stepErr.RollbackErrors = append(stepErr.RollbackErrors, fmt.Errorf("run %s: %w", strings.Join(plan.Reload, " "), err))
+			}
+		}
+		restored = false
+	}
+	for i := len(applied) - 1; i >= 0; i-- {
+		action := applied[i].action
+		if applied[i].undo == nil {
+			continue
+		}
+		if action.Op == OpRun {
+			// commands act on what the init system has loaded
+			reload()
+		}
+		if err := applied[i].undo(); err != nil {
+			stepErr.RollbackErrors = append(stepErr.RollbackErrors, fmt.Errorf("undo %s: %w", action.String(), err))
+			continue
+		}
+		stepErr.Undone = append(stepErr.Undone, *action)
+		restored = restored || action.Op != OpRun
+	}
+	reload()
+	return stepErr
+}
+
+// Take a single action on the host, returns how to revert it
+func (h *host) applyAction(action *Action) (func() error, error) {
+	path := h.path(action.Path)
+	switch action.Op {
+	case OpMkdir:
+		// only the directories created here are removed again
+		var created []string
+		for dir := path; ; dir = filepath.Dir(dir) {
+			if _, err := os.Lstat(dir); err == nil {
+				break
+			}
+			created = append(created, dir)
+		}
+		if err := os.MkdirAll(path, action.Mode); err != nil {
+			return nil, err
+		}
+		return func() error {
+			for _, dir := range created {
+				if err := os.Remove(dir); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, nil
+	case OpWrite:
+		restore := h.saveFile(path)
+		if err := writeFileAtomic(path, []byte(action.Content), action.Mode); err != nil {
+			return nil, err
+		}
+		return restore, nil
+	case OpSymlink:
+		if err := os.Symlink(action.Target, path); err != nil {
+			return nil, err
+		}
+		return func() error { return os.Remove(path) }, nil
+	case OpRemove:
+		restore := h.saveFile(path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		return restore, nil
+	case OpRun:
+		if err := h.run(action.Command[0], action.Command[1:]...); err != nil {
+			return nil, err
+		}
+		if len(action.Undo) == 0 {
+			return nil, nil
+		}
+		return func() error { return h.run(action.Undo[0], action.Undo[1:]...) }, nil
+	}
+	return nil, fmt.Errorf("unknown action %q", action.Op)
+}
+
+// Snapshot a file or symlink, returns how to put it back as it is now
+func (h *host) saveFile(path string) func() error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		// did not exist, putting it back means removing it
+		return func() error { return os.Remove(path) }
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		return func() error {
+			if err != nil {
+				return err
+			}
+			os.Remove(path)
+			return os.Symlink(target, path)
+		}
+	}
+	content, err := os.ReadFile(path)
+	return func() error {
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(path, content, info.Mode().Perm())
+	}
+}
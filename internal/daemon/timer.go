@@ -0,0 +1,315 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrCronJob appears if a job scheduled through cron is asked to start or stop
+var ErrCronJob = errors.New("the job is scheduled by cron, it cannot be started or stopped")
+
+// Check the schedule of a job
+func (opts *InstallOptions) validateTimer() error {
+	if !opts.isTimer() {
+		if opts.RandomizedDelaySec > 0 {
+			return optionError("RandomizedDelaySec", "a randomized delay needs on-calendar or on-boot")
+		}
+		if opts.Persistent {
+			return optionError("Persistent", "persistent needs on-calendar or on-boot")
+		}
+		return nil
+	}
+	if strings.ContainsAny(opts.OnCalendar, "\n\"") {
+		return optionError("OnCalendar", "on-calendar %q is not a calendar spec", opts.OnCalendar)
+	}
+	if opts.Persistent && opts.OnCalendar == "" {
+		return optionError("Persistent", "persistent only applies to on-calendar")
+	}
+	if opts.Notify {
+		return optionError("Notify", "a scheduled job cannot use notify")
+	}
+	if len(opts.Sockets) > 0 {
+		return optionError("Sockets", "a scheduled job cannot use sockets")
+	}
+	switch opts.Restart {
+	case "always", "on-success":
+		return optionError("Restart", "restart %s would run the job in a loop, the timer starts it", opts.Restart)
+	}
+	return nil
+}
+
+var systemDTimerConfig = `[Unit]
+Description={{.Description}} (timer)
+
+[Timer]
+{{if .OnCalendar}}OnCalendar={{.OnCalendar}}
+{{end}}{{if .OnBootSec}}OnBootSec={{.OnBootSec}}
+{{end}}{{if .RandomizedDelaySec}}RandomizedDelaySec={{.RandomizedDelaySec}}
+{{end}}{{if .Persistent}}Persistent=true
+{{end}}Unit={{.Name}}.service
+
+[Install]
+WantedBy=timers.target
+`
+
+// Time of a systemd timestamp property, zero for n/a. With --timestamp=unix
+// it is @seconds. The local time older systemd print is only trusted in a
+// zone Go can tell the offset of: it takes an abbreviation it does not
+// know, CEST outside Europe/Berlin say, for UTC.
+func parseSystemDTime(value string) time.Time {
+	if seconds, ok := strings.CutPrefix(value, "@"); ok {
+		n, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(n, 0)
+	}
+	t, err := time.ParseInLocation("Mon 2006-01-02 15:04:05 MST", value, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	if zone, offset := t.Zone(); offset == 0 && zone != "UTC" && zone != "GMT" {
+		if local, _ := t.In(time.Local).Zone(); local != zone {
+			return time.Time{}
+		}
+	}
+	return t
+}
+
+// Path of the cron file of a job, run-parts ignores names with dots and
+// other punctuation
+func cronPath(name string) string {
+	return "/etc/cron.d/" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// The plan installing a job as a cron file, for the init systems without timers
+func cronPlan(backend, name string, data *templateData, opts *InstallOptions) (*Plan, error) {
+	command := data.Path + " " + data.Args
+	if data.WorkingDirectory != "" {
+		command = "cd " + shellQuote(data.WorkingDirectory) + " && " + command
+	}
+	if data.LimitNOFILE > 0 {
+		command = "ulimit -n " + strconv.Itoa(data.LimitNOFILE) + " && " + command
+	}
+	if data.RandomizedDelaySec > 0 {
+		command = "sleep $(awk 'BEGIN { srand(); print int(rand() * " + strconv.Itoa(data.RandomizedDelaySec) + ") }') && " + command
+	}
+	// a % starts the standard input of the command in cron
+	command = strings.ReplaceAll(strings.TrimSpace(command), "%", `\%`)
+	command += " >> /var/log/" + name + ".log 2>> /var/log/" + name + ".err"
+	user := data.User
+	if user == "" {
+		user = "root"
+	}
+
+	var entries []string
+	if opts.OnCalendar != "" {
+		schedule, err := cronSchedule(opts.OnCalendar)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, schedule+" "+user+" "+command)
+	}
+	if data.OnBootSec > 0 {
+		entries = append(entries, "@reboot "+user+" sleep "+strconv.Itoa(data.OnBootSec)+" && "+command)
+	}
+
+	content, err := renderTemplate("cronConfig", cronConfig, &struct {
+		*templateData
+		Entries []string
+	}{data, entries})
+	if err != nil {
+		return nil, err
+	}
+
+	// cron picks up files in /etc/cron.d by itself
+	plan := &Plan{Backend: backend}
+	plan.write(cronPath(name), 0644, appendInstallOptions(content, opts))
+	return plan, nil
+}
+
+var cronConfig = `# {{.Name}} {{.Description}}
+SHELL=/bin/sh
+PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin
+{{range .Environment}}{{.Key}}={{.Value}}
+{{end}}{{range .Entries}}{{.}}
+{{end}}`
+
+// Calendar shorthands with the times systemd gives them
+var cronShorthands = map[string]string{
+	"minutely":     "* * * * *",
+	"hourly":       "0 * * * *",
+	"daily":        "0 0 * * *",
+	"weekly":       "0 0 * * 1",
+	"monthly":      "0 0 1 * *",
+	"yearly":       "0 0 1 1 *",
+	"annually":     "0 0 1 1 *",
+	"quarterly":    "0 0 1 1,4,7,10 *",
+	"semiannually": "0 0 1 1,7 *",
+}
+
+// Day of week numbers of cron
+var cronWeekdays = map[string]int{
+	"mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6, "sun": 0,
+	"monday": 1, "tuesday": 2, "wednesday": 3, "thursday": 4, "friday": 5, "saturday": 6, "sunday": 0,
+}
+
+// Convert a systemd calendar spec to the five time fields of cron. The
+// forms cron can express are supported: the shorthands such as daily, and
+// "[weekdays] [*-month-day] hour:minute[:00]" with *, lists, ranges and
+// repetitions (0/15).
+func cronSchedule(spec string) (string, error) {
+	invalid := optionError("OnCalendar", "on-calendar %q cannot be expressed as a cron schedule", spec)
+	if schedule, ok := cronShorthands[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		return schedule, nil
+	}
+
+	fields := strings.Fields(spec)
+	weekdays := "*"
+	if len(fields) > 0 && unicode.IsLetter(rune(fields[0][0])) {
+		var err error
+		if weekdays, err = cronWeekdayField(fields[0]); err != nil {
+			return "", invalid
+		}
+		fields = fields[1:]
+	}
+	month, day := "*", "*"
+	if len(fields) == 2 {
+		date := strings.Split(fields[0], "-")
+		if len(date) == 2 {
+			date = append([]string{"*"}, date...)
+		}
+		if len(date) != 3 || date[0] != "*" {
+			// cron has no years
+			return "", invalid
+		}
+		var err1, err2 error
+		month, err1 = cronField(date[1], 1, 12)
+		day, err2 = cronField(date[2], 1, 31)
+		if err1 != nil || err2 != nil {
+			return "", invalid
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 1 {
+		return "", invalid
+	}
+	clock := strings.Split(fields[0], ":")
+	if len(clock) == 3 {
+		if second, err := strconv.Atoi(clock[2]); err != nil || second != 0 {
+			// cron runs jobs on the minute
+			return "", invalid
+		}
+		clock = clock[:2]
+	}
+	if len(clock) != 2 {
+		return "", invalid
+	}
+	hour, err1 := cronField(clock[0], 0, 23)
+	minute, err2 := cronField(clock[1], 0, 59)
+	if err1 != nil || err2 != nil {
+		return "", invalid
+	}
+	return strings.Join([]string{minute, hour, day, month, weekdays}, " "), nil
+}
+
+// Convert one numeric field: *, 5, 1,15, 1..5 or 0/15
+func cronField(value string, min, max int) (string, error) {
+	if value == "*" {
+		return value, nil
+	}
+	number := func(text string) (string, error) {
+		n, err := strconv.Atoi(text)
+		if err != nil || n < min || n > max {
+			return "", fmt.Errorf("%q out of range", text)
+		}
+		return strconv.Itoa(n), nil
+	}
+	var parts []string
+	for _, part := range strings.Split(value, ",") {
+		switch {
+		case strings.Contains(part, "/"):
+			start, step, _ := strings.Cut(part, "/")
+			if n, err := strconv.Atoi(step); err != nil || n <= 0 {
+				return "", fmt.Errorf("%q is not a repetition", part)
+			}
+			if start == "*" || start == strconv.Itoa(min) || start == "0"+strconv.Itoa(min) {
+				parts = append(parts, "*/"+step)
+				continue
+			}
+			first, err := number(start)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, first+"-"+strconv.Itoa(max)+"/"+step)
+		case strings.Contains(part, ".."):
+			from, to, _ := strings.Cut(part, "..")
+			first, err1 := number(from)
+			last, err2 := number(to)
+			if err1 != nil || err2 != nil {
+				return "", fmt.Errorf("%q is not a range", part)
+			}
+			parts = append(parts, first+"-"+last)
+		default:
+			n, err := number(part)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, n)
+		}
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// Convert the weekday field: Mon, Mon,Wed, Mon..Fri or Sat..Mon, a range
+// past Sunday is split in two
+func cronWeekdayField(value string) (string, error) {
+	var parts []string
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		from, to, isRange := strings.Cut(part, "..")
+		first, ok := cronWeekdays[from]
+		if !ok {
+			return "", fmt.Errorf("%q is not a weekday", from)
+		}
+		if !isRange {
+			parts = append(parts, strconv.Itoa(first))
+			continue
+		}
+		last, ok := cronWeekdays[to]
+		if !ok {
+			return "", fmt.Errorf("%q is not a weekday", to)
+		}
+		if last == 0 && first != 0 {
+			// Mon..Sun, Sunday is 7 at the end of a range
+			last = 7
+		}
+		if last < first {
+			// Sat..Mon
+			parts = append(parts, cronRange(first, 7), cronRange(1, last))
+			continue
+		}
+		parts = append(parts, cronRange(first, last))
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// A range of the cron weekday field, a single day when it is one
+func cronRange(first, last int) string {
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return strconv.Itoa(first) + "-" + strconv.Itoa(last)
+}
@@ -0,0 +1,233 @@
+// Copyright 2020 The Go Authors. All rights reserved.
+// Use of this source code is governed by
+// license that can be found in the LICENSE file.
+
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upgrader is implemented by the daemons that can rewrite an installed
+// service in place when the options, description, dependencies or
+// template changed
+type Upgrader interface {
+	// InstalledOptions - the options the installed service was rendered with
+	InstalledOptions() (*InstallOptions, error)
+
+	// Diff - unified diff from the installed files to what opts would
+	// render, empty when the service is up to date
+	Diff(opts InstallOptions) (string, error)
+
+	// Upgrade - atomically rewrite the files that differ, reload the init
+	// system and, if asked, restart the running service. Returns the diff
+	// that was applied, empty when nothing changed.
+	Upgrade(opts InstallOptions, restart bool) (string, error)
+}
+
+// Prefix of the trailing comment that records the install options in the
+// generated unit, init script or job file
+const optionsMarker = "# daemon-install: "
+
+// Record the install options at the end of a generated file, every format
+// rendered here takes # comments
+func appendInstallOptions(content string, opts *InstallOptions) string {
+	data, _ := json.Marshal(opts)
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	return content + optionsMarker + string(data) + "\n"
+}
+
+// Read the install options recorded in a generated file
+func readInstallOptions(path string) (*InstallOptions, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var opts *InstallOptions
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), optionsMarker); ok {
+			opts = &InstallOptions{}
+			if err := json.Unmarshal([]byte(data), opts); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		return nil, fmt.Errorf("%s: no install options recorded, it was installed by an older release", path)
+	}
+	return opts, nil
+}
+
+// Diff between the files on the host and the files the plan writes
+func (h *host) diff(plan *Plan) string {
+	var text strings.Builder
+	for _, action := range plan.Actions {
+		if action.Op != OpWrite {
+			continue
+		}
+		// a missing file diffs as empty
+		installed, _ := os.ReadFile(h.path(action.Path))
+		text.WriteString(diffText(action.Path, string(installed), action.Content))
+	}
+	return text.String()
+}
+
+// Rewrite the files of a plan which differ from the host, other actions
+// are left alone since they were taken by the install. All files are
+// rewritten or none.
+func (h *host) rewrite(plan *Plan) error {
+	changed := &Plan{Backend: plan.Backend, Reload: plan.Reload}
+	for _, action := range plan.Actions {
+		if action.Op != OpWrite {
+			continue
+		}
+		if installed, err := os.ReadFile(h.path(action.Path)); err == nil && string(installed) == action.Content {
+			continue
+		}
+		changed.Actions = append(changed.Actions, action)
+	}
+	return h.apply(changed)
+}
+
+// Write a file through a temporary file and a rename so readers never see
+// it half written
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Chmod(mode); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// Unified diff of two texts with three lines of context, empty when equal
+func diffText(name, from, to string) string {
+	if from == to {
+		return ""
+	}
+	a := splitLines(from)
+	b := splitLines(to)
+
+	// longest common subsequence table, files here are a few dozen lines
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+		a, b int
+	}
+	var lines []line
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, line{' ', a[i], i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, line{'+', b[j], i, j})
+			j++
+		default:
+			lines = append(lines, line{'-', a[i], i, j})
+			i++
+		}
+	}
+
+	const context = 3
+	var text strings.Builder
+	text.WriteString("--- " + name + " (installed)\n+++ " + name + " (rendered)\n")
+	for start := 0; start < len(lines); {
+		// find the next change and the hunk around it
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		from := max(first-context, start)
+		last := first
+		for k := first; k < len(lines) && k <= last+2*context; k++ {
+			if lines[k].op != ' ' {
+				last = k
+			}
+		}
+		to := min(last+context+1, len(lines))
+
+		countA, countB := 0, 0
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				countA++
+			}
+			if l.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&text, "@@ -%d,%d +%d,%d @@\n", lines[from].a+1, countA, lines[from].b+1, countB)
+		for _, l := range lines[from:to] {
+			text.WriteByte(l.op)
+			text.WriteString(l.text + "\n")
+		}
+		start = to
+	}
+	return text.String()
+}
+
+// Split a text into lines without the trailing newlines
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// Whether the installed file at path matches what render produces from
+// the options recorded in it, nil when nothing was recorded
+func (h *host) upToDate(path string, render func(InstallOptions) (*Plan, error)) *bool {
+	opts, err := readInstallOptions(h.path(path))
+	if err != nil {
+		return nil
+	}
+	plan, err := render(*opts)
+	if err != nil {
+		return nil
+	}
+	upToDate := h.diff(plan) == ""
+	return &upToDate
+}
@@ -0,0 +1,343 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Priority is the syslog severity of a journal entry
+type Priority int
+
+// Journal priorities, lower is more severe
+const (
+	PriEmerg Priority = iota
+	PriAlert
+	PriCrit
+	PriErr
+	PriWarning
+	PriNotice
+	PriInfo
+	PriDebug
+)
+
+// Socket journald accepts native protocol datagrams on
+const journalSocket = "/run/systemd/journal/socket"
+
+// Journal writes entries to the systemd journal over its native protocol,
+// with structured fields. When the journal socket is absent (no systemd, a
+// container) entries go to stderr as plain lines instead.
+//
+// A Journal is an io.Writer, one entry per line, so it can be the output of
+// the log package or EngineOptions.AccessWriter / ErrorWriter, and
+// Handler returns a log/slog handler.
+type Journal struct {
+	identifier string
+	priority   Priority
+	fields     map[string]string
+
+	socket   string
+	fallback io.Writer
+
+	// shared by the copies made by WithPriority and WithFields
+	conn *journalConn
+}
+
+// journalConn is the datagram connection to journald, dialed on first use
+type journalConn struct {
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// NewJournal returns a journal writer tagging entries with SYSLOG_IDENTIFIER
+// identifier, the executable name when empty, written at PriInfo
+func NewJournal(identifier string) *Journal {
+	return newJournal(identifier, journalSocket, os.Stderr)
+}
+
+func newJournal(identifier, socket string, fallback io.Writer) *Journal {
+	if _, err := os.Stat(socket); err != nil {
+		socket = ""
+	}
+	if identifier == "" {
+		identifier = journalIdentifier()
+	}
+	return &Journal{
+		identifier: identifier,
+		priority:   PriInfo,
+		socket:     socket,
+		fallback:   fallback,
+		conn:       &journalConn{},
+	}
+}
+
+// Enabled reports whether entries go to journald rather than stderr
+func (journal *Journal) Enabled() bool {
+	return journal.socket != ""
+}
+
+// WithPriority returns a copy of the journal writing at priority, e.g.
+// PriErr for EngineOptions.ErrorWriter
+func (journal *Journal) WithPriority(priority Priority) *Journal {
+	clone := *journal
+	clone.priority = priority
+	return &clone
+}
+
+// WithFields returns a copy of the journal adding fields to every entry.
+// Names are turned into journal field names: upper case, A-Z 0-9 and _.
+func (journal *Journal) WithFields(fields map[string]string) *Journal {
+	clone := *journal
+	clone.fields = make(map[string]string, len(journal.fields)+len(fields))
+	for key, value := range journal.fields {
+		clone.fields[key] = value
+	}
+	for key, value := range fields {
+		clone.fields[journalField(key)] = value
+	}
+	return &clone
+}
+
+// Write sends each line of p as an entry at the journal priority
+func (journal *Journal) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if err := journal.Send(string(line), journal.priority, nil); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Send writes one entry with extra fields, e.g. {"REQUEST_ID": id}
+func (journal *Journal) Send(message string, priority Priority, fields map[string]string) error {
+	entry := map[string]string{}
+	for key, value := range journal.fields {
+		entry[key] = value
+	}
+	for key, value := range fields {
+		entry[journalField(key)] = value
+	}
+	entry["MESSAGE"] = message
+	entry["PRIORITY"] = strconv.Itoa(int(priority))
+	if journal.identifier != "" {
+		entry["SYSLOG_IDENTIFIER"] = journal.identifier
+	}
+
+	if !journal.Enabled() {
+		return journal.writeFallback(message, entry)
+	}
+	if err := journal.conn.send(journal.socket, encodeJournalEntry(entry)); err != nil {
+		// e.g. larger than a datagram, the entry is not lost
+		return journal.writeFallback(message, entry)
+	}
+	return nil
+}
+
+// Plain line for stderr: the message and the non-standard fields
+func (journal *Journal) writeFallback(message string, entry map[string]string) error {
+	var line strings.Builder
+	line.WriteString(message)
+	var keys []string
+	for key := range entry {
+		switch key {
+		case "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER", "CODE_FILE", "CODE_LINE", "CODE_FUNC":
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		line.WriteString(" " + strings.ToLower(key) + "=" + strconv.Quote(entry[key]))
+	}
+	line.WriteString("\n")
+	_, err := io.WriteString(journal.fallback, line.String())
+	return err
+}
+
+// Send a datagram, dialing again once if journald went away
+func (conn *journalConn) send(socket string, data []byte) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if conn.conn == nil {
+			conn.conn, err = net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = conn.conn.Write(data); err == nil {
+			return nil
+		}
+		conn.conn.Close()
+		conn.conn = nil
+	}
+	return err
+}
+
+// Serialize an entry: KEY=value lines, values with a newline as KEY, a
+// little endian 64 bit length and the raw value
+func encodeJournalEntry(entry map[string]string) []byte {
+	keys := make([]string, 0, len(entry))
+	for key := range entry {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var data bytes.Buffer
+	for _, key := range keys {
+		value := entry[key]
+		if !strings.Contains(value, "\n") {
+			data.WriteString(key + "=" + value + "\n")
+			continue
+		}
+		data.WriteString(key + "\n")
+		binary.Write(&data, binary.LittleEndian, uint64(len(value)))
+		data.WriteString(value + "\n")
+	}
+	return data.Bytes()
+}
+
+// Journal field name for a key: upper case letters, digits and _, not
+// starting with _ (reserved for trusted fields) or a digit
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "F_" + name
+	}
+	return name
+}
+
+// Handler returns a log/slog handler writing to the journal. Attributes
+// become fields (request_id becomes REQUEST_ID, groups are prefixed with
+// GROUP_), the source position becomes CODE_FILE, CODE_LINE and CODE_FUNC.
+func (journal *Journal) Handler(opts *slog.HandlerOptions) slog.Handler {
+	if opts == nil {
+		opts = &slog.HandlerOptions{}
+	}
+	return &journalHandler{journal: journal, opts: opts}
+}
+
+// journalHandler is the slog.Handler of a Journal
+type journalHandler struct {
+	journal *Journal
+	opts    *slog.HandlerOptions
+	fields  map[string]string
+	prefix  string
+}
+
+func (handler *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minimum := slog.LevelInfo
+	if handler.opts.Level != nil {
+		minimum = handler.opts.Level.Level()
+	}
+	return level >= minimum
+}
+
+func (handler *journalHandler) Handle(_ context.Context, record slog.Record) error {
+	fields := make(map[string]string, len(handler.fields)+record.NumAttrs()+3)
+	for key, value := range handler.fields {
+		fields[key] = value
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		handler.addAttr(fields, handler.prefix, attr)
+		return true
+	})
+	if record.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{record.PC}).Next()
+		fields["CODE_FILE"] = frame.File
+		fields["CODE_LINE"] = strconv.Itoa(frame.Line)
+		fields["CODE_FUNC"] = frame.Function
+	}
+	return handler.journal.Send(record.Message, levelPriority(record.Level), fields)
+}
+
+func (handler *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *handler
+	clone.fields = make(map[string]string, len(handler.fields)+len(attrs))
+	for key, value := range handler.fields {
+		clone.fields[key] = value
+	}
+	for _, attr := range attrs {
+		handler.addAttr(clone.fields, handler.prefix, attr)
+	}
+	return &clone
+}
+
+func (handler *journalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return handler
+	}
+	clone := *handler
+	clone.prefix = handler.prefix + name + "_"
+	return &clone
+}
+
+// Add an attribute as a field, groups are flattened with their name as prefix
+func (handler *journalHandler) addAttr(fields map[string]string, prefix string, attr slog.Attr) {
+	if handler.opts.ReplaceAttr != nil && attr.Value.Kind() != slog.KindGroup {
+		attr = handler.opts.ReplaceAttr(nil, attr)
+	}
+	value := attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "_"
+		}
+		for _, member := range value.Group() {
+			handler.addAttr(fields, prefix, member)
+		}
+		return
+	}
+	fields[journalField(prefix+attr.Key)] = value.String()
+}
+
+// Journal priority of a slog level
+func levelPriority(level slog.Level) Priority {
+	switch {
+	case level >= slog.LevelError:
+		return PriErr
+	case level >= slog.LevelWarn:
+		return PriWarning
+	case level >= slog.LevelInfo:
+		return PriInfo
+	}
+	return PriDebug
+}
+
+// Journal returns a journal writer identified by the service name, see Journal
+func (service *Service) Journal() *Journal {
+	return NewJournal(service.name)
+}
+
+// journalIdentifier is the default identifier, the executable name
+func journalIdentifier() string {
+	if ex, err := os.Executable(); err == nil {
+		return filepath.Base(ex)
+	}
+	return fmt.Sprint(os.Getpid())
+}
@@ -0,0 +1,112 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"log"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listen on a unixgram socket standing in for journald
+func listenJournal(t *testing.T) (string, *net.UnixConn) {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return socket, conn
+}
+
+// Read and decode the next journal entry
+func readJournal(t *testing.T, conn *net.UnixConn) map[string]string {
+	t.Helper()
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := map[string]string{}
+	data := buf[:n]
+	for len(data) > 0 {
+		line, rest, _ := bytes.Cut(data, []byte("\n"))
+		if key, value, ok := bytes.Cut(line, []byte("=")); ok {
+			entry[string(key)] = string(value)
+			data = rest
+			continue
+		}
+		size := binary.LittleEndian.Uint64(rest[:8])
+		entry[string(line)] = string(rest[8 : 8+size])
+		data = rest[8+size+1:]
+	}
+	return entry
+}
+
+func TestJournalWriter(t *testing.T) {
+	socket, conn := listenJournal(t)
+	journal := newJournal("my-app", socket, nil)
+	if !journal.Enabled() {
+		t.Fatal("journal socket not found")
+	}
+
+	logger := log.New(journal.WithPriority(PriErr), "", 0)
+	logger.Print("disk full")
+	entry := readJournal(t, conn)
+	if entry["MESSAGE"] != "disk full" || entry["PRIORITY"] != "3" || entry["SYSLOG_IDENTIFIER"] != "my-app" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+
+	journal.WithFields(map[string]string{"component": "tus"}).Send("line one\nline two", PriWarning, map[string]string{"request-id": "abc"})
+	entry = readJournal(t, conn)
+	if entry["MESSAGE"] != "line one\nline two" || entry["COMPONENT"] != "tus" || entry["REQUEST_ID"] != "abc" || entry["PRIORITY"] != "4" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestJournalHandler(t *testing.T) {
+	socket, conn := listenJournal(t)
+	handler := newJournal("my-app", socket, nil).Handler(&slog.HandlerOptions{AddSource: true})
+	logger := slog.New(handler).With("request_id", "r-1").WithGroup("http")
+	logger.Warn("slow request", "status", 200, slog.Group("client", "ip", "10.0.0.1"))
+
+	entry := readJournal(t, conn)
+	want := map[string]string{
+		"MESSAGE":        "slow request",
+		"PRIORITY":       "4",
+		"REQUEST_ID":     "r-1",
+		"HTTP_STATUS":    "200",
+		"HTTP_CLIENT_IP": "10.0.0.1",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %q, want %q", key, entry[key], value)
+		}
+	}
+	if !strings.HasSuffix(entry["CODE_FILE"], "journal_test.go") || entry["CODE_LINE"] == "" {
+		t.Errorf("no source position in %v", entry)
+	}
+	if logger.Enabled(context.Background(), slog.LevelDebug) {
+		t.Errorf("debug enabled by default")
+	}
+}
+
+func TestJournalFallback(t *testing.T) {
+	var stderr bytes.Buffer
+	journal := newJournal("my-app", filepath.Join(t.TempDir(), "missing.sock"), &stderr)
+	if journal.Enabled() {
+		t.Fatal("journal enabled without a socket")
+	}
+	journal.Write([]byte("GET /ping 200\n"))
+	slog.New(journal.Handler(nil)).Info("started", "port", 8080)
+	if got := stderr.String(); got != "GET /ping 200\nstarted port=\"8080\"\n" {
+		t.Errorf("unexpected fallback output %q", got)
+	}
+}
@@ -0,0 +1,349 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"go.yaml.in/yaml/v3"
+)
+
+// Manifest is a service described in a YAML or TOML file, see LoadManifest
+type Manifest struct {
+	// Config - name, description, kind and dependencies of the service
+	Config Config
+
+	// Options - how the service is installed
+	Options InstallOptions
+}
+
+// manifestFile is the schema of a manifest file. Durations are strings such
+// as "5s" or "1m30s"; environment and sockets are maps.
+type manifestFile struct {
+	Name         string   `yaml:"name" toml:"name"`
+	Description  string   `yaml:"description" toml:"description"`
+	Kind         string   `yaml:"kind" toml:"kind"`
+	Backend      string   `yaml:"backend" toml:"backend"`
+	Dependencies []string `yaml:"dependencies" toml:"dependencies"`
+	Requires     []string `yaml:"requires" toml:"requires"`
+	Wants        []string `yaml:"wants" toml:"wants"`
+	After        []string `yaml:"after" toml:"after"`
+	Before       []string `yaml:"before" toml:"before"`
+	BindsTo      []string `yaml:"binds_to" toml:"binds_to"`
+	PartOf       []string `yaml:"part_of" toml:"part_of"`
+	Conflicts    []string `yaml:"conflicts" toml:"conflicts"`
+
+	Executable       string            `yaml:"executable" toml:"executable"`
+	Args             []string          `yaml:"args" toml:"args"`
+	User             string            `yaml:"user" toml:"user"`
+	Group            string            `yaml:"group" toml:"group"`
+	WorkingDirectory string            `yaml:"working_directory" toml:"working_directory"`
+	Environment      map[string]string `yaml:"environment" toml:"environment"`
+	LimitNOFILE      int               `yaml:"limit_nofile" toml:"limit_nofile"`
+	Restart          string            `yaml:"restart" toml:"restart"`
+	RestartSec       string            `yaml:"restart_sec" toml:"restart_sec"`
+	TimeoutStopSec   string            `yaml:"timeout_stop_sec" toml:"timeout_stop_sec"`
+	Notify           bool              `yaml:"notify" toml:"notify"`
+	WatchdogSec      string            `yaml:"watchdog_sec" toml:"watchdog_sec"`
+	Sockets          map[string]string `yaml:"sockets" toml:"sockets"`
+	Linger           bool              `yaml:"linger" toml:"linger"`
+
+	OnCalendar         string `yaml:"on_calendar" toml:"on_calendar"`
+	OnBootSec          string `yaml:"on_boot_sec" toml:"on_boot_sec"`
+	RandomizedDelaySec string `yaml:"randomized_delay_sec" toml:"randomized_delay_sec"`
+	Persistent         bool   `yaml:"persistent" toml:"persistent"`
+
+	Hardening          string            `yaml:"hardening" toml:"hardening"`
+	HardeningOverrides map[string]string `yaml:"hardening_overrides" toml:"hardening_overrides"`
+	ReadWritePaths     []string          `yaml:"read_write_paths" toml:"read_write_paths"`
+
+	LogDir string `yaml:"log_dir" toml:"log_dir"`
+}
+
+// LoadManifest reads a service manifest, TOML when the file name ends in
+// .toml and YAML otherwise:
+//
+//	name: my-app
+//	description: my app server
+//	wants: [network-online.target]
+//	after: [network-online.target]
+//	args: [--config, /etc/my-app/config.yaml]
+//	user: app
+//	environment:
+//	  APP_ENV: prod
+//	restart: always
+//	restart_sec: 5s
+//	limit_nofile: 65536
+//	hardening: network-service
+//	hardening_overrides:
+//	  ProtectHome: read-only
+//
+// Unknown keys are errors. Errors name the file, the line and the key.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file manifestFile
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = decodeTOML(path, data, &file)
+	} else {
+		err = decodeYAML(path, data, &file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	manifest, key, err := file.manifest()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", manifestPosition(path, data, key), key, err)
+	}
+	return manifest, nil
+}
+
+// NewServiceFromManifest create a new service from a manifest file, see
+// LoadManifest. The install command of Console installs it with the options
+// of the manifest, flags given on the command line take precedence.
+func NewServiceFromManifest(path string) (*Service, error) {
+	manifest, err := LoadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	service, err := NewServiceWithConfig(manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	service.manifest = &manifest.Options
+	return service, nil
+}
+
+// The service described by a manifest loaded with install --manifest: the
+// manifest overrides the name, description, kind and each kind of
+// dependencies it sets
+func (service *Service) withManifest(manifest *Manifest) (*Service, error) {
+	config := service.config
+	if manifest.Config.Name != "" {
+		config.Name = manifest.Config.Name
+	}
+	if manifest.Config.Description != "" {
+		config.Description = manifest.Config.Description
+	}
+	if manifest.Config.Kind != "" {
+		config.Kind = manifest.Config.Kind
+	}
+	if manifest.Config.Backend != "" {
+		config.Backend = manifest.Config.Backend
+	}
+	for _, deps := range []struct{ from, to *[]string }{
+		{&manifest.Config.Dependencies, &config.Dependencies},
+		{&manifest.Config.Requires, &config.Requires},
+		{&manifest.Config.Wants, &config.Wants},
+		{&manifest.Config.After, &config.After},
+		{&manifest.Config.Before, &config.Before},
+		{&manifest.Config.BindsTo, &config.BindsTo},
+		{&manifest.Config.PartOf, &config.PartOf},
+		{&manifest.Config.Conflicts, &config.Conflicts},
+	} {
+		if *deps.from != nil {
+			*deps.to = *deps.from
+		}
+	}
+	target, err := service.derive(config)
+	if err != nil {
+		return nil, err
+	}
+	target.manifest = &manifest.Options
+	return target, nil
+}
+
+// Strict YAML decoding, errors carry the line
+func decodeYAML(path string, data []byte, file *manifestFile) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(file)
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		// one line per problem: "line 3: field port not found in type ..."
+		var errs []error
+		for _, problem := range typeErr.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", path, yamlProblem.ReplaceAllString(problem, "unknown key $1")))
+		}
+		return errors.Join(errs...)
+	case err.Error() == "EOF":
+		return fmt.Errorf("%s: empty manifest", path)
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// yaml.v3 names unknown keys after the Go type, not after the manifest
+var yamlProblem = regexp.MustCompile(`field (\S+) not found in type \S+`)
+
+// Strict TOML decoding, errors carry the line and column
+func decodeTOML(path string, data []byte, file *manifestFile) error {
+	err := toml.NewDecoder(bytes.NewReader(data)).DisallowUnknownFields().Decode(file)
+	var strictErr *toml.StrictMissingError
+	var decodeErr *toml.DecodeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &strictErr):
+		var errs []error
+		for _, missing := range strictErr.Errors {
+			row, column := missing.Position()
+			errs = append(errs, fmt.Errorf("%s:%d:%d: unknown key %s", path, row, column, strings.Join(missing.Key(), ".")))
+		}
+		return errors.Join(errs...)
+	case errors.As(err, &decodeErr):
+		row, column := decodeErr.Position()
+		return fmt.Errorf("%s:%d:%d: %w", path, row, column, err)
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+// Convert the file to a manifest, on error return the key at fault
+func (file *manifestFile) manifest() (*Manifest, string, error) {
+	if strings.TrimSpace(file.Name) == "" {
+		return nil, "name", errors.New("the service needs a name")
+	}
+	manifest := &Manifest{
+		Config: Config{
+			Name:         file.Name,
+			Description:  file.Description,
+			Kind:         Kind(file.Kind),
+			Backend:      file.Backend,
+			Dependencies: file.Dependencies,
+			Requires:     file.Requires,
+			Wants:        file.Wants,
+			After:        file.After,
+			Before:       file.Before,
+			BindsTo:      file.BindsTo,
+			PartOf:       file.PartOf,
+			Conflicts:    file.Conflicts,
+		},
+		Options: InstallOptions{
+			Executable:       file.Executable,
+			Args:             file.Args,
+			User:             file.User,
+			Group:            file.Group,
+			WorkingDirectory: file.WorkingDirectory,
+			LimitNOFILE:      file.LimitNOFILE,
+			Restart:          file.Restart,
+			Notify:           file.Notify,
+			Linger:           file.Linger,
+			OnCalendar:       file.OnCalendar,
+			Persistent:       file.Persistent,
+			Hardening:        file.Hardening,
+			ReadWritePaths:   file.ReadWritePaths,
+			LogDir:           file.LogDir,
+		},
+	}
+	for _, deps := range []struct {
+		key  string
+		list []string
+	}{
+		{"dependencies", file.Dependencies}, {"requires", file.Requires}, {"wants", file.Wants},
+		{"after", file.After}, {"before", file.Before}, {"binds_to", file.BindsTo},
+		{"part_of", file.PartOf}, {"conflicts", file.Conflicts},
+	} {
+		if err := (&Config{Requires: deps.list}).ValidateDependencies(); err != nil {
+			return nil, deps.key, err
+		}
+	}
+	kinds := []Kind{UserAgent, GlobalAgent, GlobalDaemon, SystemDaemon, UserDaemon}
+	if file.Kind != "" && !slices.Contains(kinds, manifest.Config.Kind) {
+		return nil, "kind", fmt.Errorf("%q is not one of %v", file.Kind, kinds)
+	}
+	if file.Backend != "" && !slices.Contains(Backends, file.Backend) {
+		return nil, "backend", fmt.Errorf("%q is not one of %v", file.Backend, Backends)
+	}
+
+	durations := []struct {
+		key   string
+		value string
+		to    *time.Duration
+	}{
+		{"restart_sec", file.RestartSec, &manifest.Options.RestartSec},
+		{"timeout_stop_sec", file.TimeoutStopSec, &manifest.Options.TimeoutStopSec},
+		{"watchdog_sec", file.WatchdogSec, &manifest.Options.WatchdogSec},
+		{"on_boot_sec", file.OnBootSec, &manifest.Options.OnBootSec},
+		{"randomized_delay_sec", file.RandomizedDelaySec, &manifest.Options.RandomizedDelaySec},
+	}
+	for _, duration := range durations {
+		if duration.value == "" {
+			continue
+		}
+		d, err := time.ParseDuration(duration.value)
+		if err != nil || d < 0 {
+			return nil, duration.key, fmt.Errorf("%q is not a duration such as 5s or 1m30s", duration.value)
+		}
+		*duration.to = d
+	}
+
+	// sorted, the generated unit must not change from one install to the next
+	for _, key := range sortedKeys(file.Environment) {
+		manifest.Options.Environment = append(manifest.Options.Environment, key+"="+file.Environment[key])
+	}
+	for _, name := range sortedKeys(file.Sockets) {
+		manifest.Options.Sockets = append(manifest.Options.Sockets, name+"="+file.Sockets[name])
+	}
+	for _, key := range sortedKeys(file.HardeningOverrides) {
+		manifest.Options.HardeningOverrides = append(manifest.Options.HardeningOverrides, key+"="+file.HardeningOverrides[key])
+	}
+
+	// Validate names the option, point at its key
+	if err := manifest.Options.Validate(); err != nil {
+		return nil, manifestKey(err), err
+	}
+	return manifest, "", nil
+}
+
+// Keys of a map in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Manifest key an error of InstallOptions.Validate is about: the key of
+// the manifestFile field named after the option
+func manifestKey(err error) string {
+	var option *OptionError
+	if !errors.As(err, &option) {
+		return "options"
+	}
+	field, ok := reflect.TypeOf(manifestFile{}).FieldByName(option.Option)
+	if !ok {
+		return "options"
+	}
+	return field.Tag.Get("yaml")
+}
+
+// file:line of the first line defining key, the file alone when not found
+func manifestPosition(path string, data []byte, key string) string {
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if rest, ok := strings.CutPrefix(line, key); ok {
+			if rest = strings.TrimSpace(rest); strings.HasPrefix(rest, ":") || strings.HasPrefix(rest, "=") {
+				return fmt.Sprintf("%s:%d", path, i+1)
+			}
+		}
+		if line == "["+key+"]" {
+			return fmt.Sprintf("%s:%d", path, i+1)
+		}
+	}
+	return path
+}
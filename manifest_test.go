@@ -0,0 +1,138 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a manifest into a temporary directory
+func writeManifest(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadManifest(t *testing.T) {
+	want := &Manifest{
+		Config: Config{
+			Name:         "my-app",
+			Description:  "my app server",
+			Kind:         SystemDaemon,
+			Dependencies: []string{"network-online.target"},
+			Wants:        []string{"redis.service"},
+			After:        []string{"redis.service"},
+		},
+		Options: InstallOptions{
+			Args:        []string{"--config", "/etc/my-app/config.yaml"},
+			User:        "app",
+			Environment: []string{"APP_ENV=prod", "PORT=8080"},
+			Restart:     "always",
+			RestartSec:  5 * time.Second,
+			LimitNOFILE: 65536,
+			Sockets:     []string{"https=443"},
+
+			Hardening:          "network-service",
+			HardeningOverrides: []string{"MemoryDenyWriteExecute=yes", "ProtectHome=read-only"},
+			ReadWritePaths:     []string{"/var/lib/my-app"},
+		},
+	}
+	yamlPath := writeManifest(t, "my-app.yaml", `name: my-app
+description: my app server
+kind: SystemDaemon
+dependencies: [network-online.target]
+wants: [redis.service]
+after: [redis.service]
+args: [--config, /etc/my-app/config.yaml]
+user: app
+environment:
+  PORT: 8080
+  APP_ENV: prod
+restart: always
+restart_sec: 5s
+limit_nofile: 65536
+sockets:
+  https: "443"
+hardening: network-service
+hardening_overrides:
+  ProtectHome: read-only
+  MemoryDenyWriteExecute: "yes"
+read_write_paths: [/var/lib/my-app]
+`)
+	tomlPath := writeManifest(t, "my-app.toml", `name = "my-app"
+description = "my app server"
+kind = "SystemDaemon"
+dependencies = ["network-online.target"]
+wants = ["redis.service"]
+after = ["redis.service"]
+args = ["--config", "/etc/my-app/config.yaml"]
+user = "app"
+restart = "always"
+restart_sec = "5s"
+limit_nofile = 65536
+hardening = "network-service"
+read_write_paths = ["/var/lib/my-app"]
+
+[environment]
+APP_ENV = "prod"
+PORT = "8080"
+
+[sockets]
+https = "443"
+
+[hardening_overrides]
+ProtectHome = "read-only"
+MemoryDenyWriteExecute = "yes"
+`)
+	for _, path := range []string{yamlPath, tomlPath} {
+		manifest, err := LoadManifest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(manifest, want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", filepath.Base(path), manifest, want)
+		}
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	for _, test := range []struct {
+		name, content, want string
+	}{
+		{"unknown.yaml", "name: app\nargz: [-v]\n", "unknown.yaml: line 2: unknown key argz"},
+		{"unknown.toml", "name = \"app\"\nargz = [\"-v\"]\n", "unknown.toml:2:1: unknown key argz"},
+		{"type.yaml", "name: app\nlimit_nofile: many\n", "type.yaml: line 2: cannot unmarshal"},
+		{"syntax.toml", "name = \"app\"\nrestart = \n", "syntax.toml:2:"},
+		{"noname.yaml", "description: app\n", "noname.yaml: name: the service needs a name"},
+		{"duration.yaml", "name: app\nrestart_sec: 5\n", `duration.yaml:2: restart_sec: "5" is not a duration`},
+		{"restart.toml", "name = \"app\"\n\nrestart = \"sometimes\"\n", `restart.toml:3: restart: invalid install options: restart policy "sometimes"`},
+		{"env.yaml", "name: app\nenvironment:\n  BAD KEY: x\n", "env.yaml:2: environment: invalid install options"},
+		{"kind.yaml", "name: app\nkind: Daemon\n", `kind.yaml:2: kind: "Daemon" is not one of`},
+		{"backend.yaml", "name: app\nbackend: launchd\n", `backend.yaml:2: backend: "launchd" is not one of`},
+		{"empty.yaml", "", "empty.yaml: empty manifest"},
+		{"after.yaml", "name: app\nafter: [redis service]\n", `after.yaml:2: after: invalid dependency "redis service"`},
+		{"hardening.yaml", "name: app\nhardening: paranoid\n", `hardening.yaml:2: hardening: invalid install options: hardening profile "paranoid"`},
+		{"paths.toml", "name = \"app\"\nread_write_paths = [\"data\"]\n", "paths.toml:2: read_write_paths: invalid install options"},
+		{"watchdog.yaml", "name: app\nwatchdog_sec: 10s\n", "watchdog.yaml:2: watchdog_sec: invalid install options: a watchdog needs notify"},
+		{"limits.yaml", "name: app\nlimit_nofile: -1\n", "limits.yaml:2: limit_nofile: invalid install options"},
+		{"persistent.yaml", "name: app\npersistent: true\n", "persistent.yaml:2: persistent: invalid install options"},
+		{"workdir.yaml", "name: app\nworking_directory: \"/srv\\u0000\"\n", "workdir.yaml:2: working_directory: invalid install options"},
+	} {
+		_, err := LoadManifest(writeManifest(t, test.name, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	_, err := LoadManifest(writeManifest(t, "restart.yaml", "name: app\nrestart: sometimes\n"))
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("got %v, want ErrInvalidOptions", err)
+	}
+}
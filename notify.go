@@ -0,0 +1,128 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier speaks the systemd notify protocol: datagrams of KEY=VALUE lines
+// sent to the socket named by NOTIFY_SOCKET. Every method is a no-op when
+// the process was not started with Type=notify, so it is safe to call
+// unconditionally.
+type Notifier struct {
+	socket   string
+	watchdog time.Duration
+
+	mu   sync.Mutex
+	stop chan struct{}
+}
+
+// NewNotifier returns a notifier configured from NOTIFY_SOCKET, WATCHDOG_USEC
+// and WATCHDOG_PID
+func NewNotifier() *Notifier {
+	notifier := &Notifier{socket: os.Getenv("NOTIFY_SOCKET")}
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 {
+		// the watchdog may be meant for another process of the service
+		if pid := os.Getenv("WATCHDOG_PID"); pid == "" || pid == strconv.Itoa(os.Getpid()) {
+			notifier.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return notifier
+}
+
+// defaultNotifier is shared by Service and Engine so the watchdog is pinged once
+var defaultNotifier = sync.OnceValue(NewNotifier)
+
+// Enabled reports whether systemd is listening for notifications
+func (notifier *Notifier) Enabled() bool {
+	return notifier != nil && notifier.socket != ""
+}
+
+// Notify sends raw state assignments such as "READY=1" in one datagram
+func (notifier *Notifier) Notify(state ...string) error {
+	if !notifier.Enabled() {
+		return nil
+	}
+	// a leading @ names an abstract socket, the net package maps it
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifier.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(strings.Join(state, "\n") + "\n"))
+	return err
+}
+
+// Ready tells systemd the service finished starting up (READY=1)
+func (notifier *Notifier) Ready() error {
+	return notifier.Notify("READY=1", "MAINPID="+strconv.Itoa(os.Getpid()))
+}
+
+// Stopping tells systemd the service is shutting down (STOPPING=1)
+func (notifier *Notifier) Stopping() error {
+	return notifier.Notify("STOPPING=1")
+}
+
+// Status sets the free text shown by systemctl status (STATUS=)
+func (notifier *Notifier) Status(text string) error {
+	return notifier.Notify("STATUS=" + strings.ReplaceAll(text, "\n", " "))
+}
+
+// Watchdog pings the systemd watchdog once (WATCHDOG=1)
+func (notifier *Notifier) Watchdog() error {
+	return notifier.Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval is how often the watchdog has to be pinged, half of
+// WATCHDOG_USEC, or 0 when the unit has no WatchdogSec
+func (notifier *Notifier) WatchdogInterval() time.Duration {
+	if !notifier.Enabled() {
+		return 0
+	}
+	return notifier.watchdog / 2
+}
+
+// StartWatchdog pings the watchdog every WatchdogInterval in the background
+// until StopWatchdog. It does nothing without a watchdog or when already started.
+func (notifier *Notifier) StartWatchdog() {
+	interval := notifier.WatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if notifier.stop != nil {
+		return
+	}
+	stop := make(chan struct{})
+	notifier.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				notifier.Watchdog()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopWatchdog stops the pings started by StartWatchdog
+func (notifier *Notifier) StopWatchdog() {
+	if notifier == nil {
+		return
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if notifier.stop != nil {
+		close(notifier.stop)
+		notifier.stop = nil
+	}
+}
@@ -0,0 +1,107 @@
+package daemon
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Listen on a unixgram socket standing in for systemd and point NOTIFY_SOCKET at it
+func listenNotify(t *testing.T) *net.UnixConn {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets unavailable: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+	return conn
+}
+
+// Read the next notification
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotifier(t *testing.T) {
+	conn := listenNotify(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+	notifier := NewNotifier()
+	if !notifier.Enabled() || notifier.WatchdogInterval() != 10*time.Millisecond {
+		t.Fatalf("enabled %v, watchdog interval %v", notifier.Enabled(), notifier.WatchdogInterval())
+	}
+
+	if err := notifier.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readNotify(t, conn); !strings.HasPrefix(msg, "READY=1\nMAINPID=") {
+		t.Errorf("ready: %q", msg)
+	}
+	notifier.Status("serving\nrequests")
+	if msg := readNotify(t, conn); msg != "STATUS=serving requests\n" {
+		t.Errorf("status: %q", msg)
+	}
+
+	notifier.StartWatchdog()
+	notifier.StartWatchdog()
+	for i := 0; i < 2; i++ {
+		if msg := readNotify(t, conn); msg != "WATCHDOG=1\n" {
+			t.Errorf("watchdog: %q", msg)
+		}
+	}
+	notifier.StopWatchdog()
+	notifier.Stopping()
+	// pings already in flight may arrive before STOPPING
+	for msg := readNotify(t, conn); msg != "STOPPING=1\n"; msg = readNotify(t, conn) {
+		if msg != "WATCHDOG=1\n" {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	t.Setenv("WATCHDOG_USEC", "20000")
+	notifier := NewNotifier()
+	if notifier.Enabled() || notifier.WatchdogInterval() != 0 {
+		t.Errorf("notifier without a socket is enabled")
+	}
+	if err := notifier.Ready(); err != nil {
+		t.Errorf("ready without a socket: %v", err)
+	}
+	notifier.StartWatchdog()
+	notifier.StopWatchdog()
+
+	// a watchdog meant for another process
+	listenNotify(t)
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := NewNotifier().WatchdogInterval(); interval != 0 {
+		t.Errorf("watchdog of another pid: %v", interval)
+	}
+}
+
+func TestEngineNotifiesReady(t *testing.T) {
+	conn := listenNotify(t)
+	engine := NewEngineWithOptions(EngineOptions{})
+	engine.notifier = NewNotifier()
+
+	engine.Start("127.0.0.1:0")
+	if msg := readNotify(t, conn); !strings.HasPrefix(msg, "READY=1\n") {
+		t.Errorf("start: %q", msg)
+	}
+	engine.Shutdown()
+	if msg := readNotify(t, conn); msg != "STOPPING=1\n" {
+		t.Errorf("shutdown: %q", msg)
+	}
+}
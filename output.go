@@ -0,0 +1,230 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	takama "github.com/zdypro888/daemon/internal/daemon"
+)
+
+// ErrUsage appears if the command line of Console cannot be understood
+var ErrUsage = errors.New("invalid command line")
+
+// Process exit codes of the Console commands, see ExitCode. They are the
+// LSB init script ones where one fits, the codes from 150 on are this
+// package's own. They do not change between versions.
+const (
+	CodeOK               = 0   // the command succeeded, the service is running for status
+	CodeFailure          = 1   // any other error
+	CodeUsage            = 2   // ErrNoCommand, ErrUsage, ErrInvalidOptions, bad flags
+	CodeUnsupported      = 3   // ErrUnsupportedSystem, ErrCronJob
+	CodePrivileges       = 4   // ErrRootPrivileges
+	CodeNotInstalled     = 5   // ErrNotInstalled
+	CodeNotRunning       = 7   // ErrAlreadyStopped
+	CodeAlreadyInstalled = 150 // ErrAlreadyInstalled
+	CodeAlreadyRunning   = 151 // ErrAlreadyRunning
+	CodeCrashLoop        = 152 // ErrCrashLoop
+)
+
+// LSB exit codes of the status command, CodeOK when the service runs
+const (
+	CodeStatusFailed  = 1 // the service died, StateFailed
+	CodeStatusStopped = 3 // the service is not running, StateStopped
+	CodeStatusUnknown = 4 // any other state, the service is not installed or could not be queried
+)
+
+// The exit code and the error_code of the JSON output for each error
+var errorCodes = []struct {
+	err  error
+	name string
+	code int
+}{
+	{ErrNoCommand, "no_command", CodeUsage},
+	{ErrUsage, "usage", CodeUsage},
+	{ErrInvalidOptions, "invalid_options", CodeUsage},
+	{ErrUnsupportedSystem, "unsupported_system", CodeUnsupported},
+	{ErrCronJob, "cron_job", CodeUnsupported},
+	{ErrRootPrivileges, "root_privileges", CodePrivileges},
+	{ErrNotInstalled, "not_installed", CodeNotInstalled},
+	{ErrAlreadyStopped, "already_stopped", CodeNotRunning},
+	{ErrAlreadyInstalled, "already_installed", CodeAlreadyInstalled},
+	{ErrAlreadyRunning, "already_running", CodeAlreadyRunning},
+	{ErrCrashLoop, "crash_loop", CodeCrashLoop},
+}
+
+// StatusError is returned by the status command of Console when the
+// service is not running, Code is the LSB status code to exit with
+type StatusError struct {
+	Status *ServiceStatus
+	Code   int
+
+	// Err - the error querying the service, nil when its state is known
+	Err error
+}
+
+// Error - the state of the service or why it could not be queried
+func (err *StatusError) Error() string {
+	if err.Err != nil {
+		return err.Err.Error()
+	}
+	return "service is " + string(err.Status.State)
+}
+
+// Unwrap - the error querying the service
+func (err *StatusError) Unwrap() error {
+	return err.Err
+}
+
+// The error of the status command for the status of the service or the
+// error querying it, nil when the service runs or, for a scheduled job,
+// waits for its next run
+func statusError(status *ServiceStatus, err error) error {
+	if status == nil {
+		status = &ServiceStatus{State: StateUnknown}
+	}
+	if err == nil && status.State == StateRunning {
+		return nil
+	}
+	if err == nil && status.State == StateStopped && status.NextTrigger.After(time.Now()) {
+		// the timer is active, the job is not running between runs
+		return nil
+	}
+	code := CodeStatusUnknown
+	if err == nil {
+		switch status.State {
+		case StateFailed:
+			code = CodeStatusFailed
+		case StateStopped:
+			code = CodeStatusStopped
+		}
+	}
+	return &StatusError{Status: status, Code: code, Err: err}
+}
+
+// ExitCode returns the process exit code for an error of Console, see the
+// Code constants: the LSB status code for the status command, the Code of
+// an Exit for the commands running the app. Pass it to os.Exit:
+//
+//	if err := service.Console(); err != nil {
+//	    log.Print(err)
+//	    os.Exit(daemon.ExitCode(err))
+//	}
+func ExitCode(err error) int {
+	code, _ := errorCode(err)
+	return code
+}
+
+// The exit code and the stable name of an error
+func errorCode(err error) (int, string) {
+	if err == nil {
+		return CodeOK, ""
+	}
+	var status *StatusError
+	if errors.As(err, &status) {
+		return status.Code, strings.ReplaceAll(string(status.Status.State), "-", "_")
+	}
+	var exit *Exit
+	if errors.As(err, &exit) && !errors.Is(exit.Err, ErrCrashLoop) {
+		return exit.Code, "exit"
+	}
+	if exit != nil {
+		err = exit.Err
+	}
+	for _, known := range errorCodes {
+		if errors.Is(err, known.err) {
+			return known.code, known.name
+		}
+	}
+	return CodeFailure, "error"
+}
+
+// Report is the JSON document Console prints for every command with
+// --output json. Its fields do not change between versions, new ones may
+// be added.
+type Report struct {
+	// Action - the command: install, remove, start, status, ...
+	Action string `json:"action"`
+
+	// Service - name of the service, with the instance
+	Service string `json:"service,omitempty"`
+
+	// Backend - the init system, empty when it cannot be told
+	Backend string `json:"backend,omitempty"`
+
+	// UnitPath - the installed unit, init script or job file
+	UnitPath string `json:"unit_path,omitempty"`
+
+	// Result - ok, or error when the command failed or, for status, the
+	// service is not running
+	Result string `json:"result"`
+
+	// Output - what the command prints in text mode: the plan of install
+	// --dry-run, the diff of install --force, the variables of env list, ...
+	Output string `json:"output,omitempty"`
+
+	// Status - the status of the service after the command
+	Status *ServiceStatus `json:"status,omitempty"`
+
+	// Error - the error message
+	Error string `json:"error,omitempty"`
+
+	// ErrorCode - stable name of the error: not_installed, already_running,
+	// root_privileges, ..., the state for status
+	ErrorCode string `json:"error_code,omitempty"`
+
+	// ExitCode - the process exit code, see ExitCode
+	ExitCode int `json:"exit_code"`
+}
+
+// Run one command of Console with its output collected into a Report,
+// printed to w
+func (service *Service) consoleJSON(w io.Writer, command string, flags []string) error {
+	report := &Report{Action: command, Service: service.name}
+	var output bytes.Buffer
+	jsonService := *service
+	jsonService.jsonOutput = true
+	target, flags, err := jsonService.selectTarget(flags)
+	if command == "" {
+		err = ErrNoCommand
+	}
+	if err == nil {
+		report.Service = target.name
+		if namer, ok := target.Daemon.(takama.BackendNamer); ok {
+			report.Backend = namer.Backend()
+		}
+		// the unit is gone after remove
+		if status, _ := target.Query(); status != nil {
+			report.UnitPath = status.UnitPath
+		}
+		err = target.console(&output, command, flags)
+		if status, _ := target.Query(); status != nil {
+			report.Status = status
+			if status.UnitPath != "" {
+				report.UnitPath = status.UnitPath
+			}
+		}
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		report.Status = statusErr.Status
+	}
+	report.Output = output.String()
+	report.Result = "ok"
+	report.ExitCode, report.ErrorCode = errorCode(err)
+	if err != nil {
+		report.Result = "error"
+		report.Error = err.Error()
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if encodeErr := encoder.Encode(report); encodeErr != nil && err == nil {
+		return fmt.Errorf("print the report: %w", encodeErr)
+	}
+	return err
+}
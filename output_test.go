@@ -0,0 +1,196 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	takama "github.com/zdypro888/daemon/internal/daemon"
+)
+
+// consoleDaemon is an installed service in a given state whose start fails
+// with startErr
+type consoleDaemon struct {
+	testDaemon
+	state    State
+	startErr error
+}
+
+func (daemon consoleDaemon) Backend() string {
+	return "fake"
+}
+
+func (daemon consoleDaemon) Query() (*takama.ServiceStatus, error) {
+	if daemon.state == StateNotInstalled {
+		return &takama.ServiceStatus{State: StateNotInstalled}, ErrNotInstalled
+	}
+	return &takama.ServiceStatus{State: daemon.state, UnitPath: "/etc/fake/app"}, nil
+}
+
+func (daemon consoleDaemon) Status() (string, error) {
+	status, err := daemon.Query()
+	return status.String(), err
+}
+
+func (daemon consoleDaemon) Start() error {
+	return daemon.startErr
+}
+
+func TestExitCode(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want int
+	}{
+		{nil, CodeOK},
+		{errors.New("boom"), CodeFailure},
+		{ErrNoCommand, CodeUsage},
+		{fmt.Errorf("%w: bad restart", ErrInvalidOptions), CodeUsage},
+		{ErrUnsupportedSystem, CodeUnsupported},
+		{fmt.Errorf("install: %w", ErrRootPrivileges), CodePrivileges},
+		{ErrNotInstalled, CodeNotInstalled},
+		{ErrAlreadyStopped, CodeNotRunning},
+		{ErrAlreadyInstalled, CodeAlreadyInstalled},
+		{fmt.Errorf("%w: pid 1 holds /run/app.pid", ErrAlreadyRunning), CodeAlreadyRunning},
+		{&Exit{Reason: ExitFailed, Code: 42}, 42},
+		{&Exit{Reason: ExitFailed, Code: 1, Err: fmt.Errorf("%w: 5 times", ErrCrashLoop)}, CodeCrashLoop},
+		{statusError(&ServiceStatus{State: StateStopped}, nil), CodeStatusStopped},
+		{statusError(nil, ErrRootPrivileges), CodeStatusUnknown},
+		{statusError(nil, nil), CodeStatusUnknown},
+		{statusError(&ServiceStatus{State: StateStopped, NextTrigger: time.Now().Add(time.Hour)}, nil), CodeOK},
+		{statusError(&ServiceStatus{State: StateStopped, NextTrigger: time.Now().Add(-time.Hour)}, nil), CodeStatusStopped},
+	} {
+		if got := ExitCode(test.err); got != test.want {
+			t.Errorf("%v: got %d, want %d", test.err, got, test.want)
+		}
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	for _, test := range []struct {
+		state State
+		want  int
+	}{
+		{StateRunning, CodeOK},
+		{StateFailed, CodeStatusFailed},
+		{StateStopped, CodeStatusStopped},
+		{StateStarting, CodeStatusUnknown},
+		{StateNotInstalled, CodeStatusUnknown},
+	} {
+		service := &Service{Daemon: consoleDaemon{state: test.state}, name: "console-test"}
+		var output bytes.Buffer
+		err := service.console(&output, "status", nil)
+		if got := ExitCode(err); got != test.want {
+			t.Errorf("%s: exit code %d, want %d (%v)", test.state, got, test.want, err)
+		}
+		if test.state == StateNotInstalled && !errors.Is(err, ErrNotInstalled) {
+			t.Errorf("not installed: got %v", err)
+		}
+		if test.state == StateStopped && !strings.Contains(output.String(), "stopped") {
+			t.Errorf("stopped: printed %q", output.String())
+		}
+	}
+}
+
+func TestConsoleJSON(t *testing.T) {
+	service := &Service{Daemon: consoleDaemon{state: StateRunning, startErr: ErrAlreadyRunning}, name: "console-test"}
+	var output bytes.Buffer
+	err := service.consoleJSON(&output, "start", nil)
+	if !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("start: got %v", err)
+	}
+	var report Report
+	if err := json.Unmarshal(output.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, output.String())
+	}
+	if report.Action != "start" || report.Service != "console-test" || report.Backend != "fake" || report.UnitPath != "/etc/fake/app" ||
+		report.Result != "error" || report.ErrorCode != "already_running" || report.ExitCode != CodeAlreadyRunning {
+		t.Errorf("start: unexpected report %+v", report)
+	}
+
+	output.Reset()
+	if err := service.consoleJSON(&output, "status", nil); err != nil {
+		t.Errorf("status: %v", err)
+	}
+	report = Report{}
+	if err := json.Unmarshal(output.Bytes(), &report); err != nil {
+		t.Fatalf("%v: %s", err, output.String())
+	}
+	if report.Result != "ok" || report.ExitCode != CodeOK || report.Status == nil || report.Status.State != StateRunning || report.Output == "" {
+		t.Errorf("status: unexpected report %+v", report)
+	}
+
+	output.Reset()
+	if err := service.consoleJSON(&output, "", nil); !errors.Is(err, ErrNoCommand) {
+		t.Errorf("no command: got %v", err)
+	}
+	if !strings.Contains(output.String(), `"error_code": "no_command"`) {
+		t.Errorf("no command: %s", output.String())
+	}
+}
+
+func TestConsoleJSONEndless(t *testing.T) {
+	service := &Service{Daemon: consoleDaemon{state: StateRunning}, name: "console-test"}
+	for _, test := range []struct {
+		command string
+		args    []string
+	}{
+		{"logs", []string{"-f"}},
+		{"supervise", []string{"--args", "serve"}},
+	} {
+		var output bytes.Buffer
+		err := service.consoleJSON(&output, test.command, test.args)
+		if !errors.Is(err, ErrUsage) {
+			t.Errorf("%s: got %v, want ErrUsage", test.command, err)
+		}
+		if !strings.Contains(output.String(), `"error_code": "usage"`) {
+			t.Errorf("%s: %s", test.command, output.String())
+		}
+	}
+}
+
+func TestConsoleJSONBadFlag(t *testing.T) {
+	service := &Service{Daemon: consoleDaemon{state: StateRunning}, name: "console-test"}
+	for _, args := range [][]string{{"--no-such-flag"}, {"-h"}, {"-n", "many"}} {
+		var output bytes.Buffer
+		err := service.consoleJSON(&output, "logs", args)
+		if ExitCode(err) != CodeUsage {
+			t.Errorf("%v: got %v, want ErrUsage", args, err)
+		}
+		var report Report
+		if err := json.Unmarshal(output.Bytes(), &report); err != nil {
+			t.Fatalf("%v: %v: %s", args, err, output.String())
+		}
+		if report.ErrorCode != "usage" || report.ExitCode != CodeUsage {
+			t.Errorf("%v: unexpected report %+v", args, report)
+		}
+	}
+}
+
+func TestConsoleOutputFlag(t *testing.T) {
+	saved := os.Args
+	defer func() { os.Args = saved }()
+	service := &Service{Daemon: consoleDaemon{state: StateRunning}, name: "console-test"}
+	for _, args := range [][]string{
+		{"status", "--output"},
+		{"status", "--output="},
+		{"status", "--output", "yaml"},
+		{"--output", "status"},
+	} {
+		os.Args = append([]string{"app"}, args...)
+		if err := service.Console(); !errors.Is(err, ErrUsage) {
+			t.Errorf("%v: got %v, want ErrUsage", args, err)
+		}
+	}
+	if _, _, err := takeFlag([]string{"--instance"}, "instance"); !errors.Is(err, ErrUsage) {
+		t.Errorf("--instance without a value: got %v", err)
+	}
+	value, rest, err := takeFlag([]string{"-n", "5", "--instance=eu1"}, "instance")
+	if err != nil || value != "eu1" || len(rest) != 2 {
+		t.Errorf("--instance=eu1: got %q %v %v", value, rest, err)
+	}
+}
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	takama "github.com/zdypro888/daemon/internal/daemon"
+)
+
+// ErrAlreadyRunning appears if another instance of the service holds its lock
+var ErrAlreadyRunning = takama.ErrAlreadyRunning
+
+// errLocked - another process holds the lock of a pid file
+var errLocked = errors.New("locked")
+
+// InstanceLock is held by the running instance of a service, see Service.Lock
+type InstanceLock struct {
+	path string
+	file *os.File
+}
+
+// PIDFile returns where Lock writes the pid of the service: the pid file
+// the init system reads when it has one, /var/run/<name>.pid otherwise. A
+// process that may not create it there, such as a service running as its
+// own user, uses <name>.pid in $XDG_RUNTIME_DIR or the temporary
+// directory; one that finds it there and locked by another user's
+// instance does not start.
+func (service *Service) PIDFile() string {
+	return service.pidFiles()[0]
+}
+
+// Where the pid file may be, in the order Lock tries them
+func (service *Service) pidFiles() []string {
+	var paths []string
+	if filer, ok := service.Daemon.(takama.PIDFiler); ok && filer.PIDFile() != "" {
+		paths = append(paths, filer.PIDFile())
+	} else if defaultRunDir != "" {
+		paths = append(paths, filepath.Join(defaultRunDir, service.name+".pid"))
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return append(paths, filepath.Join(dir, service.name+".pid"))
+}
+
+// Lock makes the process the one running instance of the service: it takes
+// an exclusive lock on the pid file and writes its pid there. When another
+// process holds it the error wraps ErrAlreadyRunning and names that process.
+// The lock goes with the process, Unlock also removes the file. Unix only,
+// ErrUnsupportedSystem elsewhere:
+//
+//	lock, err := service.Lock()
+//	if err != nil {
+//	    log.Fatal(err) // service is already running: pid 1234 holds /var/run/my-app.pid
+//	}
+//	defer lock.Unlock()
+func (service *Service) Lock() (*InstanceLock, error) {
+	var lastErr error
+	for _, path := range service.pidFiles() {
+		file, err := lockFile(path)
+		if errors.Is(err, errLocked) {
+			return nil, alreadyRunning(path)
+		}
+		if err != nil {
+			if _, statErr := os.Stat(path); !errors.Is(statErr, os.ErrNotExist) {
+				// an instance running as another user, e.g. root, holds
+				// a file this process may only read
+				if lockHeld(path) {
+					return nil, alreadyRunning(path)
+				}
+				return nil, err
+			}
+			// not ours to write, e.g. /var/run for a service running as a user
+			lastErr = err
+			continue
+		}
+		lock := &InstanceLock{path: path, file: file}
+		if err := lock.writePID(); err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+		return lock, nil
+	}
+	return nil, lastErr
+}
+
+// The error of Lock for a pid file another instance holds, naming it
+func alreadyRunning(path string) error {
+	if pid := readPID(path); pid > 0 {
+		return fmt.Errorf("%w: pid %d holds %s", ErrAlreadyRunning, pid, path)
+	}
+	return fmt.Errorf("%w: %s is locked", ErrAlreadyRunning, path)
+}
+
+// Write the pid of the process to the locked file
+func (lock *InstanceLock) writePID() error {
+	if err := lock.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := lock.file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	return err
+}
+
+// Path returns the pid file the lock is held on
+func (lock *InstanceLock) Path() string {
+	return lock.path
+}
+
+// Unlock removes the pid file and releases the lock
+func (lock *InstanceLock) Unlock() error {
+	// removed first, the next instance must not lock a file on its way out
+	err := os.Remove(lock.path)
+	if closeErr := lock.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// The pid in a pid file, 0 when there is none
+func readPID(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
+// The instance holding the lock on a pid file of the service, 0 when none
+// does, and the time it took the lock. The pid is only trusted while the
+// file is locked: one left behind by a crash may name a reused pid. stale
+// tells such a file was found.
+func (service *Service) lockHolder() (pid int, info os.FileInfo, stale bool) {
+	for _, path := range service.pidFiles() {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if !lockHeld(path) {
+			stale = true
+			continue
+		}
+		if pid := readPID(path); pid > 0 {
+			info, _ := os.Stat(path)
+			return pid, info, false
+		}
+	}
+	return 0, nil, stale
+}
+
+// Complete the status of the init system with the pid file when it could
+// not report a pid, returns whether it did. A service the init system
+// cannot tell about is stopped when its pid file is not locked.
+func (service *Service) addLockHolder(status *ServiceStatus) bool {
+	if status.PID != 0 || (status.State != StateRunning && status.State != StateUnknown) {
+		return false
+	}
+	pid, info, stale := service.lockHolder()
+	if pid == 0 {
+		if stale && status.State == StateUnknown {
+			status.State = StateStopped
+			return true
+		}
+		return false
+	}
+	status.State, status.PID = StateRunning, pid
+	if status.StartedAt.IsZero() && info != nil {
+		status.StartedAt = info.ModTime()
+	}
+	return true
+}
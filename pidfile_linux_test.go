@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Run fn as an unprivileged user, the effective uid only so root comes back
+func asNobody(t *testing.T, fn func()) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		fn()
+		return
+	}
+	if err := syscall.Setresuid(-1, 65534, 0); err != nil {
+		t.Skipf("cannot switch users: %v", err)
+	}
+	defer func() {
+		if err := syscall.Setresuid(-1, 0, -1); err != nil {
+			t.Fatalf("back to root: %v", err)
+		}
+	}()
+	fn()
+}
+
+func TestLockReadOnlyHeld(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the pid file of another user's instance needs root to set up")
+	}
+	dir := t.TempDir()
+	runtime := t.TempDir()
+	for _, d := range []string{filepath.Dir(dir), dir} {
+		os.Chmod(d, 0755)
+	}
+	os.Chmod(runtime, 0777)
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	path := filepath.Join(dir, "app.pid")
+	service := &Service{Daemon: pidDaemon{path: path}, name: "app"}
+
+	// a root instance holds the pid file, others may only read it
+	held, err := service.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	asNobody(t, func() {
+		lock, err := service.Lock()
+		if err == nil {
+			lock.Unlock()
+		}
+		if !errors.Is(err, ErrAlreadyRunning) || !strings.Contains(err.Error(), path) {
+			t.Errorf("got %v, want ErrAlreadyRunning for %s", err, path)
+		}
+	})
+
+	// left behind unlocked, it still may not be taken over elsewhere
+	held.file.Close()
+	asNobody(t, func() {
+		if lock, err := service.Lock(); err == nil || errors.Is(err, ErrAlreadyRunning) {
+			if lock != nil {
+				lock.Unlock()
+			}
+			t.Errorf("a stale pid file of root: got %v, want a permission error", err)
+		}
+	})
+
+	// missing, the runtime directory is used
+	os.Remove(path)
+	asNobody(t, func() {
+		lock, err := service.Lock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lock.Unlock()
+		if lock.Path() != filepath.Join(runtime, "app.pid") {
+			t.Errorf("got %s, want the runtime directory", lock.Path())
+		}
+	})
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"os"
+)
+
+// Where pid files are kept, the temporary directory here
+const defaultRunDir = ""
+
+// Pid files are never locked here
+func lockHeld(path string) bool {
+	return false
+}
+
+// Pid files cannot be locked here
+func lockFile(path string) (*os.File, error) {
+	return nil, ErrUnsupportedSystem
+}
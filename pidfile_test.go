@@ -0,0 +1,125 @@
+//go:build unix
+
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	takama "github.com/zdypro888/daemon/internal/daemon"
+)
+
+// pidDaemon has a pid file of its own and an init system that cannot tell
+// the pid of the service
+type pidDaemon struct {
+	testDaemon
+	path  string
+	state State
+}
+
+func (daemon pidDaemon) PIDFile() string {
+	return daemon.path
+}
+
+func (daemon pidDaemon) Query() (*takama.ServiceStatus, error) {
+	return &takama.ServiceStatus{State: daemon.state}, nil
+}
+
+func (daemon pidDaemon) Status() (string, error) {
+	return "Service status is unknown", nil
+}
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.pid")
+	service := &Service{Daemon: pidDaemon{path: path}, name: "app"}
+	if service.PIDFile() != path {
+		t.Errorf("pid file: got %s, want %s", service.PIDFile(), path)
+	}
+
+	lock, err := service.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); lock.Path() != path || string(data) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("unexpected pid file %s: %q", lock.Path(), data)
+	}
+
+	// flock locks belong to the open file, a second one conflicts
+	_, err = service.Lock()
+	if !errors.Is(err, ErrAlreadyRunning) || !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("second lock: got %v, want ErrAlreadyRunning naming the holder", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("pid file left after unlock: %v", err)
+	}
+	lock, err = service.Lock()
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestLockFallback(t *testing.T) {
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	service := &Service{Daemon: pidDaemon{path: "/nonexistent/app.pid"}, name: "app"}
+	lock, err := service.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	if lock.Path() != filepath.Join(runtime, "app.pid") {
+		t.Errorf("got %s, want the runtime directory", lock.Path())
+	}
+}
+
+func TestStatusFromLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.pid")
+	service := &Service{Daemon: pidDaemon{path: path, state: StateUnknown}, name: "app"}
+	if status, _ := service.Query(); status.State != StateUnknown || status.PID != 0 {
+		t.Errorf("unlocked: unexpected status %+v", status)
+	}
+
+	lock, err := service.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	status, err := service.Query()
+	if err != nil || status.State != StateRunning || status.PID != os.Getpid() || status.StartedAt.IsZero() {
+		t.Errorf("locked: unexpected status %+v, %v", status, err)
+	}
+	if text, _ := service.Status(); !strings.Contains(text, strconv.Itoa(os.Getpid())) {
+		t.Errorf("status does not name the pid: %q", text)
+	}
+
+	// a stopped service is not made running by a stale file
+	service.Daemon = pidDaemon{path: path, state: StateStopped}
+	if status, _ := service.Query(); status.State != StateStopped || status.PID != 0 {
+		t.Errorf("stopped: unexpected status %+v", status)
+	}
+}
+
+func TestStatusFromStaleLock(t *testing.T) {
+	// left by a crash, naming a live process that does not hold the lock
+	path := filepath.Join(t.TempDir(), "app.pid")
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	service := &Service{Daemon: pidDaemon{path: path, state: StateUnknown}, name: "app"}
+	if status, _ := service.Query(); status.State != StateStopped || status.PID != 0 {
+		t.Errorf("unknown: unexpected status %+v", status)
+	}
+	service.Daemon = pidDaemon{path: path, state: StateRunning}
+	if status, _ := service.Query(); status.State != StateRunning || status.PID != 0 {
+		t.Errorf("running: unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,54 @@
+//go:build unix
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// Where pid files are kept
+const defaultRunDir = "/var/run"
+
+// Whether a process holds the lock on a pid file, found by trying to take
+// it: a file that cannot be read is not trusted either
+func lockHeld(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		// released with the file
+		return false
+	}
+	return err == syscall.EWOULDBLOCK
+}
+
+// Open and lock a pid file without waiting. A file removed by the holder
+// while it was being locked is opened again.
+func lockFile(path string) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			file.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, errLocked
+			}
+			return nil, err
+		}
+		opened, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(opened, current) {
+			return file, nil
+		}
+		file.Close()
+	}
+}
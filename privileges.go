@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// credentials - the user and groups the process switches to
+type credentials struct {
+	uid, gid int
+	groups   []int
+}
+
+// Look up the user and group to switch to, the primary group of the user
+// when group is empty. The supplementary groups are those of the user.
+func lookupCredentials(userName, groupName string) (*credentials, error) {
+	if userName == "" {
+		return nil, errors.New("no user to switch to")
+	}
+	account, err := user.Lookup(userName)
+	if err != nil {
+		return nil, err
+	}
+	creds := &credentials{}
+	if creds.uid, err = strconv.Atoi(account.Uid); err != nil {
+		return nil, fmt.Errorf("user %s: uid %q is not a number", userName, account.Uid)
+	}
+	gid := account.Gid
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, err
+		}
+		gid = group.Gid
+	}
+	if creds.gid, err = strconv.Atoi(gid); err != nil {
+		return nil, fmt.Errorf("group of %s: gid %q is not a number", userName, gid)
+	}
+	ids, err := account.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("groups of %s: %w", userName, err)
+	}
+	creds.groups = []int{creds.gid}
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil && n != creds.gid {
+			creds.groups = append(creds.groups, n)
+		}
+	}
+	return creds, nil
+}
+
+// Give the files under path to the user, a missing path is skipped
+func chownTree(path string, uid, gid int) error {
+	err := filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(name, uid, gid)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Switch the process to the user and group for good, once the files it
+// writes to are theirs
+func dropPrivileges(userName, groupName string, paths []string) error {
+	if !switchUsers {
+		// before anything is looked up or chowned
+		return ErrUnsupportedSystem
+	}
+	creds, err := lookupCredentials(userName, groupName)
+	if err != nil {
+		return err
+	}
+	if creds.current() {
+		// started as the user already, e.g. by User= of the unit
+		return nil
+	}
+	for _, path := range paths {
+		if err := chownTree(path, creds.uid, creds.gid); err != nil {
+			return err
+		}
+	}
+	return setCredentials(creds)
+}
+
+// DropPrivileges switches the process to user and group, the primary
+// group of the user when group is empty, with the supplementary groups of
+// the user. Call it once the privileged ports are bound. The directories
+// the process writes to (CertsDir of the Engine, TUS uploads, the
+// RedirectLog file) are given to the user first. An error means the
+// process still runs with the privileges it had, do not go on serving:
+//
+//	ln, err := net.Listen("tcp", ":443")
+//	...
+//	if err := service.DropPrivileges("app", ""); err != nil {
+//	    log.Fatal(err)
+//	}
+//
+// A process already running as the user has nothing to drop. Unix only,
+// ErrUnsupportedSystem elsewhere. EngineOptions.User does this for the
+// listeners of the Engine.
+func (service *Service) DropPrivileges(user, group string) error {
+	paths := service.writableDirs()
+	if service.logFile != "" {
+		paths = append(paths, service.logFile)
+	}
+	return dropPrivileges(user, group, paths)
+}
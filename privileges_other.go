@@ -0,0 +1,16 @@
+//go:build !unix
+
+package daemon
+
+// The process cannot switch users here
+const switchUsers = false
+
+// Whether the process runs as the user and group already, it cannot tell here
+func (creds *credentials) current() bool {
+	return false
+}
+
+// The process cannot switch users here
+func setCredentials(creds *credentials) error {
+	return ErrUnsupportedSystem
+}
@@ -0,0 +1,171 @@
+//go:build unix
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLookupCredentials(t *testing.T) {
+	creds, err := lookupCredentials("root", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.uid != 0 || creds.gid != 0 || len(creds.groups) == 0 || creds.groups[0] != 0 {
+		t.Errorf("root = %+v", creds)
+	}
+	if _, err := lookupCredentials("", "root"); err == nil {
+		t.Error("no user: no error")
+	}
+	if _, err := lookupCredentials("no-such-user-here", ""); err == nil {
+		t.Error("unknown user: no error")
+	}
+	if _, err := lookupCredentials("root", "no-such-group-here"); err == nil {
+		t.Error("unknown group: no error")
+	}
+}
+
+func TestChownTree(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a", "b", "cert.pem"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := chownTree(dir, os.Getuid(), os.Getgid()); err != nil {
+		t.Error(err)
+	}
+	if err := chownTree(filepath.Join(dir, "missing"), os.Getuid(), os.Getgid()); err != nil {
+		t.Errorf("missing path: %v", err)
+	}
+}
+
+// The child of TestDropPrivileges: the test binary started again as root
+// with DROP_PRIVILEGES_CHILD set to the directory to hand over
+func TestDropPrivilegesChild(t *testing.T) {
+	dir := os.Getenv("DROP_PRIVILEGES_CHILD")
+	if dir == "" {
+		t.Skip("run as the child of TestDropPrivileges")
+	}
+	if err := dropPrivileges("nobody", "", []string{dir}); err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("uid=%d gid=%d\n", os.Getuid(), os.Getgid())
+	os.Exit(0)
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	creds, err := lookupCredentials("nobody", "")
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "upload"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesChild$")
+	cmd.Env = append(os.Environ(), "DROP_PRIVILEGES_CHILD="+dir)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	if want := fmt.Sprintf("uid=%d gid=%d", creds.uid, creds.gid); !strings.Contains(string(output), want) {
+		t.Errorf("child printed %q, want %s", output, want)
+	}
+	info, err := os.Stat(filepath.Join(dir, "upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat := info.Sys().(*syscall.Stat_t); int(stat.Uid) != creds.uid {
+		t.Errorf("upload owned by %d, want %d", stat.Uid, creds.uid)
+	}
+}
+
+func TestEngineDropFailsClosed(t *testing.T) {
+	failed := make(chan error, 1)
+	saved := privilegeDropFailed
+	privilegeDropFailed = func(user string, err error) { failed <- err }
+	defer func() { privilegeDropFailed = saved }()
+
+	// a group without a user cannot be switched to
+	engine := NewEngineWithOptions(EngineOptions{Group: "root", DisableNotify: true})
+	engine.Start("127.0.0.1:0")
+	defer engine.Shutdown()
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Error("nil error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the drop did not fail")
+	}
+	select {
+	case <-engine.dropped:
+		t.Error("listeners released after a failed drop")
+	default:
+	}
+}
+
+// flakyListener fails its first Accept like a listener that broke
+type flakyListener struct {
+	net.Listener
+	failed atomic.Bool
+}
+
+func (ln *flakyListener) Accept() (net.Conn, error) {
+	if !ln.failed.Swap(true) {
+		return nil, errors.New("accept failed")
+	}
+	return ln.Listener.Accept()
+}
+
+func TestListenerKeptAfterDrop(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewEngineWithOptions(EngineOptions{DisableNotify: true})
+	// dropped already: the port could not be bound again
+	engine.dropped = make(chan struct{})
+	close(engine.dropped)
+	engine.httpsrv = &http.Server{Addr: "127.0.0.1:1", Handler: engine}
+	done := make(chan struct{})
+	go func() {
+		engine.listenLoop(engine.httpsrv, false, &flakyListener{Listener: ln}, nil)
+		close(done)
+	}()
+
+	// served on the same listener after the retry
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	engine.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listenLoop did not return after Shutdown")
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Error("listener still open after Shutdown")
+	}
+}
@@ -0,0 +1,39 @@
+//go:build unix
+
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// The process can switch users here
+const switchUsers = true
+
+// Whether the process runs as the user and group already
+func (creds *credentials) current() bool {
+	return os.Getuid() == creds.uid && os.Geteuid() == creds.uid && os.Getgid() == creds.gid && os.Getegid() == creds.gid
+}
+
+// Switch to the credentials: the groups first, setuid takes the right to
+// change them away. On Linux the calls apply to every thread of the process.
+func setCredentials(creds *credentials) error {
+	if err := syscall.Setgroups(creds.groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(creds.gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", creds.gid, err)
+	}
+	if err := syscall.Setuid(creds.uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", creds.uid, err)
+	}
+	if !creds.current() {
+		return fmt.Errorf("still running as uid %d gid %d", os.Geteuid(), os.Getegid())
+	}
+	if creds.uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("root privileges can be regained")
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// DefaultStopTimeout is how long Service.Run waits for the app to stop when
+// Service.StopTimeout is not set
+const DefaultStopTimeout = 30 * time.Second
+
+// App is a program run by Service.Run
+type App interface {
+	// Run serves until ctx is cancelled and returns once it stopped. A
+	// non-nil error other than ctx.Err() means the app failed.
+	Run(ctx context.Context) error
+}
+
+// Stopper is implemented by apps which need an explicit call to stop, e.g.
+// to drain connections. Stop is called once the Run context is cancelled,
+// with a context that expires at the stop timeout.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// AppFunc adapts a function to App
+type AppFunc func(ctx context.Context) error
+
+// Run calls f(ctx)
+func (f AppFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+// ExitReason is why Service.Run returned
+type ExitReason string
+
+const (
+	// ExitCompleted - the app returned by itself without error
+	ExitCompleted ExitReason = "completed"
+
+	// ExitFailed - the app returned an error
+	ExitFailed ExitReason = "failed"
+
+	// ExitSignal - stopped after SIGINT / SIGTERM or a service manager stop
+	ExitSignal ExitReason = "signal"
+
+	// ExitCanceled - stopped because the context given to Run was done
+	ExitCanceled ExitReason = "canceled"
+
+	// ExitForced - a second signal arrived while the app was stopping
+	ExitForced ExitReason = "forced"
+
+	// ExitTimeout - the app did not stop within the stop timeout
+	ExitTimeout ExitReason = "timeout"
+)
+
+// Exit reports how Service.Run ended. Code is the process exit code to use:
+// 0 for a requested stop that went well, 1 otherwise, so systemd's
+// Restart=on-failure restarts the service only when it really failed.
+type Exit struct {
+	Reason ExitReason
+	Code   int
+
+	// Signal - the signal that stopped or forced the app, nil otherwise
+	Signal os.Signal
+
+	// Err - the error of the app, its Stop or the service manager
+	Err error
+}
+
+// String - one line description of the exit
+func (exit *Exit) String() string {
+	text := string(exit.Reason)
+	if exit.Signal != nil {
+		text += " (" + exit.Signal.String() + ")"
+	}
+	if exit.Err != nil {
+		text += ": " + exit.Err.Error()
+	}
+	return fmt.Sprintf("%s, exit code %d", text, exit.Code)
+}
+
+// Error - the description of the exit, an Exit with a non-zero Code is the
+// error of the Console commands running the app or its child
+func (exit *Exit) Error() string {
+	return exit.String()
+}
+
+// Run starts app and manages its lifecycle: SIGINT / SIGTERM (or a stop
+// from the Windows service manager) cancel the context of the app and call
+// its Stop; a second signal or StopTimeout elapsing abandon it. Run returns
+// the reason, pass its Code to os.Exit:
+//
+//	os.Exit(service.Run(context.Background(), app).Code)
+//
+// Returning after a forced exit leaves the app goroutines running, exiting
+// the process is what ends them.
+func (service *Service) Run(ctx context.Context, app App) *Exit {
+	runner := &appRunner{
+		ctx:      ctx,
+		app:      app,
+		timeout:  service.StopTimeout,
+		notifier: defaultNotifier(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if runner.timeout <= 0 {
+		runner.timeout = DefaultStopTimeout
+	}
+	// the backend decides how the app is driven: directly, or by the
+	// Windows service control manager through Start and Stop
+	if err := service.Daemon.Run(runner); err != nil {
+		select {
+		case <-runner.done:
+		default:
+			return &Exit{Reason: ExitFailed, Code: 1, Err: err}
+		}
+	}
+	select {
+	case <-runner.done:
+	default:
+		// the service manager returned without stopping the app
+		runner.Stop()
+	}
+	return runner.exit
+}
+
+// appRunner adapts an App to the Executable driven by Daemon.Run
+type appRunner struct {
+	ctx      context.Context
+	app      App
+	timeout  time.Duration
+	notifier *Notifier
+
+	stop chan struct{}
+	done chan struct{}
+	exit *Exit
+}
+
+// Start runs the app in the background, for the service manager
+func (runner *appRunner) Start() {
+	go runner.Run()
+}
+
+// Stop asks the app to stop as a signal would and waits for it
+func (runner *appRunner) Stop() {
+	select {
+	case runner.stop <- struct{}{}:
+	case <-runner.done:
+	}
+	<-runner.done
+}
+
+// Run runs the app until it returns or is stopped
+func (runner *appRunner) Run() {
+	exit := &Exit{}
+	defer func() {
+		runner.exit = exit
+		close(runner.done)
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	ctx, cancel := context.WithCancel(runner.ctx)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- runner.app.Run(ctx)
+	}()
+
+	select {
+	case err := <-result:
+		exit.Reason, exit.Err = ExitCompleted, err
+		if err != nil {
+			exit.Reason, exit.Code = ExitFailed, 1
+		}
+		return
+	case sig := <-signals:
+		exit.Reason, exit.Signal = ExitSignal, sig
+	case <-runner.stop:
+		exit.Reason = ExitSignal
+	case <-runner.ctx.Done():
+		exit.Reason = ExitCanceled
+	}
+
+	runner.notifier.Stopping()
+	cancel()
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), runner.timeout)
+	defer stopCancel()
+	stopped := make(chan error, 1)
+	if stopper, ok := runner.app.(Stopper); ok {
+		go func() {
+			stopped <- stopper.Stop(stopCtx)
+		}()
+	} else {
+		stopped <- nil
+	}
+
+	// wait for both Run and Stop to return
+	var errs []error
+	for pending := 2; pending > 0; pending-- {
+		select {
+		case err := <-result:
+			if err != nil && !errors.Is(err, context.Canceled) {
+				errs = append(errs, err)
+			}
+			result = nil
+		case err := <-stopped:
+			if err != nil {
+				errs = append(errs, fmt.Errorf("stop: %w", err))
+			}
+			stopped = nil
+		case sig := <-signals:
+			exit.Reason, exit.Signal, exit.Code = ExitForced, sig, 1
+			return
+		case <-stopCtx.Done():
+			exit.Reason, exit.Code = ExitTimeout, 1
+			exit.Err = fmt.Errorf("app did not stop within %v", runner.timeout)
+			return
+		}
+	}
+	if exit.Err = errors.Join(errs...); exit.Err != nil {
+		exit.Code = 1
+	}
+}
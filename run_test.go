@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	takama "github.com/zdypro888/daemon/internal/daemon"
+)
+
+// testDaemon drives the app the way the unix backends do
+type testDaemon struct {
+	takama.Daemon
+}
+
+func (testDaemon) Run(e takama.Executable) error {
+	e.Run()
+	return nil
+}
+
+// stopApp serves until cancelled and records its Stop call
+type stopApp struct {
+	stopped chan struct{}
+	stopErr error
+	block   bool
+}
+
+func (app *stopApp) Run(ctx context.Context) error {
+	<-ctx.Done()
+	if app.block {
+		select {}
+	}
+	return ctx.Err()
+}
+
+func (app *stopApp) Stop(ctx context.Context) error {
+	close(app.stopped)
+	return app.stopErr
+}
+
+func testService() *Service {
+	return &Service{Daemon: testDaemon{}, StopTimeout: time.Second}
+}
+
+// Send a signal to the test process once Run is waiting for it
+func sendSignal(t *testing.T, sig os.Signal, delay time.Duration) {
+	t.Helper()
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(delay, func() { process.Signal(sig) })
+}
+
+func TestRunCompletes(t *testing.T) {
+	exit := testService().Run(context.Background(), AppFunc(func(ctx context.Context) error { return nil }))
+	if exit.Reason != ExitCompleted || exit.Code != 0 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+	failure := errors.New("database gone")
+	exit = testService().Run(context.Background(), AppFunc(func(ctx context.Context) error { return failure }))
+	if exit.Reason != ExitFailed || exit.Code != 1 || !errors.Is(exit.Err, failure) {
+		t.Errorf("unexpected exit %v", exit)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	app := &stopApp{stopped: make(chan struct{})}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	exit := testService().Run(ctx, app)
+	if exit.Reason != ExitCanceled || exit.Code != 0 || exit.Err != nil {
+		t.Errorf("unexpected exit %v", exit)
+	}
+	select {
+	case <-app.stopped:
+	default:
+		t.Error("Stop not called")
+	}
+
+	// a failing Stop is a failure
+	ctx, cancel = context.WithCancel(context.Background())
+	app = &stopApp{stopped: make(chan struct{}), stopErr: errors.New("flush failed")}
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if exit := testService().Run(ctx, app); exit.Code != 1 || !errors.Is(exit.Err, app.stopErr) {
+		t.Errorf("unexpected exit %v", exit)
+	}
+}
+
+func TestRunSignals(t *testing.T) {
+	app := &stopApp{stopped: make(chan struct{})}
+	sendSignal(t, syscall.SIGTERM, 10*time.Millisecond)
+	exit := testService().Run(context.Background(), app)
+	if exit.Reason != ExitSignal || exit.Signal != syscall.SIGTERM || exit.Code != 0 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+
+	// an app that hangs while stopping is abandoned on the second signal
+	app = &stopApp{stopped: make(chan struct{}), block: true}
+	sendSignal(t, syscall.SIGTERM, 10*time.Millisecond)
+	sendSignal(t, os.Interrupt, 100*time.Millisecond)
+	exit = testService().Run(context.Background(), app)
+	if exit.Reason != ExitForced || exit.Signal != os.Interrupt || exit.Code != 1 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+}
+
+func TestOnReload(t *testing.T) {
+	service := testService()
+	first, second := make(chan struct{}, 1), make(chan struct{}, 1)
+	service.OnReload(func() { first <- struct{}{} })
+	stop := service.OnReload(func() { second <- struct{}{} })
+	sendSignal(t, syscall.SIGHUP, 0)
+	select {
+	case <-second:
+	case <-time.After(time.Second):
+		t.Fatal("reload callback not called")
+	}
+	select {
+	case <-first:
+		t.Error("replaced callback called")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// SIGHUP would end the test process without a handler
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	stop()
+	stop()
+	sendSignal(t, syscall.SIGHUP, 0)
+	<-hangup
+	select {
+	case <-second:
+		t.Error("callback called after stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRunStopTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	service := testService()
+	service.StopTimeout = 20 * time.Millisecond
+	time.AfterFunc(10*time.Millisecond, cancel)
+	exit := service.Run(ctx, &stopApp{stopped: make(chan struct{}), block: true})
+	if exit.Reason != ExitTimeout || exit.Code != 1 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+}
+
+func TestRunServiceManagerStop(t *testing.T) {
+	// as the Windows service control manager drives it
+	runner := &appRunner{ctx: context.Background(), app: &stopApp{stopped: make(chan struct{})}, timeout: time.Second, stop: make(chan struct{}), done: make(chan struct{})}
+	runner.Start()
+	runner.Stop()
+	if runner.exit.Reason != ExitSignal || runner.exit.Code != 0 {
+		t.Errorf("unexpected exit %v", runner.exit)
+	}
+}
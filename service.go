@@ -1,14 +1,19 @@
 package daemon
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/zdypro888/crash"
 	takama "github.com/zdypro888/daemon/internal/daemon"
@@ -16,74 +21,644 @@ import (
 
 var ErrNoCommand = errors.New("no command specified")
 
+// ErrUnsupportedSystem appears if the feature is not available for the init system in use
+var ErrUnsupportedSystem = takama.ErrUnsupportedSystem
+
+// ErrInvalidOptions appears if the install options cannot be rendered
+var ErrInvalidOptions = takama.ErrInvalidOptions
+
+// OptionError is the ErrInvalidOptions naming the install option at fault,
+// returned by InstallOptions.Validate
+type OptionError = takama.OptionError
+
+// ErrCronJob appears if a job installed as a cron file is started or stopped
+var ErrCronJob = takama.ErrCronJob
+
+// ErrRootPrivileges appears if the command needs root and the process is not
+var ErrRootPrivileges = takama.ErrRootPrivileges
+
+// ErrAlreadyInstalled appears if install finds the service installed
+var ErrAlreadyInstalled = takama.ErrAlreadyInstalled
+
+// ErrNotInstalled appears if the service to act on is not installed
+var ErrNotInstalled = takama.ErrNotInstalled
+
+// ErrAlreadyStopped appears if stop or reload finds the service stopped
+var ErrAlreadyStopped = takama.ErrAlreadyStopped
+
+// Backends are the linux init systems Config.Backend and the --backend
+// flag of Console may name
+var Backends = takama.Backends
+
+// Plan is everything an install would write and run, see Service.Render
+type Plan = takama.Plan
+
+// Action is one step of a Plan
+type Action = takama.Action
+
+// StepError is returned by a failed install or remove on Linux: the step
+// that failed, what was rolled back and what could not be
+type StepError = takama.StepError
+
+// LogOptions selects the part of the service output Logs prints
+type LogOptions = takama.LogOptions
+
+// ServiceStatus is the structured status returned by Service.Query
+type ServiceStatus = takama.ServiceStatus
+
+// InstallOptions describes the user, environment, limits and restart policy
+// of the installed service
+type InstallOptions = takama.InstallOptions
+
+// State is the lifecycle state of a service
+type State = takama.State
+
+// Service states reported in ServiceStatus.State
+const (
+	StateUnknown      = takama.StateUnknown
+	StateNotInstalled = takama.StateNotInstalled
+	StateStopped      = takama.StateStopped
+	StateStarting     = takama.StateStarting
+	StateRunning      = takama.StateRunning
+	StateStopping     = takama.StateStopping
+	StateFailed       = takama.StateFailed
+)
+
 // Service represents a service
 type Service struct {
 	takama.Daemon
+
+	// StopTimeout is how long Run waits for the app to stop before it
+	// gives up on it, DefaultStopTimeout when zero
+	StopTimeout time.Duration
+
+	// name of the unit, as normalized by the init system backend
+	name string
+
+	// config the service was created with, for Instance
+	config Config
+
+	// manifest options the install command starts from, see NewServiceFromManifest
+	manifest *InstallOptions
+
+	// logFile set by RedirectLog, read by the logs command
+	logFile string
+
+	// writePaths declared with WritablePaths
+	writePaths []string
+
+	// statusFile of Supervise set with StatusFile
+	statusFile string
+
+	// jsonOutput - Console runs with --output json, errors go into the Report
+	jsonOutput bool
+
+	// stopReload unregisters the callback of OnReload
+	stopReload func()
 }
 
+// Config is the full set of parameters of a service
+type Config = takama.Config
+
+// Kind is the type of the service
+type Kind = takama.Kind
+
+// Service kinds, see the internal/daemon documentation for the platforms
+// each one is valid for
+const (
+	UserAgent    = takama.UserAgent
+	GlobalAgent  = takama.GlobalAgent
+	GlobalDaemon = takama.GlobalDaemon
+	SystemDaemon = takama.SystemDaemon
+	UserDaemon   = takama.UserDaemon
+)
+
 // NewService create a new service
 func NewService(name, description string, dependencies ...string) (*Service, error) {
-	var kind takama.Kind
-	switch runtime.GOOS {
-	case "darwin":
-		kind = takama.UserAgent
-	default:
-		kind = takama.SystemDaemon
+	return NewServiceWithConfig(Config{
+		Name:         name,
+		Description:  description,
+		Dependencies: dependencies,
+	})
+}
+
+// NewUserService create a new per-user service, a launchd user agent on
+// macOS and a systemd user unit (systemctl --user) on Linux
+func NewUserService(name, description string, dependencies ...string) (*Service, error) {
+	kind := UserDaemon
+	if runtime.GOOS == "darwin" {
+		kind = UserAgent
 	}
-	td, err := takama.New(name, description, kind, dependencies...)
+	return NewServiceWithConfig(Config{
+		Name:         name,
+		Description:  description,
+		Kind:         kind,
+		Dependencies: dependencies,
+	})
+}
+
+// NewServiceWithConfig create a new service from a full config, an empty
+// Kind selects the platform default
+func NewServiceWithConfig(config Config) (*Service, error) {
+	if config.Kind == "" {
+		switch runtime.GOOS {
+		case "darwin":
+			config.Kind = UserAgent
+		default:
+			config.Kind = SystemDaemon
+		}
+	}
+	td, err := takama.NewWithConfig(config)
 	if err != nil {
 		return nil, err
 	}
+	name := strings.Join(strings.Fields(config.Name), "_")
+	if config.Instance != "" {
+		name += "@" + config.Instance
+	}
 	return &Service{
 		Daemon: td,
+		name:   name,
+		config: config,
 	}, nil
 }
 
+// Instance returns the service for one instance of this one, installed as a
+// systemd template unit (name@.service, started as name@instance.service) or
+// as a script of its own (name@instance) on SysV and upstart. Install
+// arguments may use %i for the instance name, e.g. --config /etc/app/%i.yaml.
+func (service *Service) Instance(instance string) (*Service, error) {
+	config := service.config
+	config.Instance = instance
+	return service.derive(config)
+}
+
+// A service like this one with another config
+func (service *Service) derive(config Config) (*Service, error) {
+	target, err := NewServiceWithConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	target.StopTimeout = service.StopTimeout
+	target.logFile = service.logFile
+	target.writePaths = service.writePaths
+	target.statusFile = service.statusFile
+	target.manifest = service.manifest
+	target.jsonOutput = service.jsonOutput
+	return target, nil
+}
+
+// Query returns the structured status of the service: the state of the
+// child while Supervise runs it, the state known to the init system
+// otherwise, with the pid of the instance holding the lock when the init
+// system cannot tell it, see Lock
+func (service *Service) Query() (*ServiceStatus, error) {
+	if status := service.supervisedStatus(); status != nil {
+		return status, nil
+	}
+	status, err := service.Daemon.Query()
+	if err == nil {
+		service.addLockHolder(status)
+	}
+	return status, err
+}
+
+// Status returns the status of the service as text, see Query
+func (service *Service) Status() (string, error) {
+	if status := service.supervisedStatus(); status != nil {
+		return status.String(), nil
+	}
+	if status, err := service.Daemon.Query(); err == nil && service.addLockHolder(status) {
+		return status.String(), nil
+	}
+	return service.Daemon.Status()
+}
+
 // Usage print usage information
 func (service *Service) Usage() {
-	fmt.Println("Usage: command <install|remove|start|stop|status> [flags]")
+	fmt.Println("Usage: command <install|remove|start|stop|restart|reload|status|logs|env|supervise> [--instance NAME] [--backend NAME] [--output text|json] [flags]")
 }
 
-// Console parse command line arguments and execute an action
+// Console parse command line arguments and execute an action. Every command
+// takes --instance NAME to act on one instance of the service, see Instance,
+// --backend NAME to use another init system than the detected one, see
+// Config.Backend, and --output json to print a single Report instead of
+// text. The status command returns a *StatusError when the service is not
+// running; ExitCode gives the process exit code for any error.
 func (service *Service) Console() error {
-	if len(os.Args) < 2 {
-		return ErrNoCommand
+	format, args, err := takeFlag(os.Args[1:], "output")
+	if err != nil {
+		return err
 	}
-	command := os.Args[1]
+	var command string
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch format {
+	case "", "text":
+		if command == "" {
+			return ErrNoCommand
+		}
+		target, flags, err := service.selectTarget(args)
+		if err != nil {
+			return err
+		}
+		return target.console(os.Stdout, command, flags)
+	case "json":
+		return service.consoleJSON(os.Stdout, command, args)
+	}
+	return fmt.Errorf("%w: --output %s, use text or json", ErrUsage, format)
+}
+
+// The service --backend and --instance select, with the rest of the flags
+func (service *Service) selectTarget(flags []string) (*Service, []string, error) {
+	backend, flags, err := takeFlag(flags, "backend")
+	if err != nil {
+		return nil, nil, err
+	}
+	if backend != "" {
+		config := service.config
+		config.Backend = backend
+		if service, err = service.derive(config); err != nil {
+			return nil, nil, err
+		}
+	}
+	instance, flags, err := takeFlag(flags, "instance")
+	if err != nil {
+		return nil, nil, err
+	}
+	if instance != "" {
+		target, err := service.Instance(instance)
+		return target, flags, err
+	}
+	return service, flags, nil
+}
+
+// Run one command of Console, printing to w
+func (service *Service) console(w io.Writer, command string, flags []string) error {
 	var err error
 	switch command {
 	case "install":
-		installCmd := flag.NewFlagSet("install", flag.ExitOnError)
+		// the manifest gives the defaults, flags override them
+		var path string
+		if path, flags, err = takeFlag(flags, "manifest"); err != nil {
+			break
+		}
+		if path != "" {
+			var manifest *Manifest
+			if manifest, err = LoadManifest(path); err != nil {
+				break
+			}
+			if service, err = service.withManifest(manifest); err != nil {
+				break
+			}
+		}
+		var opts InstallOptions
+		if service.manifest != nil {
+			opts = *service.manifest
+			opts.Environment = slices.Clone(opts.Environment)
+			opts.Sockets = slices.Clone(opts.Sockets)
+			opts.HardeningOverrides = slices.Clone(opts.HardeningOverrides)
+			opts.ReadWritePaths = slices.Clone(opts.ReadWritePaths)
+		}
+		var env, sockets, overrides, readWrite listFlag
+		installCmd := service.flagSet("install")
+		installCmd.String("manifest", "", "Install the service described by a YAML or TOML manifest")
 		args := installCmd.String("args", "", "Arguments for the service")
-		_ = installCmd.Parse(os.Args[2:])
-		err = service.Install(strings.Fields(*args)...)
+		installCmd.StringVar(&opts.User, "user", opts.User, "Run the service as this user")
+		installCmd.StringVar(&opts.Group, "group", opts.Group, "Run the service with this group")
+		installCmd.StringVar(&opts.WorkingDirectory, "workdir", opts.WorkingDirectory, "Working directory of the service")
+		installCmd.Var(&env, "env", "Environment variable KEY=VAL, may be repeated")
+		installCmd.StringVar(&opts.Restart, "restart", opts.Restart, "Restart policy: no, always, on-failure, ...")
+		installCmd.DurationVar(&opts.RestartSec, "restart-sec", opts.RestartSec, "Delay before the service is restarted")
+		installCmd.DurationVar(&opts.TimeoutStopSec, "timeout-stop", opts.TimeoutStopSec, "How long to wait for the service to stop")
+		installCmd.IntVar(&opts.LimitNOFILE, "limit-nofile", opts.LimitNOFILE, "Maximum number of open files")
+		installCmd.BoolVar(&opts.Linger, "linger", opts.Linger, "Start a user service at boot without a login session")
+		installCmd.Var(&sockets, "socket", "Socket activation NAME=LISTEN (http=80, https=443, redirect=80), may be repeated")
+		installCmd.BoolVar(&opts.Notify, "notify", opts.Notify, "The service reports readiness over sd_notify (Type=notify)")
+		installCmd.DurationVar(&opts.WatchdogSec, "watchdog", opts.WatchdogSec, "Restart the service when it stops pinging the watchdog, needs --notify")
+		installCmd.StringVar(&opts.OnCalendar, "on-calendar", opts.OnCalendar, "Install a scheduled job run at a calendar spec (daily, \"Mon *-*-* 02:00\")")
+		installCmd.DurationVar(&opts.OnBootSec, "on-boot", opts.OnBootSec, "Install a scheduled job run this long after boot")
+		installCmd.DurationVar(&opts.RandomizedDelaySec, "randomized-delay", opts.RandomizedDelaySec, "Delay every run of a job by a random time up to this")
+		installCmd.BoolVar(&opts.Persistent, "persistent", opts.Persistent, "Catch up on a run of a job missed while the machine was off")
+		installCmd.StringVar(&opts.Hardening, "hardening", opts.Hardening, "Sandbox the service with a systemd hardening profile: strict, network-service")
+		installCmd.Var(&overrides, "harden", "Hardening directive Directive=value over the profile, empty value removes it, may be repeated")
+		installCmd.Var(&readWrite, "read-write", "Path the hardened service may write to, may be repeated")
+		installCmd.StringVar(&opts.LogDir, "log-dir", opts.LogDir, "Directory of the runit or s6 log service, - for none")
+		dryRun := installCmd.Bool("dry-run", false, "Print what would be written and run instead of installing")
+		force := installCmd.Bool("force", false, "Upgrade the installed service in place if it differs")
+		restartAfter := installCmd.Bool("restart-after", false, "Restart the running service after --force changed it")
+		if err = parseFlags(installCmd, flags); err != nil {
+			break
+		}
+		if *args != "" {
+			opts.Args = strings.Fields(*args)
+		}
+		opts.Environment = append(opts.Environment, env...)
+		opts.Sockets = append(opts.Sockets, sockets...)
+		opts.HardeningOverrides = append(opts.HardeningOverrides, overrides...)
+		opts.ReadWritePaths = append(opts.ReadWritePaths, readWrite...)
+		if opts.Hardening != "" {
+			opts.ReadWritePaths = service.readWritePaths(opts)
+		}
+		if *force {
+			err = service.forceInstall(w, opts, service.manifest != nil || optionFlags(installCmd), *dryRun, *restartAfter)
+			break
+		}
+		if *dryRun {
+			var plan *Plan
+			if plan, err = service.RenderWithOptions(opts); err == nil {
+				fmt.Fprint(w, plan)
+			}
+			break
+		}
+		err = service.InstallWithOptions(opts)
 	case "remove":
 		err = service.Remove()
 	case "start":
 		err = service.Start()
 	case "stop":
 		err = service.Stop()
+	case "restart":
+		err = service.Restart()
+	case "reload":
+		err = service.Reload()
 	case "status":
 		var result string
 		if result, err = service.Status(); err == nil {
-			fmt.Print(result)
+			fmt.Fprint(w, result)
+		}
+		status, queryErr := service.Query()
+		if err == nil && queryErr == nil && status.UpToDate != nil && !*status.UpToDate {
+			fmt.Fprint(w, "\nInstalled service is out of date, run install --force to upgrade")
+		}
+		if err == nil {
+			err = queryErr
+		}
+		err = statusError(status, err)
+	case "env":
+		err = service.envCommand(w, flags)
+	case "supervise":
+		if service.jsonOutput {
+			// the child runs for as long as the service, there is no end to report
+			err = fmt.Errorf("%w: supervise has no JSON output", ErrUsage)
+			break
+		}
+		err = service.superviseCommand(flags)
+	case "logs":
+		var opts LogOptions
+		logsCmd := service.flagSet("logs")
+		logsCmd.BoolVar(&opts.Follow, "f", false, "Keep printing new output")
+		logsCmd.IntVar(&opts.Lines, "n", 0, "Print only the last N lines")
+		since := logsCmd.String("since", "", "Only output since a time (2006-01-02 15:04:05) or for a duration (1h)")
+		if err = parseFlags(logsCmd, flags); err != nil {
+			break
+		}
+		if opts.Since, err = parseSince(*since); err != nil {
+			break
 		}
+		if opts.Follow && service.jsonOutput {
+			err = fmt.Errorf("%w: logs -f has no JSON output, it never ends", ErrUsage)
+			break
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = service.Logs(ctx, w, opts)
 	default:
 		err = ErrNoCommand
 	}
 	return err
 }
 
+// Logs copies the service output to w: the RedirectLog file when one is
+// set, otherwise wherever the init system sends it (journald for systemd,
+// the log files of upstart, SysV and launchd). With opts.Follow it keeps
+// copying until ctx is done.
+func (service *Service) Logs(ctx context.Context, w io.Writer, opts LogOptions) error {
+	if service.logFile != "" {
+		return takama.Tail(ctx, w, opts, service.logFile)
+	}
+	reader, ok := service.Daemon.(takama.LogReader)
+	if !ok {
+		return ErrUnsupportedSystem
+	}
+	return reader.Logs(ctx, w, opts)
+}
+
+// Parse the --since flag of logs: a duration back from now or a local time
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q, want a duration (1h) or a time (2006-01-02 15:04:05)", value)
+}
+
+// Render returns the unit / init script contents and the actions Install
+// would take, without touching the system
+func (service *Service) Render(args ...string) (*Plan, error) {
+	return service.RenderWithOptions(InstallOptions{Args: args})
+}
+
+// RenderWithOptions returns what InstallWithOptions would write and run
+func (service *Service) RenderWithOptions(opts InstallOptions) (*Plan, error) {
+	renderer, ok := service.Daemon.(takama.Renderer)
+	if !ok {
+		return nil, ErrUnsupportedSystem
+	}
+	return renderer.Render(opts)
+}
+
+// Upgrade rewrites the installed unit / init script if it differs from what
+// opts render, reloads the init system and, when restart is set, restarts the
+// running service. It returns the applied diff, empty when already up to date.
+func (service *Service) Upgrade(opts InstallOptions, restart bool) (string, error) {
+	upgrader, ok := service.Daemon.(takama.Upgrader)
+	if !ok {
+		return "", ErrUnsupportedSystem
+	}
+	return upgrader.Upgrade(opts, restart)
+}
+
+// Diff returns the unified diff Upgrade would apply, without touching the system
+func (service *Service) Diff(opts InstallOptions) (string, error) {
+	upgrader, ok := service.Daemon.(takama.Upgrader)
+	if !ok {
+		return "", ErrUnsupportedSystem
+	}
+	return upgrader.Diff(opts)
+}
+
+// InstalledOptions returns the options the installed service was rendered with
+func (service *Service) InstalledOptions() (*InstallOptions, error) {
+	upgrader, ok := service.Daemon.(takama.Upgrader)
+	if !ok {
+		return nil, ErrUnsupportedSystem
+	}
+	return upgrader.InstalledOptions()
+}
+
+// Were options given on the install command line
+func optionFlags(flags *flag.FlagSet) bool {
+	given := false
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "force", "dry-run", "restart-after":
+		default:
+			given = true
+		}
+	})
+	return given
+}
+
+// install --force: upgrade in place, or install when nothing is installed yet.
+// Without options from flags or a manifest the options recorded at install
+// time are kept.
+func (service *Service) forceInstall(w io.Writer, opts InstallOptions, given, dryRun, restart bool) error {
+	if !given {
+		if installed, err := service.InstalledOptions(); err == nil {
+			opts = *installed
+		}
+	}
+	var diff string
+	var err error
+	if dryRun {
+		diff, err = service.Diff(opts)
+	} else {
+		diff, err = service.Upgrade(opts, restart)
+	}
+	if errors.Is(err, takama.ErrNotInstalled) {
+		if dryRun {
+			var plan *Plan
+			if plan, err = service.RenderWithOptions(opts); err == nil {
+				fmt.Fprint(w, plan)
+			}
+			return err
+		}
+		return service.InstallWithOptions(opts)
+	}
+	if err != nil {
+		return err
+	}
+	if diff == "" {
+		fmt.Fprintln(w, "Service is up to date")
+		return nil
+	}
+	fmt.Fprint(w, diff)
+	return nil
+}
+
+// The flags of a Console command: a bad flag or -h prints the usage and
+// exits in text mode, in JSON mode the error goes into the Report
+func (service *Service) flagSet(name string) *flag.FlagSet {
+	if !service.jsonOutput {
+		return flag.NewFlagSet(name, flag.ExitOnError)
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+// Parse the arguments of a Console command, ErrUsage when they are wrong
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrUsage, flags.Name(), err)
+	}
+	return nil
+}
+
+// Take a flag given as -name value, --name value or --name=value out of
+// the command line arguments, before the subcommand parses the rest. A flag
+// without a value is ErrUsage.
+func takeFlag(args []string, flagName string) (string, []string, error) {
+	var found string
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != flagName {
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+		if value == "" {
+			return "", nil, fmt.Errorf("%w: --%s needs a value", ErrUsage, flagName)
+		}
+		found = value
+	}
+	return found, rest, nil
+}
+
+// listFlag collects the values of a repeated command line flag
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
 // PanicFile redirect panic output to a file
 func (service *Service) PanicFile(filepath string) error {
 	return crash.InitPanicFile(filepath)
 }
 
-// RedirectLog redirect log output to a file
+// RedirectLog redirect log output to a file, the logs command then reads it
 func (service *Service) RedirectLog(filepath string) error {
+	service.logFile = filepath
 	return crash.RedirectLog(filepath)
 }
 
+// OnReload register a callback fired every time the service is asked to
+// reload its configuration (SIGHUP, sent by `reload`). It replaces the
+// callback registered before. Calling stop unregisters it, SIGHUP then has
+// its default effect again.
+func (service *Service) OnReload(callback func()) (stop func()) {
+	if service.stopReload != nil {
+		service.stopReload()
+	}
+	reload := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-reload:
+				callback()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	service.stopReload = func() {
+		once.Do(func() {
+			signal.Stop(reload)
+			close(done)
+		})
+	}
+	return service.stopReload
+}
+
+// Notifier returns the systemd notify client of the process, see Notifier.
+// Engine sends READY=1 and STOPPING=1 by itself; programs without an Engine
+// call Ready once they are able to serve.
+func (service *Service) Notifier() *Notifier {
+	return defaultNotifier()
+}
+
 // Graceful wait for a signal to notify the service to stop
 func (service *Service) Graceful() os.Signal {
 	interrupt := make(chan os.Signal, 1)
@@ -0,0 +1,424 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SuperviseOptions describes the child process run by Service.Supervise
+type SuperviseOptions struct {
+	// InstallOptions - the child as it would be installed: Executable (the
+	// running binary when empty), Args, Environment, WorkingDirectory,
+	// Restart, RestartSec (the first delay of the backoff, 1s when zero)
+	// and TimeoutStopSec (how long a stopping child gets before it is
+	// killed, StopTimeout of the service when zero). Other options are
+	// ignored.
+	InstallOptions
+
+	// MaxRestartSec - the restart delay doubles with every crash up to
+	// this, 1m when zero
+	MaxRestartSec time.Duration
+
+	// MinUptime - a run shorter than this is a crash, a longer one resets
+	// the backoff, 10s when zero
+	MinUptime time.Duration
+
+	// MaxRestarts - crashes in a row that make a crash loop, the supervisor
+	// gives up and fails, 5 when zero. Negative never gives up.
+	MaxRestarts int
+
+	// StatusFile - where the state of the child is published for Query,
+	// the one set with Service.StatusFile or SuperviseStatusFile when
+	// empty. Query only finds it there.
+	StatusFile string
+}
+
+// Defaults of the zero SuperviseOptions
+func (opts *SuperviseOptions) defaults(service *Service) {
+	if opts.Restart == "" {
+		opts.Restart = "on-failure"
+	}
+	if opts.RestartSec <= 0 {
+		opts.RestartSec = time.Second
+	}
+	if opts.MaxRestartSec <= 0 {
+		opts.MaxRestartSec = time.Minute
+	}
+	if opts.MinUptime <= 0 {
+		opts.MinUptime = 10 * time.Second
+	}
+	if opts.MaxRestarts == 0 {
+		opts.MaxRestarts = 5
+	}
+	if opts.TimeoutStopSec <= 0 {
+		opts.TimeoutStopSec = service.StopTimeout
+	}
+	if opts.TimeoutStopSec <= 0 {
+		opts.TimeoutStopSec = DefaultStopTimeout
+	}
+	if opts.StatusFile == "" {
+		opts.StatusFile = service.superviseStatusFile()
+	}
+}
+
+// StatusFile sets where Supervise publishes the state of the child and
+// where Query, from any process, reads it, %i in the path is replaced by
+// the instance name. Call it before Console so the supervise and status
+// commands agree on it.
+func (service *Service) StatusFile(path string) {
+	service.statusFile = path
+}
+
+// The status file of the service: the one set with StatusFile, the
+// default one otherwise
+func (service *Service) superviseStatusFile() string {
+	if service.statusFile != "" {
+		return strings.ReplaceAll(service.statusFile, "%i", service.config.Instance)
+	}
+	return SuperviseStatusFile(service.name)
+}
+
+// SuperviseStatusFile returns where Supervise publishes the state of the
+// child of a service by default: in /run when it may write there, in the
+// temporary directory otherwise
+func SuperviseStatusFile(name string) string {
+	file := name + ".supervise.json"
+	if dirWritable("/run") {
+		return filepath.Join("/run", file)
+	}
+	return filepath.Join(os.TempDir(), file)
+}
+
+// The status file Supervise writes: the state of the child and the
+// process publishing it
+type supervisorStatus struct {
+	SupervisorPID int `json:"supervisor_pid"`
+	ServiceStatus
+}
+
+// childExit - how a child process ended
+type childExit struct {
+	// Code - the exit code, 128 + the signal number when killed by one
+	Code int
+
+	// Signal - the signal that killed it, nil when it exited
+	Signal os.Signal
+}
+
+// A clean exit in the systemd sense: code 0 or one of the signals a
+// service is stopped with
+func (exit childExit) clean() bool {
+	switch exit.Signal {
+	case nil:
+		return exit.Code == 0
+	case syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE:
+		return true
+	}
+	return false
+}
+
+// Whether the restart policy restarts a child that ended so, with the
+// meaning of the systemd Restart= values. There is no watchdog here,
+// on-watchdog never restarts.
+func restartChild(policy string, exit childExit) bool {
+	switch policy {
+	case "always":
+		return true
+	case "on-success":
+		return exit.clean()
+	case "on-failure":
+		return !exit.clean()
+	case "on-abnormal", "on-abort":
+		return exit.Signal != nil && !exit.clean()
+	}
+	return false
+}
+
+// Delay before the restart following crashes in a row, doubling from
+// RestartSec up to MaxRestartSec
+func (opts *SuperviseOptions) backoff(crashes int) time.Duration {
+	delay := opts.RestartSec
+	for i := 1; i < crashes && delay < opts.MaxRestartSec; i++ {
+		delay *= 2
+	}
+	return min(delay, opts.MaxRestartSec)
+}
+
+// ErrCrashLoop appears when Supervise gives up on a child crashing in a row
+var ErrCrashLoop = errors.New("crash loop")
+
+// Supervise runs the program of the service as a child process and keeps it
+// running, for hosts without an init system such as containers: the child
+// is restarted per the restart policy after a delay doubling with every
+// crash, and after MaxRestarts crashes in a row Supervise gives up with
+// ErrCrashLoop. SIGHUP, SIGUSR1 and SIGUSR2 are passed on to the child,
+// SIGINT and SIGTERM stop it within the stop timeout, a second one kills
+// it. As PID 1 the supervisor also reaps the orphaned processes of the
+// container. While it runs, Query and Status of the service, from this
+// or another process, report the state of the child.
+//
+// The exit code is the one of the child when it failed for good, 0 when it
+// ended cleanly or was stopped:
+//
+//	os.Exit(service.Supervise(context.Background(), daemon.SuperviseOptions{}).Code)
+func (service *Service) Supervise(ctx context.Context, opts SuperviseOptions) *Exit {
+	opts.defaults(service)
+	executable := opts.Executable
+	if executable == "" {
+		var err error
+		if executable, err = os.Executable(); err != nil {
+			return &Exit{Reason: ExitFailed, Code: 1, Err: err}
+		}
+	}
+	env := append(os.Environ(), opts.Environment...)
+	// the environment file overrides the options as it does under an init system
+	if vars, err := service.Env(); err == nil {
+		env = append(env, vars...)
+	}
+
+	supervisor := &supervisor{status: opts.StatusFile}
+	defer supervisor.remove()
+
+	// as PID 1, orphans are reaped between restarts too
+	reaper := startReaper()
+	defer reaper.stop()
+
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, forwardSignals...)...)
+	defer signal.Stop(signals)
+
+	crashes := 0
+	for {
+		cmd := exec.CommandContext(context.Background(), executable, opts.Args...)
+		cmd.Env = env
+		cmd.Dir = opts.WorkingDirectory
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		setChildAttr(cmd)
+		if err := reaper.start(cmd); err != nil {
+			supervisor.set(StateFailed, 0, 1)
+			return &Exit{Reason: ExitFailed, Code: 1, Err: err}
+		}
+		started := time.Now()
+		supervisor.started(cmd.Process.Pid, started)
+
+		exited := make(chan childExit, 1)
+		go func() {
+			exited <- reaper.wait(cmd)
+		}()
+
+		exit, stop := supervisor.wait(ctx, cmd.Process, exited, signals, opts.TimeoutStopSec)
+		if stop != nil {
+			return stop
+		}
+
+		if !restartChild(opts.Restart, exit) {
+			if !exit.clean() {
+				supervisor.set(StateFailed, 0, exit.Code)
+				return &Exit{Reason: ExitFailed, Code: exit.Code, Signal: exit.Signal, Err: fmt.Errorf("child exited with code %d", exit.Code)}
+			}
+			supervisor.set(StateStopped, 0, exit.Code)
+			return &Exit{Reason: ExitCompleted, Signal: exit.Signal}
+		}
+
+		crashes++
+		if time.Since(started) >= opts.MinUptime {
+			crashes = 1
+		}
+		if opts.MaxRestarts > 0 && crashes > opts.MaxRestarts {
+			supervisor.set(StateFailed, 0, exit.Code)
+			return &Exit{Reason: ExitFailed, Code: 1, Err: fmt.Errorf("%w: the child ended %d times in a row within %v", ErrCrashLoop, crashes, opts.MinUptime)}
+		}
+		delay := opts.backoff(crashes)
+		log.Printf("%s: child exited with code %d, restarting in %v", service.name, exit.Code, delay)
+		supervisor.set(StateStarting, 0, exit.Code)
+
+		timer := time.NewTimer(delay)
+		for waiting := true; waiting; {
+			select {
+			case <-timer.C:
+				waiting = false
+			case sig := <-signals:
+				if sig == os.Interrupt || sig == syscall.SIGTERM {
+					timer.Stop()
+					supervisor.set(StateStopped, 0, exit.Code)
+					return &Exit{Reason: ExitSignal, Signal: sig}
+				}
+			case <-ctx.Done():
+				timer.Stop()
+				supervisor.set(StateStopped, 0, exit.Code)
+				return &Exit{Reason: ExitCanceled}
+			}
+		}
+		supervisor.restarts++
+	}
+}
+
+// supervisor publishes the state of the child in the status file
+type supervisor struct {
+	status string
+
+	mu       sync.Mutex
+	current  ServiceStatus
+	restarts int
+}
+
+// Wait for the child to exit, stopping it on a signal or when ctx is done.
+// A non-nil Exit ends the supervision.
+func (supervisor *supervisor) wait(ctx context.Context, process *os.Process, exited <-chan childExit, signals <-chan os.Signal, timeout time.Duration) (childExit, *Exit) {
+	var stop *Exit
+	for stop == nil {
+		select {
+		case exit := <-exited:
+			return exit, nil
+		case sig := <-signals:
+			if sig != os.Interrupt && sig != syscall.SIGTERM {
+				process.Signal(sig)
+				continue
+			}
+			stop = &Exit{Reason: ExitSignal, Signal: sig}
+		case <-ctx.Done():
+			stop = &Exit{Reason: ExitCanceled}
+		}
+	}
+
+	supervisor.set(StateStopping, supervisor.current.PID, 0)
+	stopChild(process)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case exit := <-exited:
+			supervisor.set(StateStopped, 0, exit.Code)
+			return exit, stop
+		case sig := <-signals:
+			if sig != os.Interrupt && sig != syscall.SIGTERM {
+				process.Signal(sig)
+				continue
+			}
+			stop.Reason, stop.Signal, stop.Code = ExitForced, sig, 1
+		case <-deadline.C:
+			stop.Reason, stop.Code = ExitTimeout, 1
+			stop.Err = fmt.Errorf("child did not stop within %v", timeout)
+		}
+		process.Kill()
+		exit := <-exited
+		supervisor.set(StateStopped, 0, exit.Code)
+		return exit, stop
+	}
+}
+
+// The child is running
+func (supervisor *supervisor) started(pid int, at time.Time) {
+	supervisor.mu.Lock()
+	supervisor.current.StartedAt = at
+	supervisor.mu.Unlock()
+	supervisor.set(StateRunning, pid, 0)
+}
+
+// Publish a new state of the child
+func (supervisor *supervisor) set(state State, pid, exitCode int) {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	supervisor.current.State = state
+	supervisor.current.PID = pid
+	supervisor.current.ExitCode = exitCode
+	supervisor.current.Restarts = supervisor.restarts
+	supervisor.current.UnitPath = supervisor.status
+	data, _ := json.Marshal(supervisorStatus{os.Getpid(), supervisor.current})
+	if err := writeFileAtomic(supervisor.status, data); err != nil {
+		log.Printf("supervise: %v", err)
+	}
+}
+
+// Remove the status file, nothing supervises the service anymore
+func (supervisor *supervisor) remove() {
+	os.Remove(supervisor.status)
+}
+
+// Write a file through a rename so a reader never sees half of it
+func writeFileAtomic(path string, data []byte) error {
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// The state published by a running supervisor of the service, nil when
+// there is none
+func (service *Service) supervisedStatus() *ServiceStatus {
+	data, err := os.ReadFile(service.superviseStatusFile())
+	if err != nil {
+		return nil
+	}
+	var status supervisorStatus
+	if json.Unmarshal(data, &status) != nil || !processAlive(status.SupervisorPID) {
+		// left behind by a supervisor that was killed
+		return nil
+	}
+	return &status.ServiceStatus
+}
+
+// The supervise command of Console: the options of the manifest or of the
+// installed service, flags given on the command line take precedence
+func (service *Service) superviseCommand(flags []string) error {
+	path, flags, err := takeFlag(flags, "manifest")
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		manifest, err := LoadManifest(path)
+		if err != nil {
+			return err
+		}
+		if service, err = service.withManifest(manifest); err != nil {
+			return err
+		}
+	}
+	var opts SuperviseOptions
+	if service.manifest != nil {
+		opts.InstallOptions = *service.manifest
+	} else if installed, err := service.InstalledOptions(); err == nil {
+		opts.InstallOptions = *installed
+	}
+	opts.Environment = append([]string(nil), opts.Environment...)
+
+	var env listFlag
+	superviseCmd := service.flagSet("supervise")
+	superviseCmd.String("manifest", "", "Supervise the service described by a YAML or TOML manifest")
+	args := superviseCmd.String("args", "", "Arguments for the child")
+	superviseCmd.StringVar(&opts.WorkingDirectory, "workdir", opts.WorkingDirectory, "Working directory of the child")
+	superviseCmd.Var(&env, "env", "Environment variable KEY=VAL, may be repeated")
+	superviseCmd.StringVar(&opts.Restart, "restart", opts.Restart, "Restart policy: no, always, on-failure, ...")
+	superviseCmd.DurationVar(&opts.RestartSec, "restart-sec", opts.RestartSec, "First delay before the child is restarted, doubled on every crash")
+	superviseCmd.DurationVar(&opts.MaxRestartSec, "max-restart-sec", opts.MaxRestartSec, "Longest delay before the child is restarted")
+	superviseCmd.DurationVar(&opts.MinUptime, "min-uptime", opts.MinUptime, "A run shorter than this is a crash")
+	superviseCmd.IntVar(&opts.MaxRestarts, "max-restarts", opts.MaxRestarts, "Crashes in a row before giving up, negative never gives up")
+	superviseCmd.DurationVar(&opts.TimeoutStopSec, "timeout-stop", opts.TimeoutStopSec, "How long to wait for the child to stop")
+	if err := parseFlags(superviseCmd, flags); err != nil {
+		return err
+	}
+	if *args != "" {
+		opts.Args = strings.Fields(*args)
+	}
+	opts.Environment = append(opts.Environment, env...)
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	if exit := service.Supervise(context.Background(), opts); exit.Code != 0 {
+		return exit
+	}
+	return nil
+}
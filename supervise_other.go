@@ -0,0 +1,57 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Signals Supervise passes on to the child, none without unix signals
+var forwardSignals []os.Signal
+
+// The child runs with the attributes of the supervisor
+func setChildAttr(cmd *exec.Cmd) {}
+
+// reaper - there are no orphans to reap without unix processes, the
+// child is waited for
+type reaper struct{}
+
+// The reaper of Supervise, none here
+func startReaper() *reaper {
+	return nil
+}
+
+// Stop reaping
+func (reaper *reaper) stop() {}
+
+// Start the child
+func (reaper *reaper) start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+// Wait for the child to exit
+func (reaper *reaper) wait(cmd *exec.Cmd) childExit {
+	cmd.Wait()
+	return childExit{Code: cmd.ProcessState.ExitCode()}
+}
+
+// Stop the child, it cannot be asked to
+func stopChild(process *os.Process) {
+	process.Kill()
+}
+
+// Whether a process exists
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// Whether the process may create files in a directory, the temporary one
+// is used here
+func dirWritable(dir string) bool {
+	return false
+}
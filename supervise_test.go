@@ -0,0 +1,212 @@
+//go:build unix
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The child run by the Supervise tests: the test binary started again with
+// SUPERVISE_CHILD set to exit:N or serve
+func TestSuperviseChild(t *testing.T) {
+	mode := os.Getenv("SUPERVISE_CHILD")
+	if mode == "" {
+		t.Skip("run as the child of the Supervise tests")
+	}
+	if code, ok := strings.CutPrefix(mode, "exit:"); ok {
+		n, _ := strconv.Atoi(code)
+		os.Exit(n)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	<-signals
+	os.Exit(0)
+}
+
+// Options running the test binary as the child
+func childOptions(t *testing.T, mode string) SuperviseOptions {
+	t.Setenv("SUPERVISE_CHILD", mode)
+	return SuperviseOptions{
+		InstallOptions: InstallOptions{
+			Executable: os.Args[0],
+			Args:       []string{"-test.run=^TestSuperviseChild$"},
+			RestartSec: time.Millisecond,
+		},
+		StatusFile: filepath.Join(t.TempDir(), "status.json"),
+	}
+}
+
+func TestRestartChild(t *testing.T) {
+	crash := childExit{Code: 134, Signal: syscall.SIGABRT}
+	stopped := childExit{Code: 143, Signal: syscall.SIGTERM}
+	failed := childExit{Code: 1}
+	done := childExit{}
+	for _, test := range []struct {
+		policy string
+		exit   childExit
+		want   bool
+	}{
+		{"no", crash, false},
+		{"always", done, true},
+		{"on-success", done, true},
+		{"on-success", failed, false},
+		{"on-failure", failed, true},
+		{"on-failure", crash, true},
+		{"on-failure", stopped, false},
+		{"on-failure", done, false},
+		{"on-abnormal", crash, true},
+		{"on-abnormal", failed, false},
+		{"on-abort", stopped, false},
+		{"on-watchdog", crash, false},
+	} {
+		if got := restartChild(test.policy, test.exit); got != test.want {
+			t.Errorf("%s after %+v: got %v, want %v", test.policy, test.exit, got, test.want)
+		}
+	}
+}
+
+func TestSuperviseBackoff(t *testing.T) {
+	opts := SuperviseOptions{InstallOptions: InstallOptions{RestartSec: time.Second}, MaxRestartSec: 5 * time.Second}
+	for crashes, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if got := opts.backoff(crashes); got != want {
+			t.Errorf("after %d crashes: got %v, want %v", crashes, got, want)
+		}
+	}
+}
+
+func TestSuperviseCrashLoop(t *testing.T) {
+	opts := childOptions(t, "exit:3")
+	opts.MaxRestarts = 2
+	opts.MinUptime = time.Hour
+	exit := testService().Supervise(context.Background(), opts)
+	if exit.Reason != ExitFailed || exit.Code != 1 || !errors.Is(exit.Err, ErrCrashLoop) {
+		t.Errorf("unexpected exit %v", exit)
+	}
+	if _, err := os.Stat(opts.StatusFile); !os.IsNotExist(err) {
+		t.Errorf("status file left behind: %v", err)
+	}
+
+	// not restarted, the exit code is passed on
+	opts.Restart = "no"
+	if exit := testService().Supervise(context.Background(), opts); exit.Reason != ExitFailed || exit.Code != 3 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+	opts = childOptions(t, "exit:0")
+	if exit := testService().Supervise(context.Background(), opts); exit.Reason != ExitCompleted || exit.Code != 0 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+}
+
+func TestSuperviseStatus(t *testing.T) {
+	service := testService()
+	service.name = "supervise-test-" + strconv.Itoa(os.Getpid())
+	opts := childOptions(t, "serve")
+	opts.StatusFile = ""
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan *Exit, 1)
+	go func() {
+		result <- service.Supervise(ctx, opts)
+	}()
+	var status *ServiceStatus
+	for i := 0; i < 100; i++ {
+		if status = service.supervisedStatus(); status != nil && status.State == StateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status == nil || status.State != StateRunning || status.PID == 0 || status.StartedAt.IsZero() {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if queried, err := service.Query(); err != nil || queried.PID != status.PID {
+		t.Errorf("query: %+v, %v", queried, err)
+	}
+
+	cancel()
+	if exit := <-result; exit.Reason != ExitCanceled || exit.Code != 0 {
+		t.Errorf("unexpected exit %v", exit)
+	}
+	if syscall.Kill(status.PID, 0) == nil {
+		t.Error("child still running after stop")
+	}
+	if service.supervisedStatus() != nil {
+		t.Error("status still published after stop")
+	}
+}
+
+func TestSuperviseStatusFile(t *testing.T) {
+	service := testService()
+	service.StatusFile(filepath.Join(t.TempDir(), "%i.json"))
+	instance, err := service.Instance("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(filepath.Dir(service.statusFile), "one.json")
+	if got := instance.superviseStatusFile(); got != path {
+		t.Fatalf("status file %q, want %q", got, path)
+	}
+
+	// another process reads what the supervisor wrote there
+	opts := childOptions(t, "serve")
+	opts.StatusFile = ""
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan *Exit, 1)
+	go func() {
+		result <- instance.Supervise(ctx, opts)
+	}()
+	reader := testService()
+	reader.StatusFile(service.statusFile)
+	if reader, err = reader.Instance("one"); err != nil {
+		t.Fatal(err)
+	}
+	var status *ServiceStatus
+	for i := 0; i < 100; i++ {
+		if status = reader.supervisedStatus(); status != nil && status.State == StateRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status == nil || status.State != StateRunning || status.UnitPath != path {
+		t.Errorf("unexpected status %+v", status)
+	}
+	cancel()
+	<-result
+}
+
+func TestReaper(t *testing.T) {
+	reaper := newReaper()
+	defer reaper.stop()
+
+	// a process nobody waits for, as an orphan of the container is
+	orphan := exec.Command(os.Args[0], "-test.run=^TestSuperviseChild$")
+	orphan.Env = append(os.Environ(), "SUPERVISE_CHILD=exit:0")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	child := exec.Command(os.Args[0], "-test.run=^TestSuperviseChild$")
+	child.Env = append(os.Environ(), "SUPERVISE_CHILD=exit:3")
+	if err := reaper.start(child); err != nil {
+		t.Fatal(err)
+	}
+	if exit := reaper.wait(child); exit.Code != 3 || exit.Signal != nil {
+		t.Errorf("unexpected exit %+v", exit)
+	}
+	for i := 0; i < 100; i++ {
+		// a zombie exists until it is reaped
+		if !processAlive(orphan.Process.Pid) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("orphan not reaped")
+}
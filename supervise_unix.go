@@ -0,0 +1,152 @@
+//go:build unix
+
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Signals Supervise passes on to the child
+var forwardSignals = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// The child gets a process group of its own so a Ctrl-C in the terminal
+// reaches it once, through the supervisor
+func setChildAttr(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// reaper - as PID 1 the supervisor inherits the orphans of the container.
+// It reaps every process that exits, for as long as Supervise runs, and
+// hands the exit of the child to the one waiting for it.
+type reaper struct {
+	mu      sync.Mutex
+	waiters map[int]chan childExit
+
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+// The reaper of Supervise, nil unless the supervisor is PID 1
+func startReaper() *reaper {
+	if os.Getpid() != 1 {
+		return nil
+	}
+	return newReaper()
+}
+
+// Reap on every SIGCHLD until stop
+func newReaper() *reaper {
+	reaper := &reaper{
+		waiters: make(map[int]chan childExit),
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+	signal.Notify(reaper.signals, syscall.SIGCHLD)
+	go func() {
+		for {
+			reaper.reap()
+			select {
+			case <-reaper.signals:
+			case <-reaper.done:
+				return
+			}
+		}
+	}()
+	return reaper
+}
+
+// Reap the processes that exited, without blocking
+func (reaper *reaper) reap() {
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+		if !status.Exited() && !status.Signaled() {
+			continue
+		}
+		reaper.mu.Lock()
+		if waiter, ok := reaper.waiters[pid]; ok {
+			waiter <- waitExit(status)
+		}
+		reaper.mu.Unlock()
+	}
+}
+
+// Stop reaping
+func (reaper *reaper) stop() {
+	if reaper == nil {
+		return
+	}
+	signal.Stop(reaper.signals)
+	close(reaper.done)
+}
+
+// Start the child. The reaper cannot hand its exit out before the child
+// is known to it.
+func (reaper *reaper) start(cmd *exec.Cmd) error {
+	if reaper == nil {
+		return cmd.Start()
+	}
+	reaper.mu.Lock()
+	defer reaper.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	reaper.waiters[cmd.Process.Pid] = make(chan childExit, 1)
+	return nil
+}
+
+// Wait for the child to exit
+func (reaper *reaper) wait(cmd *exec.Cmd) childExit {
+	if reaper == nil {
+		cmd.Wait()
+		status, _ := cmd.ProcessState.Sys().(syscall.WaitStatus)
+		return waitExit(status)
+	}
+	pid := cmd.Process.Pid
+	reaper.mu.Lock()
+	waiter := reaper.waiters[pid]
+	reaper.mu.Unlock()
+	exit := <-waiter
+	reaper.mu.Lock()
+	delete(reaper.waiters, pid)
+	reaper.mu.Unlock()
+	cmd.Process.Release()
+	return exit
+}
+
+// How a process ended from its wait status
+func waitExit(status syscall.WaitStatus) childExit {
+	if status.Signaled() {
+		return childExit{Code: 128 + int(status.Signal()), Signal: status.Signal()}
+	}
+	return childExit{Code: status.ExitStatus()}
+}
+
+// Ask the child to stop
+func stopChild(process *os.Process) {
+	process.Signal(syscall.SIGTERM)
+}
+
+// Whether a process exists, a process of another user does too
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Whether the process may create files in a directory
+func dirWritable(dir string) bool {
+	return syscall.Access(dir, 2) == nil
+}